@@ -0,0 +1,457 @@
+// Package cassette records the requests of a client.Client to a directory, and replays them, so a
+// library can be synced again offline and a reported problem reproduced without its account.
+//
+// A cassette holds one JSON file per request, numbered in the order of the responses. What grants
+// access is scrubbed: only a few response headers are kept, and baseUrls and page tokens are
+// replaced by hashes of themselves, which replay matches just as well. Media bodies are only kept
+// WithMedia; otherwise a short placeholder stands in for each, replayed with the Content-Type
+// client.PlaceholderType so that it is never saved as the media.
+package cassette
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"velocitizer.com/photogo/client"
+)
+
+// Interaction is a recorded request and its response, the contents of a cassette file
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Range  string `json:"range,omitempty"`
+	// JSON is the body of a search
+	JSON json.RawMessage `json:"json,omitempty"`
+}
+
+type Response struct {
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+	// JSON is a JSON body, Body any other, unless the body is in BodyFile
+	JSON json.RawMessage `json:"json,omitempty"`
+	Body string          `json:"body,omitempty"`
+	// BodyFile is the file of a media body, next to the interaction
+	BodyFile string `json:"bodyFile,omitempty"`
+	// Placeholder is true when the media was not recorded and replays as a placeholder, of
+	// Content-Type client.PlaceholderType
+	Placeholder bool `json:"placeholder,omitempty"`
+}
+
+// keptHeaders are the response headers recorded
+var keptHeaders = []string{"Content-Type", "Content-Range", "Accept-Ranges", "ETag", "Retry-After"}
+
+// Option configures Record
+type Option func(*recorder)
+
+// WithMedia records media bodies, which can be large and are the private photos themselves
+func WithMedia(enabled bool) Option {
+	return func(r *recorder) {
+		r.media = enabled
+	}
+}
+
+type recorder struct {
+	dir   string
+	media bool
+
+	mu   sync.Mutex
+	next int
+}
+
+// Record is a client.Middleware writing every request and response to the cassette in dir,
+// which is created if needed. Requests are recorded as they are answered, so it goes innermost to
+// record every attempt of client.Retry. Failures to record are returned as failures of the request.
+func Record(dir string, options ...Option) client.Middleware {
+	r := &recorder{dir: dir}
+	for _, option := range options {
+		option(r)
+	}
+	return func(next client.Getter) client.Getter {
+		return func(req *http.Request) (*http.Response, error) {
+			response, err := next(req)
+			if err != nil {
+				return response, err
+			}
+			if err := r.record(req, response); err != nil {
+				response.Body.Close()
+				return nil, fmt.Errorf("failed to record %s: %v", client.Redact(req.URL.String()), err)
+			}
+			return response, nil
+		}
+	}
+}
+
+// record writes the interaction. Media is left for the caller to stream: a placeholder is
+// recorded at once, and recorded media is copied to its file as the caller reads it. Other
+// bodies, the small answers of the API, are read and replaced by what was read.
+func (r *recorder) record(req *http.Request, response *http.Response) error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.next++
+	n := r.next
+	r.mu.Unlock()
+
+	request, err := scrubRequest(req)
+	if err != nil {
+		return err
+	}
+	interaction := Interaction{
+		Request:  request,
+		Response: Response{Status: response.StatusCode, Header: map[string]string{}},
+	}
+	for _, name := range keptHeaders {
+		if value := response.Header.Get(name); value != "" {
+			interaction.Response.Header[name] = value
+		}
+	}
+	contentType := response.Header.Get("Content-Type")
+	if isMedia(req, contentType) {
+		if !r.media {
+			placeholder(&interaction.Response)
+			return r.write(n, interaction)
+		}
+		return r.tee(n, interaction, response)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if strings.Contains(contentType, "json") && json.Valid(body) {
+		if interaction.Response.JSON, err = scrubJSON(body); err != nil {
+			return err
+		}
+	} else {
+		interaction.Response.Body = client.Redact(string(body))
+	}
+	return r.write(n, interaction)
+}
+
+// placeholder makes response replay as a placeholder for media that was not recorded
+func placeholder(response *Response) {
+	response.Placeholder = true
+	// the placeholder is always whole
+	delete(response.Header, "Content-Range")
+	delete(response.Header, "Accept-Ranges")
+	if response.Status == http.StatusPartialContent {
+		response.Status = http.StatusOK
+	}
+}
+
+// tee replaces the body of response with one copying the media into its file as it is read.
+// The interaction is written once the body is closed, as a placeholder when it was not read
+// to the end, rather than replay truncated media.
+func (r *recorder) tee(n int, interaction Interaction, response *http.Response) error {
+	interaction.Response.BodyFile = fmt.Sprintf("%05d.body", n)
+	file, err := os.Create(filepath.Join(r.dir, interaction.Response.BodyFile))
+	if err != nil {
+		return err
+	}
+	response.Body = &teeBody{body: response.Body, file: file, finish: func(complete bool) error {
+		if !complete {
+			if err := os.Remove(file.Name()); err != nil {
+				return err
+			}
+			interaction.Response.BodyFile = ""
+			placeholder(&interaction.Response)
+		}
+		return r.write(n, interaction)
+	}}
+	return nil
+}
+
+// write saves the interaction as the n-th of the cassette
+func (r *recorder) write(n int, interaction Interaction) error {
+	b, err := json.MarshalIndent(interaction, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(r.dir, fmt.Sprintf("%05d.json", n)), append(b, '\n'), 0644)
+}
+
+// teeBody copies a media body to file as it is read, and finishes the recording when closed
+type teeBody struct {
+	body   io.ReadCloser
+	file   *os.File
+	finish func(complete bool) error
+	eof    bool
+	closed bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		if _, writeErr := b.file.Write(p[:n]); writeErr != nil {
+			return n, fmt.Errorf("failed to record: %v", writeErr)
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	err := b.body.Close()
+	if closeErr := b.file.Close(); closeErr != nil {
+		b.eof = false
+	}
+	if finishErr := b.finish(b.eof); err == nil && finishErr != nil {
+		err = fmt.Errorf("failed to record: %v", finishErr)
+	}
+	return err
+}
+
+// scrubRequest is the request as recorded
+func scrubRequest(req *http.Request) (Request, error) {
+	request := Request{Method: req.Method, URL: scrubURL(req.URL), Range: req.Header.Get("Range")}
+	if req.GetBody == nil {
+		return request, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return request, err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil || len(b) == 0 {
+		return request, err
+	}
+	if request.JSON, err = scrubJSON(b); err != nil {
+		return request, fmt.Errorf("body is not JSON: %v", err)
+	}
+	return request, nil
+}
+
+// isMedia is whether the response is the bytes of media, rather than an API response
+func isMedia(req *http.Request, contentType string) bool {
+	return isBaseURL(req.URL) && !strings.HasPrefix(contentType, "text/") && !strings.Contains(contentType, "json")
+}
+
+// isBaseURL is whether u is media, anything but the API itself
+func isBaseURL(u *url.URL) bool {
+	return !strings.HasPrefix(u.Path, "/v1/")
+}
+
+// hashed matches what hash returns
+var hashed = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// hash stands in for a secret: the same secret always has the same hash, and it can not be reversed.
+// A hash is kept as it is, as replay scrubs the baseUrls and page tokens it served once more,
+// and an empty one stays empty.
+func hash(secret string) string {
+	if secret == "" || hashed.MatchString(secret) {
+		return secret
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// downloadSuffix is what the client appends to a baseUrl, such as =d or =dv
+var downloadSuffix = regexp.MustCompile(`=[a-z0-9-]{1,8}$`)
+
+// scrubURL hashes the baseUrl of a download and the page token of a listing, and drops credentials
+func scrubURL(u *url.URL) string {
+	scrubbed := *u
+	scrubbed.User = nil
+	if isBaseURL(u) {
+		suffix := downloadSuffix.FindString(u.Path)
+		scrubbed.Path, scrubbed.RawPath = "/"+hash(strings.TrimPrefix(strings.TrimSuffix(u.Path, suffix), "/"))+suffix, ""
+	}
+	query := u.Query()
+	for _, key := range []string{"pageToken", "access_token", "key"} {
+		if query.Has(key) {
+			query.Set(key, hash(query.Get(key)))
+		}
+	}
+	scrubbed.RawQuery = query.Encode()
+	return scrubbed.String()
+}
+
+// scrubJSON replaces the baseUrls and page tokens of a JSON body
+func scrubJSON(body []byte) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// numbers stay as they were written
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(scrubValue("", v))
+	return json.RawMessage(b), err
+}
+
+func scrubValue(key string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, value := range v {
+			v[k] = scrubValue(k, value)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = scrubValue(key, value)
+		}
+	case string:
+		switch key {
+		case "baseUrl":
+			if u, err := url.Parse(v); err == nil {
+				return scrubURL(u)
+			}
+			return hash(v)
+		case "nextPageToken", "pageToken":
+			return hash(v)
+		}
+	}
+	return v
+}
+
+// Replay returns a Getter answering the requests recorded in dir. Requests are matched by method,
+// path, query and range, after the same scrubbing as recording; a request recorded more than once gets
+// its responses in the order they were recorded, the last one from then on. Media requested with
+// a range that was not recorded gets the media recorded without it.
+func Replay(dir string) (client.Getter, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no cassette in %s", dir)
+	}
+	// in the order they were recorded, which the width of the numbers only gives up to 99999
+	slices.SortStableFunc(names, func(a, b string) int {
+		return cmp.Compare(interactionNumber(a), interactionNumber(b))
+	})
+	p := &player{dir: dir, responses: map[string][]Response{}}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(b, &interaction); err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: %v", name, err)
+		}
+		key := matchKey(interaction.Request)
+		p.responses[key] = append(p.responses[key], interaction.Response)
+	}
+	return p.serve, nil
+}
+
+// interactionNumber is the number of the cassette file name, after the others when it has none
+func interactionNumber(name string) int {
+	n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".json"))
+	if err != nil {
+		return math.MaxInt
+	}
+	return n
+}
+
+type player struct {
+	dir string
+
+	mu        sync.Mutex
+	responses map[string][]Response
+}
+
+// matchKey identifies a request by its path and query, so a cassette replays whatever the host
+// of the API or its baseUrls
+func matchKey(request Request) string {
+	requestURI := request.URL
+	if u, err := url.Parse(request.URL); err == nil {
+		requestURI = u.RequestURI()
+	}
+	return strings.Join([]string{request.Method, requestURI, request.Range, string(request.JSON)}, " ")
+}
+
+func (p *player) serve(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	request, err := scrubRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	response, ok := p.take(matchKey(request))
+	if !ok && request.Range != "" && isBaseURL(req.URL) {
+		request.Range = ""
+		response, ok = p.take(matchKey(request))
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s %s was not recorded", req.Method, client.Redact(request.URL))
+	}
+	var body []byte
+	switch {
+	case response.JSON != nil:
+		body = response.JSON
+	case response.BodyFile != "":
+		var err error
+		if body, err = os.ReadFile(filepath.Join(p.dir, response.BodyFile)); err != nil {
+			return nil, err
+		}
+	case response.Placeholder:
+		body = []byte("photogo cassette placeholder for " + request.URL)
+	default:
+		body = []byte(response.Body)
+	}
+	header := http.Header{}
+	for name, value := range response.Header {
+		header.Set(name, value)
+	}
+	if response.Placeholder {
+		// which the client refuses as media
+		header.Set("Content-Type", client.PlaceholderType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", response.Status, http.StatusText(response.Status)),
+		StatusCode:    response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// take returns the next response of key, keeping the last one
+func (p *player) take(key string) (Response, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queue := p.responses[key]
+	if len(queue) == 0 {
+		return Response{}, false
+	}
+	if len(queue) > 1 {
+		p.responses[key] = queue[1:]
+	}
+	return queue[0], true
+}
@@ -0,0 +1,263 @@
+package cassette_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/client/cassette"
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/photos"
+	"velocitizer.com/photogo/photos/photostest"
+	"velocitizer.com/photogo/storage"
+)
+
+func library(count int) *photostest.Server {
+	var items []photostest.Item
+	for i := 0; i < count; i++ {
+		items = append(items, photostest.Item{
+			MediaItem: data.MediaItem{
+				ID:       fmt.Sprintf("id-%d", i),
+				Filename: fmt.Sprintf("IMG_%04d.JPG", i),
+				MimeType: "image/jpeg",
+				Metadata: data.MediaMetadata{CreationTime: time.Date(2021, 9, 13, 15, 4, 5, 0, time.UTC)},
+			},
+			Content: []byte(fmt.Sprintf("image %d", i)),
+		})
+	}
+	return photostest.NewServer(items...)
+}
+
+// files are the media files of store with their contents
+func files(t *testing.T, store *storage.Memory) map[string]string {
+	contents := map[string]string{}
+	for _, name := range store.Writes() {
+		if filepath.Ext(name) != ".JPG" {
+			continue
+		}
+		b, err := store.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			// discarded
+			continue
+		}
+		require.NoError(t, err)
+		contents[name] = string(b)
+	}
+	return contents
+}
+
+func TestReplay(t *testing.T) {
+	t.Run("replays a sync offline", func(t *testing.T) {
+		server := library(30)
+		dir := t.TempDir()
+		recording := client.New(server.Client().Do, client.WithBaseURL(server.URL),
+			client.WithMiddleware(cassette.Record(dir, cassette.WithMedia(true))))
+		recorded := storage.NewMemory()
+		require.NoError(t, photos.Extract(context.Background(), recording, recorded, 3, false))
+		server.Close()
+
+		replay, err := cassette.Replay(dir)
+		require.NoError(t, err)
+		replayed := storage.NewMemory()
+		require.NoError(t, photos.Extract(context.Background(), client.New(replay), replayed, 3, false))
+		assert.Len(t, files(t, replayed), 30)
+		assert.Equal(t, files(t, recorded), files(t, replayed))
+	})
+	t.Run("media is a placeholder unless recorded", func(t *testing.T) {
+		server := library(3)
+		defer server.Close()
+		dir := t.TempDir()
+		recording := client.New(server.Client().Do, client.WithBaseURL(server.URL), client.WithMiddleware(cassette.Record(dir)))
+		require.NoError(t, photos.Extract(context.Background(), recording, storage.NewMemory(), 1, false))
+		bodies, err := filepath.Glob(filepath.Join(dir, "*.body"))
+		require.NoError(t, err)
+		assert.Empty(t, bodies)
+
+		replay, err := cassette.Replay(dir)
+		require.NoError(t, err)
+		replayed := storage.NewMemory()
+		c := photos.NewController()
+		require.NoError(t, photos.Extract(context.Background(), client.New(replay), replayed, 1, false, photos.WithController(c)))
+		assert.Empty(t, files(t, replayed), "placeholders are not saved")
+		assert.Equal(t, int64(3), c.Status().Progress.Skipped)
+	})
+	t.Run("requests that were not recorded fail", func(t *testing.T) {
+		server := library(1)
+		defer server.Close()
+		dir := t.TempDir()
+		recording := client.New(server.Client().Do, client.WithBaseURL(server.URL), client.WithMiddleware(cassette.Record(dir)))
+		_, err := recording.List(context.Background(), "")
+		require.NoError(t, err)
+
+		replay, err := cassette.Replay(dir)
+		require.NoError(t, err)
+		_, err = client.New(replay).List(context.Background(), "other-page")
+		assert.Error(t, err)
+		_, err = cassette.Replay(t.TempDir())
+		assert.Error(t, err, "an empty cassette")
+	})
+	t.Run("responses recorded twice replay in order", func(t *testing.T) {
+		server := library(1)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.List, Status: http.StatusServiceUnavailable, Times: 1})
+		dir := t.TempDir()
+		recording := client.New(server.Client().Do, client.WithBaseURL(server.URL),
+			client.WithMiddleware(client.Retry(2, time.Millisecond), cassette.Record(dir)))
+		_, err := recording.List(context.Background(), "")
+		require.NoError(t, err)
+
+		replay, err := cassette.Replay(dir)
+		require.NoError(t, err)
+		replaying := client.New(replay)
+		_, err = replaying.List(context.Background(), "")
+		var apiErr *client.APIError
+		require.True(t, errors.As(err, &apiErr), "got %v", err)
+		assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+		medias, err := replaying.List(context.Background(), "")
+		require.NoError(t, err)
+		assert.Len(t, medias.MediaItems, 1)
+	})
+	t.Run("past 99999 interactions replay in number order", func(t *testing.T) {
+		dir := t.TempDir()
+		for n, token := range map[int]string{99_999: "first", 100_000: "second"} {
+			b, err := json.Marshal(cassette.Interaction{
+				Request:  cassette.Request{Method: http.MethodGet, URL: "https://photoslibrary.googleapis.com/v1/mediaItems?pageSize=25"},
+				Response: cassette.Response{Status: http.StatusOK, JSON: json.RawMessage(fmt.Sprintf(`{"nextPageToken":%q}`, token))},
+			})
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%05d.json", n)), b, 0644))
+		}
+		replay, err := cassette.Replay(dir)
+		require.NoError(t, err)
+		c := client.New(replay)
+		for _, want := range []string{"first", "second"} {
+			medias, err := c.List(context.Background(), "")
+			require.NoError(t, err)
+			assert.Equal(t, want, medias.NextPageToken)
+		}
+	})
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestRecord_Streams(t *testing.T) {
+	content := bytes.Repeat([]byte("jpeg"), 1<<16)
+	var body *countingReader
+	getter := func(r *http.Request) (*http.Response, error) {
+		body = &countingReader{r: bytes.NewReader(content)}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"image/jpeg"}}, Body: io.NopCloser(body)}, nil
+	}
+	download := func(t *testing.T, record client.Middleware, read int64) {
+		request, _ := http.NewRequest(http.MethodGet, "https://lh3.googleusercontent.com/secret=d", nil)
+		response, err := client.Chain(getter, record)(request)
+		require.NoError(t, err)
+		assert.Zero(t, body.read, "the body is left to the caller")
+		got, err := io.ReadAll(io.LimitReader(response.Body, read))
+		require.NoError(t, err)
+		assert.Equal(t, content[:len(got)], got)
+		require.NoError(t, response.Body.Close())
+	}
+	// replay returns the replayed media, nil for a placeholder
+	replay := func(t *testing.T, dir string) []byte {
+		replay, err := cassette.Replay(dir)
+		require.NoError(t, err)
+		request, _ := http.NewRequest(http.MethodGet, "https://lh3.googleusercontent.com/secret=d", nil)
+		response, err := replay(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		b, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		if response.Header.Get("Content-Type") == client.PlaceholderType {
+			assert.Contains(t, string(b), "photogo cassette placeholder")
+			return nil
+		}
+		assert.Equal(t, "image/jpeg", response.Header.Get("Content-Type"))
+		return b
+	}
+
+	t.Run("a placeholder without reading the media", func(t *testing.T) {
+		dir := t.TempDir()
+		download(t, cassette.Record(dir), 0)
+		assert.Nil(t, replay(t, dir))
+	})
+	t.Run("media copied as it is read", func(t *testing.T) {
+		dir := t.TempDir()
+		download(t, cassette.Record(dir, cassette.WithMedia(true)), int64(len(content))+1)
+		assert.Equal(t, content, replay(t, dir))
+	})
+	t.Run("media read in part is a placeholder", func(t *testing.T) {
+		dir := t.TempDir()
+		download(t, cassette.Record(dir, cassette.WithMedia(true)), 10)
+		assert.Nil(t, replay(t, dir))
+		bodies, err := filepath.Glob(filepath.Join(dir, "*.body"))
+		require.NoError(t, err)
+		assert.Empty(t, bodies)
+	})
+}
+
+func TestRecord_Scrubs(t *testing.T) {
+	const baseURL = "https://lh3.googleusercontent.com/lr/SECRETSIGNATURE"
+	getter := func(r *http.Request) (*http.Response, error) {
+		response := httptest.NewRecorder()
+		if r.URL.Host == "lh3.googleusercontent.com" {
+			response.Header().Set("Content-Type", "image/jpeg")
+			response.Header().Set("Set-Cookie", "session=SECRETCOOKIE")
+			response.WriteString("jpeg")
+			return response.Result(), nil
+		}
+		response.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		fmt.Fprintf(response, `{"mediaItems":[{"id":"AB12","baseUrl":%q,"mimeType":"image/jpeg","filename":"a.jpg"}],"nextPageToken":"SECRETPAGE"}`, baseURL)
+		return response.Result(), nil
+	}
+	dir := t.TempDir()
+	c := client.New(getter, client.WithMiddleware(cassette.Record(dir, cassette.WithMedia(true))))
+	medias, err := c.List(context.Background(), "SECRETPREVIOUS")
+	require.NoError(t, err)
+	b, err := c.Get(context.Background(), *medias.MediaItems[0])
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", string(b), "the caller still gets the body")
+
+	var recorded bytes.Buffer
+	require.NoError(t, filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(name)
+		recorded.Write(b)
+		return err
+	}))
+	assert.NotContains(t, recorded.String(), "SECRET")
+	assert.Contains(t, recorded.String(), `"id": "AB12"`)
+
+	replay, err := cassette.Replay(dir)
+	require.NoError(t, err)
+	replayed, err := client.New(replay).List(context.Background(), "SECRETPREVIOUS")
+	require.NoError(t, err, "the scrubbed cassette replays the original requests")
+	assert.NotEqual(t, baseURL, replayed.MediaItems[0].BaseUrl)
+	b, err = client.New(replay).Get(context.Background(), *replayed.MediaItems[0])
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", string(b))
+}
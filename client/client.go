@@ -3,10 +3,13 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"velocitizer.com/photogo/data"
@@ -15,13 +18,43 @@ import (
 type Getter func(*http.Request) (resp *http.Response, err error)
 
 type Client struct {
-	getter Getter
+	getter  Getter
+	baseURL string
+	limiter *Limiter
+	log     *slog.Logger
+	// middleware wraps getter, the first outermost
+	middleware []Middleware
 }
 
+// Option configures a Client
+type Option func(*Client)
+
 const pageSize = "25"
 
-func New(getter Getter) *Client {
-	return &Client{getter: getter}
+// DefaultBaseURL is the Google Photos Library API
+const DefaultBaseURL = "https://photoslibrary.googleapis.com"
+
+func New(getter Getter, options ...Option) *Client {
+	c := &Client{getter: getter, baseURL: DefaultBaseURL, log: slog.Default()}
+	for _, option := range options {
+		option(c)
+	}
+	c.getter = Chain(getter, c.middleware...)
+	return c
+}
+
+// WithLogger sets the logger of error responses and downloads, slog.Default() by default
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.log = logger
+	}
+}
+
+// WithBaseURL points the client at another Library API, such as a photostest.Server
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
 }
 
 func (c Client) List(ctx context.Context, nextPageToken string) (*data.MediaResponse, error) {
@@ -30,24 +63,17 @@ func (c Client) List(ctx context.Context, nextPageToken string) (*data.MediaResp
 	if nextPageToken != "" {
 		values.Set("pageToken", nextPageToken)
 	}
-	url := fmt.Sprintf("%s?%s", "https://photoslibrary.googleapis.com/v1/mediaItems", values.Encode())
+	url := fmt.Sprintf("%s/v1/mediaItems?%s", c.baseURL, values.Encode())
 	get, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
 	response, err := c.getter(get)
 	if err != nil {
 		if response != nil && response.Body != nil {
-			defer response.Body.Close()
-			b, _ := io.ReadAll(response.Body)
-			fmt.Println("body from error:", string(b))
+			response.Body.Close()
 		}
 		return nil, err
 	}
 	if response.StatusCode != http.StatusOK {
-		if response.Body != nil {
-			defer response.Body.Close()
-			b, _ := io.ReadAll(response.Body)
-			fmt.Println("body from error:", string(b))
-		}
-		return nil, fmt.Errorf("list call returned: %d:%s", response.StatusCode, http.StatusText(response.StatusCode))
+		return nil, NewAPIError(RequestList, "", response)
 	}
 	defer response.Body.Close()
 	var medias data.MediaResponse
@@ -57,23 +83,140 @@ func (c Client) List(ctx context.Context, nextPageToken string) (*data.MediaResp
 	return &medias, nil
 }
 
+// Do makes a request through the middleware of the client, for the calls of other Google APIs
+func (c Client) Do(r *http.Request) (*http.Response, error) {
+	return c.getter(r)
+}
+
+// Item gets a media item by id, with a new baseUrl
+func (c Client) Item(ctx context.Context, id string) (*data.MediaItem, error) {
+	get, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/mediaItems/%s", c.baseURL, url.PathEscape(id)), nil)
+	response, err := c.getter(get)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get item (%s): %w", id, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, NewAPIError(RequestItem, id, response)
+	}
+	defer response.Body.Close()
+	var mediaItem data.MediaItem
+	if err := json.NewDecoder(response.Body).Decode(&mediaItem); err != nil {
+		return nil, err
+	}
+	return &mediaItem, nil
+}
+
 func (c Client) Get(ctx context.Context, mediaItem data.MediaItem) ([]byte, error) {
+	download, err := c.Download(ctx, mediaItem, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	defer download.Body.Close()
+
+	return io.ReadAll(download.Body)
+}
+
+// PlaceholderType is the Content-Type of what a cassette replays in place of media it did not record
+const PlaceholderType = "application/x-photogo-placeholder"
+
+// ErrPlaceholder is returned by Download for a PlaceholderType response, which is not the media
+var ErrPlaceholder = errors.New("media was not recorded, only a placeholder")
+
+// Download is the response to Client.Download
+type Download struct {
+	Body io.ReadCloser
+	// Offset is where Body starts in the media, zero when the server sent all of it
+	Offset int64
+	// Size is the size of the whole media, -1 when the server did not say
+	Size int64
+	// ETag identifies this version of the media, empty when the server did not send one
+	ETag string
+	// Ranges is true when the server announced it accepts Range requests
+	Ranges bool
+}
+
+// Download requests the media from offset with a Range request. With an etag the range is only
+// honored while the media is unchanged (If-Range). Servers that ignore ranges send the whole media.
+func (c Client) Download(ctx context.Context, mediaItem data.MediaItem, offset int64, etag string) (*Download, error) {
+	return c.DownloadRange(ctx, mediaItem, offset, -1, etag)
+}
+
+// DownloadRange is Download of the bytes from start to end inclusive, to the end of the media when end is -1
+func (c Client) DownloadRange(ctx context.Context, mediaItem data.MediaItem, start, end int64, etag string) (*Download, error) {
 	get, _ := http.NewRequestWithContext(ctx, "GET", buildURL(mediaItem.MimeType, mediaItem.BaseUrl), nil)
+	if start > 0 || end >= 0 {
+		byteRange := fmt.Sprintf("bytes=%d-", start)
+		if end >= 0 {
+			byteRange += strconv.FormatInt(end, 10)
+		}
+		get.Header.Set("Range", byteRange)
+		if etag != "" {
+			get.Header.Set("If-Range", etag)
+		}
+	}
 	imgResponse, err := c.getter(get)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get (%s): %v", mediaItem.ID, err)
+		return nil, fmt.Errorf("failed to get (%s): %w", mediaItem.ID, err)
+	}
+	if imgResponse.StatusCode == http.StatusRequestedRangeNotSatisfiable && start > 0 {
+		// the partial download is no longer a prefix of the media
+		imgResponse.Body.Close()
+		return c.DownloadRange(ctx, mediaItem, 0, -1, "")
 	}
-	if imgResponse.StatusCode != http.StatusOK {
-		if imgResponse.Body != nil {
-			defer imgResponse.Body.Close()
-			b, _ := io.ReadAll(imgResponse.Body)
-			fmt.Println("body from error:", string(b))
+	if imgResponse.StatusCode != http.StatusOK && imgResponse.StatusCode != http.StatusPartialContent {
+		return nil, NewAPIError(RequestGet, mediaItem.ID, imgResponse)
+	}
+	if imgResponse.Header.Get("Content-Type") == PlaceholderType {
+		imgResponse.Body.Close()
+		return nil, fmt.Errorf("failed to get (%s): %w", mediaItem.ID, ErrPlaceholder)
+	}
+	c.log.Debug("download", "id", mediaItem.ID, "mime", mediaItem.MimeType, "start", start, "end", end,
+		"status", imgResponse.StatusCode, "bytes", imgResponse.ContentLength)
+	body := imgResponse.Body
+	if c.limiter != nil {
+		body = &limitedReader{ctx: ctx, limiter: c.limiter, body: body}
+	}
+	download := &Download{
+		Body:   body,
+		Size:   imgResponse.ContentLength,
+		ETag:   imgResponse.Header.Get("ETag"),
+		Ranges: imgResponse.Header.Get("Accept-Ranges") == "bytes",
+	}
+	if imgResponse.StatusCode == http.StatusPartialContent {
+		offset, size, ok := parseContentRange(imgResponse.Header.Get("Content-Range"))
+		if !ok || offset != start {
+			imgResponse.Body.Close()
+			return nil, fmt.Errorf("failed to get (%s): unexpected range %q for offset %d", mediaItem.ID, imgResponse.Header.Get("Content-Range"), start)
 		}
-		return nil, fmt.Errorf("list call returned: %d:%s", imgResponse.StatusCode, http.StatusText(imgResponse.StatusCode))
+		download.Offset, download.Size, download.Ranges = offset, size, true
+	}
+	return download, nil
+}
+
+// Throughput reports the bytes downloaded through the Limiter and its current limit, zero without one
+func (c Client) Throughput() Throughput {
+	if c.limiter == nil {
+		return Throughput{}
 	}
-	defer imgResponse.Body.Close()
+	return c.limiter.Throughput()
+}
 
-	return io.ReadAll(imgResponse.Body)
+// parseContentRange reads the start and complete size of a "bytes start-end/size" Content-Range,
+// the size being -1 when unknown
+func parseContentRange(value string) (int64, int64, bool) {
+	var start, end int64
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/", &start, &end); err != nil {
+		return 0, 0, false
+	}
+	_, total, _ := strings.Cut(value, "/")
+	if total == "*" {
+		return start, -1, true
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
 }
 
 // buildURL based on details from https://developers.google.com/photos/library/guides/access-media-items#base-urls
@@ -10,7 +10,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/client/cassette"
 	"velocitizer.com/photogo/client/mocks"
 	"velocitizer.com/photogo/data"
 )
@@ -45,6 +47,19 @@ func TestClient_List(t *testing.T) {
 		client.New(getter.Execute).List(context.Background(), "foopagetoken")
 		getter.AssertExpectations(t)
 	})
+	t.Run("given a base url", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		response.Body = bytes.NewBuffer([]byte(`{}`))
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.MatchedBy(func(r *http.Request) bool {
+			return r.URL.String() == "http://127.0.0.1:8080/v1/mediaItems?pageSize=25"
+		})).Return(response.Result(), nil)
+
+		_, err := client.New(getter.Execute, client.WithBaseURL("http://127.0.0.1:8080/")).List(context.Background(), "")
+		assert.NoError(t, err)
+		getter.AssertExpectations(t)
+	})
 	t.Run("bad content from REST body", func(t *testing.T) {
 		response := httptest.NewRecorder()
 		response.Body = bytes.NewBuffer([]byte(`thi}s is not { jason }`))
@@ -85,7 +100,7 @@ func TestClient_List(t *testing.T) {
 
 		_, err := client.New(getter.Execute).List(context.Background(), "foopagetoken")
 
-		assert.EqualError(t, err, "list call returned: 424:"+http.StatusText(http.StatusFailedDependency))
+		assert.EqualError(t, err, "list returned 424 "+http.StatusText(http.StatusFailedDependency))
 	})
 }
 
@@ -130,3 +145,127 @@ func TestClient_Get(t *testing.T) {
 		assert.EqualError(t, err, "failed to get (the_id): expected")
 	})
 }
+
+func TestClient_Download(t *testing.T) {
+	item := data.MediaItem{ID: "video", BaseUrl: "https://lh3.googleusercontent.com/video", MimeType: "video/mp4"}
+	partial := func(status int, headers map[string]string, body string) *http.Response {
+		response := httptest.NewRecorder()
+		for key, value := range headers {
+			response.Header().Set(key, value)
+		}
+		response.WriteHeader(status)
+		response.Body = bytes.NewBufferString(body)
+		return response.Result()
+	}
+	t.Run("continues with a conditional range", func(t *testing.T) {
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.MatchedBy(func(r *http.Request) bool {
+			return r.Header.Get("Range") == "bytes=4-" && r.Header.Get("If-Range") == `"v1"`
+		})).Return(partial(http.StatusPartialContent, map[string]string{"Content-Range": "bytes 4-9/10", "ETag": `"v1"`}, "456789"), nil)
+
+		download, err := client.New(getter.Execute).Download(context.Background(), item, 4, `"v1"`)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 4, download.Offset)
+		assert.EqualValues(t, 10, download.Size)
+		assert.Equal(t, `"v1"`, download.ETag)
+		getter.AssertExpectations(t)
+	})
+	t.Run("a bounded range", func(t *testing.T) {
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.MatchedBy(func(r *http.Request) bool {
+			return r.Header.Get("Range") == "bytes=0-3" && r.Header.Get("If-Range") == `"v1"`
+		})).Return(partial(http.StatusPartialContent, map[string]string{"Content-Range": "bytes 0-3/10", "ETag": `"v1"`}, "0123"), nil)
+
+		download, err := client.New(getter.Execute).DownloadRange(context.Background(), item, 0, 3, `"v1"`)
+		assert.NoError(t, err)
+		assert.Zero(t, download.Offset)
+		assert.EqualValues(t, 10, download.Size, "the size of the whole media")
+		assert.True(t, download.Ranges)
+		getter.AssertExpectations(t)
+	})
+	t.Run("whole media when the range is ignored", func(t *testing.T) {
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.Anything).Return(partial(http.StatusOK, map[string]string{"ETag": `"v2"`}, "0123456789"), nil)
+
+		download, err := client.New(getter.Execute).Download(context.Background(), item, 4, `"v1"`)
+		assert.NoError(t, err)
+		assert.Zero(t, download.Offset)
+		assert.Equal(t, `"v2"`, download.ETag)
+	})
+	t.Run("restarts when the range is not satisfiable", func(t *testing.T) {
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.MatchedBy(func(r *http.Request) bool {
+			return r.Header.Get("Range") != ""
+		})).Return(partial(http.StatusRequestedRangeNotSatisfiable, nil, ""), nil).Once()
+		getter.On("Execute", mock.MatchedBy(func(r *http.Request) bool {
+			return r.Header.Get("Range") == ""
+		})).Return(partial(http.StatusOK, nil, "0123456789"), nil).Once()
+
+		download, err := client.New(getter.Execute).Download(context.Background(), item, 40, "")
+		assert.NoError(t, err)
+		assert.Zero(t, download.Offset)
+		getter.AssertExpectations(t)
+	})
+	t.Run("a range from elsewhere fails", func(t *testing.T) {
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.Anything).Return(partial(http.StatusPartialContent, map[string]string{"Content-Range": "bytes 0-9/10"}, "0123456789"), nil)
+
+		_, err := client.New(getter.Execute).Download(context.Background(), item, 4, "")
+		assert.Error(t, err)
+	})
+	t.Run("failures keep their cause", func(t *testing.T) {
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.Anything).Return(nil, context.DeadlineExceeded)
+
+		_, err := client.New(getter.Execute).Download(context.Background(), item, 0, "")
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+		_, err = client.New(getter.Execute).Item(context.Background(), item.ID)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+	})
+	t.Run("a cassette placeholder is not media", func(t *testing.T) {
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.Anything).Return(partial(http.StatusOK, map[string]string{"Content-Type": client.PlaceholderType}, "placeholder"), nil)
+
+		_, err := client.New(getter.Execute).Get(context.Background(), item)
+		assert.True(t, errors.Is(err, client.ErrPlaceholder), "got %v", err)
+	})
+}
+
+func TestClient_Cassette(t *testing.T) {
+	// testdata/library is a two page library recorded from photostest.Server, which answers in the
+	// shape of the API, the media of an item of each page included. It is not a capture of Google's
+	// own payloads, which would name the media of a real account.
+	replay, err := cassette.Replay("testdata/library")
+	require.NoError(t, err)
+	c := client.New(replay)
+	ctx := context.Background()
+
+	first, err := c.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, first.MediaItems, 25)
+	assert.NotEmpty(t, first.NextPageToken)
+	assert.Equal(t, "IMG_0000.JPG", first.MediaItems[0].Filename)
+	assert.Equal(t, "4032", first.MediaItems[0].Metadata.Width)
+	second, err := c.List(ctx, first.NextPageToken)
+	require.NoError(t, err)
+	require.Len(t, second.MediaItems, 2)
+	assert.Empty(t, second.NextPageToken)
+
+	b, err := c.Get(ctx, *first.MediaItems[0])
+	require.NoError(t, err)
+	assert.Equal(t, "media 0", string(b))
+	video := *second.MediaItems[1]
+	assert.Equal(t, "video/mp4", video.MimeType)
+	download, err := c.Download(ctx, video, 0, "")
+	require.NoError(t, err)
+	defer download.Body.Close()
+	assert.True(t, download.Ranges)
+	assert.NotEmpty(t, download.ETag)
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// RequestKind is the call an APIError comes from
+type RequestKind string
+
+const (
+	RequestList   RequestKind = "list"
+	RequestGet    RequestKind = "get"
+	RequestSearch RequestKind = "search"
+	// RequestItem is the call for a single media item, such as to renew its baseUrl
+	RequestItem RequestKind = "item"
+	// RequestSession is a call on a session of the Picker API
+	RequestSession RequestKind = "session"
+	// RequestPicked lists the media picked in a session of the Picker API
+	RequestPicked RequestKind = "picked"
+	// RequestPickedMedia downloads media picked in a session of the Picker API
+	RequestPickedMedia RequestKind = "picked_media"
+	// RequestArchive is a call on an archive job of the Data Portability API
+	RequestArchive RequestKind = "archive"
+	// RequestArchiveDownload downloads an archive of the Data Portability API
+	RequestArchiveDownload RequestKind = "archive_download"
+)
+
+// APIError is a response other than success, with the details of Google's error body when it sent one
+type APIError struct {
+	Kind RequestKind
+	// ItemID is the media item of the request, empty for list and search
+	ItemID string
+	// StatusCode is the HTTP status
+	StatusCode int
+	// Status is Google's status name, such as RESOURCE_EXHAUSTED, empty when the body had none
+	Status string
+	// Message is Google's message, or the start of a body that is not Google's error JSON
+	Message string
+	// Details are the error details, undecoded
+	Details []json.RawMessage
+}
+
+// maxErrorBody bounds how much of an error body is read
+const maxErrorBody = 64 << 10
+
+// NewAPIError reads the error of response, closing its body
+func NewAPIError(kind RequestKind, itemID string, response *http.Response) *APIError {
+	apiErr := &APIError{Kind: kind, ItemID: itemID, StatusCode: response.StatusCode}
+	if response.Body == nil {
+		return apiErr
+	}
+	defer response.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+	var body struct {
+		Error struct {
+			Message string            `json:"message"`
+			Status  string            `json:"status"`
+			Details []json.RawMessage `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &body) == nil {
+		apiErr.Status, apiErr.Message, apiErr.Details = body.Error.Status, body.Error.Message, body.Error.Details
+		return apiErr
+	}
+	message := strings.TrimSpace(string(b))
+	if len(message) > 200 {
+		message = message[:200] + "..."
+	}
+	apiErr.Message = message
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString(string(e.Kind))
+	if e.ItemID != "" {
+		fmt.Fprintf(&b, " %s", e.ItemID)
+	}
+	fmt.Fprintf(&b, " returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Status != "" {
+		fmt.Fprintf(&b, " (%s)", e.Status)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	return b.String()
+}
+
+// asAPIError finds the APIError in err's chain
+func asAPIError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+// IsQuotaExceeded reports whether err is the API refusing more requests for now, usually
+// until the daily quota resets
+func IsQuotaExceeded(err error) bool {
+	apiErr, ok := asAPIError(err)
+	return ok && (apiErr.StatusCode == http.StatusTooManyRequests || apiErr.Status == "RESOURCE_EXHAUSTED")
+}
+
+// IsDailyQuotaExceeded reports whether err is the daily quota exhausted, which only midnight
+// Pacific time resets, rather than a limit per minute a retry soon gets past. Google names the
+// limit in the message, "All requests per day", and in the details.
+func IsDailyQuotaExceeded(err error) bool {
+	apiErr, ok := asAPIError(err)
+	if !ok || !IsQuotaExceeded(err) {
+		return false
+	}
+	perDay := func(text string) bool {
+		text = strings.ToLower(text)
+		return strings.Contains(text, "per day") || strings.Contains(text, "perday")
+	}
+	if perDay(apiErr.Message) {
+		return true
+	}
+	for _, detail := range apiErr.Details {
+		if perDay(string(detail)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNotFound reports whether err is for media, or a page, that no longer exists
+func IsNotFound(err error) bool {
+	apiErr, ok := asAPIError(err)
+	return ok && (apiErr.StatusCode == http.StatusNotFound || apiErr.Status == "NOT_FOUND")
+}
+
+// IsExpiredURL reports whether err is a download refused because the baseUrl expired,
+// which it does an hour after listing. Listing the item again renews it.
+func IsExpiredURL(err error) bool {
+	apiErr, ok := asAPIError(err)
+	return ok && apiErr.Kind == RequestGet && apiErr.StatusCode == http.StatusForbidden
+}
+
+// IsUnauthorized reports whether err is the token being rejected or lacking the scope of the call
+func IsUnauthorized(err error) bool {
+	apiErr, ok := asAPIError(err)
+	if !ok {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusUnauthorized || apiErr.Status == "UNAUTHENTICATED" ||
+		(apiErr.Kind != RequestGet && apiErr.StatusCode == http.StatusForbidden)
+}
@@ -0,0 +1,85 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/client/mocks"
+	"velocitizer.com/photogo/data"
+)
+
+func TestAPIError(t *testing.T) {
+	respond := func(status int, body string) *mocks.Getter {
+		response := httptest.NewRecorder()
+		response.WriteHeader(status)
+		response.Body = bytes.NewBufferString(body)
+		getter := new(mocks.Getter)
+		getter.Test(t)
+		getter.On("Execute", mock.Anything).Return(response.Result(), nil)
+		return getter
+	}
+	item := data.MediaItem{ID: "AB12", MimeType: "image/jpeg", BaseUrl: "https://lh3.googleusercontent.com/secret"}
+
+	t.Run("google error body", func(t *testing.T) {
+		getter := respond(http.StatusTooManyRequests, `{"error":{"code":429,"message":"Quota exceeded for quota metric 'All requests'","status":"RESOURCE_EXHAUSTED",
+			"details":[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"RATE_LIMIT_EXCEEDED"}]}}`)
+
+		_, err := client.New(getter.Execute).List(context.Background(), "")
+		var apiErr *client.APIError
+		require.True(t, errors.As(err, &apiErr), "got %v", err)
+		assert.Equal(t, client.RequestList, apiErr.Kind)
+		assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+		assert.Equal(t, "RESOURCE_EXHAUSTED", apiErr.Status)
+		assert.Equal(t, "Quota exceeded for quota metric 'All requests'", apiErr.Message)
+		assert.Len(t, apiErr.Details, 1)
+		assert.EqualError(t, err, "list returned 429 Too Many Requests (RESOURCE_EXHAUSTED): Quota exceeded for quota metric 'All requests'")
+	})
+	t.Run("other bodies become the message", func(t *testing.T) {
+		getter := respond(http.StatusForbidden, "<html>Forbidden</html>")
+
+		_, err := client.New(getter.Execute).Get(context.Background(), item)
+		assert.EqualError(t, err, "get AB12 returned 403 Forbidden: <html>Forbidden</html>")
+	})
+	t.Run("classification", func(t *testing.T) {
+		for _, test := range []struct {
+			status  int
+			body    string
+			get     bool
+			matches func(error) bool
+		}{
+			{http.StatusTooManyRequests, "", true, client.IsQuotaExceeded},
+			{http.StatusForbidden, `{"error":{"status":"RESOURCE_EXHAUSTED"}}`, false, client.IsQuotaExceeded},
+			{http.StatusNotFound, "", true, client.IsNotFound},
+			{http.StatusForbidden, "", true, client.IsExpiredURL},
+			{http.StatusUnauthorized, "", false, client.IsUnauthorized},
+			{http.StatusForbidden, `{"error":{"status":"PERMISSION_DENIED"}}`, false, client.IsUnauthorized},
+		} {
+			getter := respond(test.status, test.body)
+			var err error
+			if test.get {
+				_, err = client.New(getter.Execute).Get(context.Background(), item)
+			} else {
+				_, err = client.New(getter.Execute).List(context.Background(), "")
+			}
+			wrapped := fmt.Errorf("failed to read IMG_0001.JPG: %w", err)
+			assert.True(t, test.matches(wrapped), "%d %s: %v", test.status, test.body, err)
+		}
+		assert.False(t, client.IsExpiredURL(&client.APIError{Kind: client.RequestList, StatusCode: http.StatusForbidden}), "only downloads expire")
+		assert.False(t, client.IsUnauthorized(&client.APIError{Kind: client.RequestGet, StatusCode: http.StatusForbidden}))
+		assert.False(t, client.IsNotFound(errors.New("not found")))
+		assert.False(t, client.IsDailyQuotaExceeded(&client.APIError{StatusCode: http.StatusTooManyRequests,
+			Message: "Quota exceeded for quota metric 'Read requests' and limit 'Read requests per minute per user'"}))
+		assert.True(t, client.IsDailyQuotaExceeded(&client.APIError{StatusCode: http.StatusTooManyRequests,
+			Details: []json.RawMessage{[]byte(`{"reason":"RATE_LIMIT_EXCEEDED","metadata":{"quota_limit":"ApiCallsPerProjectPerDay"}}`)}}))
+	})
+}
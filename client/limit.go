@@ -0,0 +1,238 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a bandwidth in bytes per second, zero is unlimited
+type Rate int64
+
+// ParseRate reads a rate such as "2MB", "500KiB/s" or "unlimited". Units are decimal (KB, MB, GB)
+// or binary (KiB, MiB, GiB), a bare number is bytes.
+func ParseRate(value string) (Rate, error) {
+	value = strings.TrimSuffix(strings.TrimSpace(value), "/s")
+	if value == "unlimited" {
+		return 0, nil
+	}
+	number := strings.TrimRight(value, "BKMGTibkmgt ")
+	unit := strings.ToUpper(strings.TrimSpace(value[len(number):]))
+	multiplier, ok := map[string]float64{
+		"": 1, "B": 1,
+		"K": 1e3, "KB": 1e3, "KIB": 1 << 10,
+		"M": 1e6, "MB": 1e6, "MIB": 1 << 20,
+		"G": 1e9, "GB": 1e9, "GIB": 1 << 30,
+	}[unit]
+	n, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 2MB or unlimited", value)
+	}
+	return Rate(n * multiplier), nil
+}
+
+func (r Rate) String() string {
+	if r <= 0 {
+		return "unlimited"
+	}
+	return FormatBytes(int64(r)) + "/s"
+}
+
+// FormatBytes prints a size with a decimal unit, e.g. 2.5 MB
+func FormatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for ; value >= unit && prefix < 3; prefix++ {
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f %cB", value, "kMGT"[prefix])
+}
+
+// Window is a rate for a time of day, from Start to End as offsets from midnight.
+// A window with End before Start runs past midnight.
+type Window struct {
+	Start, End time.Duration
+	Rate       Rate
+}
+
+func (w Window) contains(offset time.Duration) bool {
+	if w.End <= w.Start {
+		return offset >= w.Start || offset < w.End
+	}
+	return offset >= w.Start && offset < w.End
+}
+
+// Schedule is the download rate by time of day: the first window containing the time, or Default
+type Schedule struct {
+	Default Rate
+	Windows []Window
+}
+
+// ParseSchedule reads comma separated rates, each either the default rate or a window of the day,
+// e.g. "01:00-06:00=unlimited,2MB" for unlimited from 1am to 6am and 2 MB/s otherwise
+func ParseSchedule(value string) (Schedule, error) {
+	var schedule Schedule
+	for _, part := range strings.Split(value, ",") {
+		span, rate, windowed := strings.Cut(part, "=")
+		if !windowed {
+			r, err := ParseRate(part)
+			if err != nil {
+				return Schedule{}, err
+			}
+			schedule.Default = r
+			continue
+		}
+		first, last, ok := strings.Cut(span, "-")
+		start, startErr := parseClock(first)
+		end, endErr := parseClock(last)
+		if !ok || startErr != nil || endErr != nil {
+			return Schedule{}, fmt.Errorf("invalid window %q, expected e.g. 01:00-06:00", span)
+		}
+		r, err := ParseRate(rate)
+		if err != nil {
+			return Schedule{}, err
+		}
+		schedule.Windows = append(schedule.Windows, Window{Start: start, End: end, Rate: r})
+	}
+	return schedule, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// At is the rate at the local time of t
+func (s Schedule) At(t time.Time) Rate {
+	year, month, day := t.Date()
+	offset := t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+	for _, window := range s.Windows {
+		if window.contains(offset) {
+			return window.Rate
+		}
+	}
+	return s.Default
+}
+
+// Limiter shares a Schedule between every download of a Client, however many run at once
+type Limiter struct {
+	schedule Schedule
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	bytes  int64
+	now    func() time.Time
+}
+
+func NewLimiter(schedule Schedule) *Limiter {
+	return &Limiter{schedule: schedule, now: time.Now}
+}
+
+// WithLimiter limits the rate media is downloaded at
+func WithLimiter(limiter *Limiter) Option {
+	return func(c *Client) {
+		c.limiter = limiter
+	}
+}
+
+// Throughput is what the downloads of a Client amount to
+type Throughput struct {
+	// Bytes downloaded so far
+	Bytes int64
+	// Limit is the rate allowed now
+	Limit Rate
+}
+
+// Throughput reports the bytes downloaded and the current limit
+func (l *Limiter) Throughput() Throughput {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Throughput{Bytes: l.bytes, Limit: l.schedule.At(l.now())}
+}
+
+// wait takes n bytes from the bucket, sleeping until the bucket can afford them.
+// The bucket holds a second's worth of the rate, so a transfer can not burst past that.
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := l.now()
+	rate := float64(l.schedule.At(now))
+	l.bytes += int64(n)
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		l.mu.Unlock()
+		return nil
+	}
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*rate, rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// limitedReader waits for the limiter after each read of a download body
+type limitedReader struct {
+	ctx     context.Context
+	limiter *Limiter
+	body    io.ReadCloser
+}
+
+// readSize bounds each read, so a slow rate is spread over small writes instead of long pauses
+const readSize = 32 << 10
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > readSize {
+		p = p[:readSize]
+	}
+	n, err := r.body.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *limitedReader) Close() error {
+	return r.body.Close()
+}
+
+// Throttle limits the response bodies of a Getter that is not a Client, such as the archive
+// downloads of the portability package, sharing limiter with whatever else uses it
+func Throttle(limiter *Limiter) Middleware {
+	return func(next Getter) Getter {
+		return func(r *http.Request) (*http.Response, error) {
+			response, err := next(r)
+			if err == nil {
+				response.Body = &limitedReader{ctx: r.Context(), limiter: limiter, body: response.Body}
+			}
+			return response, err
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/data"
+)
+
+func TestParseRate(t *testing.T) {
+	for value, expected := range map[string]client.Rate{
+		"2MB":       2_000_000,
+		"2 MB/s":    2_000_000,
+		"500KiB":    500 << 10,
+		"1.5G":      1_500_000_000,
+		"4096":      4096,
+		"unlimited": 0,
+	} {
+		rate, err := client.ParseRate(value)
+		if assert.NoError(t, err, value) {
+			assert.Equal(t, expected, rate, value)
+		}
+	}
+	for _, value := range []string{"", "fast", "2XB", "-1MB"} {
+		_, err := client.ParseRate(value)
+		assert.Error(t, err, value)
+	}
+	assert.Equal(t, "2.0 MB/s", client.Rate(2_000_000).String())
+	assert.Equal(t, "unlimited", client.Rate(0).String())
+}
+
+func TestSchedule(t *testing.T) {
+	schedule, err := client.ParseSchedule("01:00-06:00=unlimited,22:30-00:30=1MB,2MB")
+	require.NoError(t, err)
+	at := func(hour, minute int) client.Rate {
+		return schedule.At(time.Date(2022, 1, 2, hour, minute, 0, 0, time.Local))
+	}
+	assert.Equal(t, client.Rate(0), at(1, 0))
+	assert.Equal(t, client.Rate(0), at(5, 59))
+	assert.Equal(t, client.Rate(2_000_000), at(6, 0))
+	assert.Equal(t, client.Rate(2_000_000), at(12, 0))
+	assert.Equal(t, client.Rate(1_000_000), at(23, 0), "a window past midnight")
+	assert.Equal(t, client.Rate(1_000_000), at(0, 15))
+	assert.Equal(t, client.Rate(2_000_000), at(0, 45))
+
+	for _, value := range []string{"01:00=1MB", "1am-6am=1MB", "01:00-06:00=fast"} {
+		_, err := client.ParseSchedule(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 15_000)
+	getter := func(r *http.Request) (*http.Response, error) {
+		response := httptest.NewRecorder()
+		response.Write(content)
+		return response.Result(), nil
+	}
+	limiter := client.NewLimiter(client.Schedule{Default: 100_000})
+	c := client.New(getter, client.WithLimiter(limiter))
+	item := data.MediaItem{ID: "video", BaseUrl: "https://lh3.googleusercontent.com/video", MimeType: "video/mp4"}
+
+	start := time.Now()
+	got, err := c.Get(context.Background(), item)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "150 kB at 100 kB/s after a second's burst, took %s", time.Since(start))
+	assert.Equal(t, client.Throughput{Bytes: 150_000, Limit: 100_000}, c.Throughput())
+
+	t.Run("a canceled download stops waiting", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		download, err := c.Download(ctx, item, 0, "")
+		require.NoError(t, err)
+		cancel()
+		_, err = io.ReadAll(download.Body)
+		assert.Equal(t, context.Canceled, err)
+	})
+	t.Run("throttles a getter that is not a client", func(t *testing.T) {
+		limiter := client.NewLimiter(client.Schedule{Default: 100_000})
+		get := client.Chain(getter, client.Throttle(limiter))
+		request, _ := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/archive-001.zip", nil)
+
+		start := time.Now()
+		response, err := get(request)
+		require.NoError(t, err)
+		got, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.Equal(t, content, got)
+		assert.True(t, time.Since(start) >= 400*time.Millisecond, "took %s", time.Since(start))
+		assert.EqualValues(t, 150_000, limiter.Throughput().Bytes)
+	})
+}
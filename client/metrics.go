@@ -0,0 +1,123 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"velocitizer.com/photogo/metrics"
+)
+
+// Daily quotas of a project on the Library API, which reset at midnight Pacific time
+const (
+	requestQuota = 10000
+	mediaQuota   = 75000
+)
+
+// WithMetrics counts the requests, downloaded bytes and quota use of the client in registry,
+// as the Metrics middleware after any other
+func WithMetrics(registry *metrics.Registry) Option {
+	return WithMiddleware(Metrics(registry))
+}
+
+// downloads are the kinds of request whose body is media, or an archive of it
+var downloads = map[RequestKind]bool{RequestGet: true, RequestPickedMedia: true, RequestArchiveDownload: true}
+
+// quotas are the Library API quotas the kinds of request count against, the other APIs have their own
+var quotas = map[RequestKind]string{RequestList: "requests", RequestSearch: "requests", RequestItem: "requests", RequestGet: "media"}
+
+// Metrics counts requests, downloaded bytes and quota use in registry. Placed outside of Retry
+// it counts calls, inside it counts every attempt, which is what the quota counts, and the retries.
+func Metrics(registry *metrics.Registry) Middleware {
+	m := newClientMetrics(registry)
+	return func(next Getter) Getter {
+		return func(r *http.Request) (*http.Response, error) {
+			kind := requestKind(r)
+			if retried(r) {
+				m.retries.Inc(string(kind))
+			}
+			response, err := next(r)
+			m.request(kind, response, err)
+			if err == nil && downloads[kind] && response.Body != nil {
+				response.Body = &countedReader{ReadCloser: response.Body, bytes: m.bytes}
+			}
+			return response, err
+		}
+	}
+}
+
+type clientMetrics struct {
+	requests      *metrics.Counter
+	retries       *metrics.Counter
+	bytes         *metrics.Counter
+	quotaUsed     *metrics.Gauge
+	quotaExceeded *metrics.Counter
+
+	mu sync.Mutex
+	// day is the quota day of used
+	day  string
+	used map[string]int
+}
+
+func newClientMetrics(registry *metrics.Registry) *clientMetrics {
+	limit := registry.Gauge("photogo_api_quota_limit", "Daily requests allowed by the Library API quota.", "quota")
+	limit.Set(requestQuota, "requests")
+	limit.Set(mediaQuota, "media")
+	return &clientMetrics{
+		requests:      registry.Counter("photogo_api_requests_total", "API requests by endpoint and status code.", "endpoint", "code"),
+		retries:       registry.Counter("photogo_api_retries_total", "API requests made again after a failure, by endpoint.", "endpoint"),
+		bytes:         registry.Counter("photogo_download_bytes_total", "Bytes of media and archives downloaded."),
+		quotaUsed:     registry.Gauge("photogo_api_quota_used", "Requests counted against the daily Library API quota today, as seen by this process.", "quota"),
+		quotaExceeded: registry.Counter("photogo_api_quota_exceeded_total", "Requests refused for exceeding the Library API quota.", "endpoint"),
+		used:          map[string]int{},
+	}
+}
+
+// pacific is where the quota day is, a fixed offset when the time zone database is missing
+var pacific = func() *time.Location {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return time.FixedZone("PST", -8*60*60)
+	}
+	return location
+}()
+
+func (m *clientMetrics) request(kind RequestKind, response *http.Response, err error) {
+	code := "error"
+	if err == nil && response != nil {
+		code = strconv.Itoa(response.StatusCode)
+		if response.StatusCode == http.StatusTooManyRequests && quotas[kind] != "" {
+			m.quotaExceeded.Inc(string(kind))
+		}
+	}
+	m.requests.Inc(string(kind), code)
+
+	quota := quotas[kind]
+	if quota == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if day := time.Now().In(pacific).Format(time.DateOnly); day != m.day {
+		m.day = day
+		m.used = map[string]int{}
+		m.quotaUsed.Set(0, "requests")
+		m.quotaUsed.Set(0, "media")
+	}
+	m.used[quota]++
+	m.quotaUsed.Set(float64(m.used[quota]), quota)
+}
+
+// countedReader counts the bytes read from a download
+type countedReader struct {
+	io.ReadCloser
+	bytes *metrics.Counter
+}
+
+func (r *countedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes.Add(float64(n))
+	return n, err
+}
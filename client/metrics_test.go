@@ -0,0 +1,105 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/client/mocks"
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/metrics"
+)
+
+func TestWithMetrics(t *testing.T) {
+	respond := func(status int, body string) *http.Response {
+		response := httptest.NewRecorder()
+		response.WriteHeader(status)
+		response.Body = bytes.NewBufferString(body)
+		return response.Result()
+	}
+	getter := new(mocks.Getter)
+	getter.Test(t)
+	getter.On("Execute", mock.MatchedBy(func(r *http.Request) bool { return r.URL.Path == "/v1/mediaItems" })).
+		Return(respond(http.StatusTooManyRequests, `{"error":{"status":"RESOURCE_EXHAUSTED"}}`), nil).Once()
+	getter.On("Execute", mock.MatchedBy(func(r *http.Request) bool { return r.URL.Path == "/v1/mediaItems" })).
+		Return(nil, errors.New("connection reset")).Once()
+	getter.On("Execute", mock.MatchedBy(func(r *http.Request) bool { return r.URL.Host == "lh3.googleusercontent.com" })).
+		Return(respond(http.StatusOK, "jpeg bytes"), nil)
+	registry := metrics.NewRegistry()
+	c := client.New(getter.Execute, client.WithMetrics(registry))
+
+	_, err := c.List(context.Background(), "")
+	assert.True(t, client.IsQuotaExceeded(err), "got %v", err)
+	_, err = c.List(context.Background(), "")
+	assert.Error(t, err)
+	b, err := c.Get(context.Background(), data.MediaItem{ID: "AB12", MimeType: "image/jpeg", BaseUrl: "https://lh3.googleusercontent.com/secret"})
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg bytes", string(b))
+
+	var out strings.Builder
+	_, err = registry.WriteTo(&out)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`photogo_api_requests_total{endpoint="get",code="200"} 1`,
+		`photogo_api_requests_total{endpoint="list",code="429"} 1`,
+		`photogo_api_requests_total{endpoint="list",code="error"} 1`,
+		`photogo_api_quota_exceeded_total{endpoint="list"} 1`,
+		`photogo_api_quota_used{quota="media"} 1`,
+		`photogo_api_quota_used{quota="requests"} 2`,
+		`photogo_api_quota_limit{quota="requests"} 10000`,
+		`photogo_download_bytes_total 10`,
+	} {
+		assert.Contains(t, out.String(), line+"\n")
+	}
+	getter.AssertExpectations(t)
+
+	t.Run("other APIs and retries by kind", func(t *testing.T) {
+		failed := false
+		getter := func(r *http.Request) (*http.Response, error) {
+			if !failed {
+				failed = true
+				return respond(http.StatusServiceUnavailable, ""), nil
+			}
+			return respond(http.StatusOK, "archive bytes"), nil
+		}
+		registry := metrics.NewRegistry()
+		c := client.New(getter, client.WithMiddleware(client.Retry(2, time.Millisecond)), client.WithMetrics(registry))
+
+		ctx := client.WithRequestKind(context.Background(), client.RequestArchiveDownload)
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://storage.googleapis.com/archive-001.zip", nil)
+		response, err := c.Do(request)
+		require.NoError(t, err)
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		// the Picker API lists picked media at the path the Library API lists the library
+		ctx = client.WithRequestKind(context.Background(), client.RequestPicked)
+		request, _ = http.NewRequestWithContext(ctx, http.MethodGet, "https://photospicker.googleapis.com/v1/mediaItems", nil)
+		response, err = c.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		var out strings.Builder
+		_, err = registry.WriteTo(&out)
+		require.NoError(t, err)
+		for _, line := range []string{
+			`photogo_api_requests_total{endpoint="archive_download",code="503"} 1`,
+			`photogo_api_requests_total{endpoint="archive_download",code="200"} 1`,
+			`photogo_api_requests_total{endpoint="picked",code="200"} 1`,
+			`photogo_api_retries_total{endpoint="archive_download"} 1`,
+			`photogo_download_bytes_total 13`,
+		} {
+			assert.Contains(t, out.String(), line+"\n")
+		}
+		assert.NotContains(t, out.String(), "photogo_api_quota_used{", "only the Library API has a quota")
+	})
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a Getter with a concern of every request, such as logging or retries
+type Middleware func(Getter) Getter
+
+// WithMiddleware wraps the Getter of New in middleware, the first outermost, so it sees a request
+// before the others and its response after them. Given more than once, the middleware adds up.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(c *Client) {
+		c.middleware = append(c.middleware, middleware...)
+	}
+}
+
+// Chain wraps getter in middleware, the first outermost
+func Chain(getter Getter, middleware ...Middleware) Getter {
+	for _, m := range slices.Backward(middleware) {
+		getter = m(getter)
+	}
+	return getter
+}
+
+type kindKey struct{}
+
+// WithRequestKind tells the middleware the kind of the requests made with ctx, for the calls of
+// other APIs whose url does not tell them apart from those of the Library API
+func WithRequestKind(ctx context.Context, kind RequestKind) context.Context {
+	return context.WithValue(ctx, kindKey{}, kind)
+}
+
+// requestKind tells the call of a request by the kind of WithRequestKind, or else by its url
+func requestKind(r *http.Request) RequestKind {
+	if kind, ok := r.Context().Value(kindKey{}).(RequestKind); ok {
+		return kind
+	}
+	switch {
+	case r.URL.Path == "/v1/mediaItems":
+		return RequestList
+	case r.URL.Path == "/v1/mediaItems:search":
+		return RequestSearch
+	case strings.HasPrefix(r.URL.Path, "/v1/mediaItems/"):
+		return RequestItem
+	case strings.HasPrefix(r.URL.Path, "/v1/sessions"):
+		return RequestSession
+	case strings.HasPrefix(r.URL.Path, "/v1/portabilityArchive"), strings.HasPrefix(r.URL.Path, "/v1/archiveJobs/"):
+		return RequestArchive
+	}
+	return RequestGet
+}
+
+// Logging logs every request at debug level with its outcome, redacted as by Redact
+func Logging(logger *slog.Logger) Middleware {
+	return func(next Getter) Getter {
+		return func(r *http.Request) (*http.Response, error) {
+			start := time.Now()
+			response, err := next(r)
+			attrs := []any{"method", r.Method, "url", Redact(r.URL.String()), "duration", time.Since(start)}
+			if err != nil {
+				logger.Debug("request failed", append(attrs, "err", Redact(err.Error()))...)
+			} else {
+				logger.Debug("request", append(attrs, "status", response.StatusCode)...)
+			}
+			return response, err
+		}
+	}
+}
+
+// UserAgent sets the User-Agent of every request
+func UserAgent(userAgent string) Middleware {
+	return func(next Getter) Getter {
+		return func(r *http.Request) (*http.Response, error) {
+			r = r.Clone(r.Context())
+			r.Header.Set("User-Agent", userAgent)
+			return next(r)
+		}
+	}
+}
+
+// retryable are the statuses worth another attempt: rate limiting and failures of the server
+var retryable = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+type retryKey struct{}
+
+// retried is true for the requests Retry makes again
+func retried(r *http.Request) bool {
+	_, ok := r.Context().Value(retryKey{}).(bool)
+	return ok
+}
+
+// Retry makes up to attempts requests while they fail in the network or with a retryable status,
+// waiting backoff after the first, twice as long after the next and so on, or the Retry-After of
+// the response. A daily quota exceeded is not retried, it lasts until midnight Pacific time.
+// Requests with a body are not retried unless they can get it again.
+func Retry(attempts int, backoff time.Duration) Middleware {
+	return func(next Getter) Getter {
+		return func(r *http.Request) (*http.Response, error) {
+			wait := backoff
+			for attempt := 1; ; attempt++ {
+				response, err := next(r)
+				if attempt >= attempts || (r.Body != nil && r.GetBody == nil) || !(err != nil || retryable[response.StatusCode]) {
+					return response, err
+				}
+				delay := wait
+				if err == nil {
+					if response.StatusCode == http.StatusTooManyRequests && dailyQuotaExceeded(r, response) {
+						return response, nil
+					}
+					if after, ok := retryAfter(response.Header.Get("Retry-After")); ok {
+						delay = after
+					}
+					io.Copy(io.Discard, io.LimitReader(response.Body, maxErrorBody))
+					response.Body.Close()
+				}
+				if err := sleep(r.Context(), delay); err != nil {
+					return nil, err
+				}
+				wait *= 2
+				r = r.WithContext(context.WithValue(r.Context(), retryKey{}, true))
+				if r.GetBody != nil {
+					body, err := r.GetBody()
+					if err != nil {
+						return nil, err
+					}
+					r = r.Clone(r.Context())
+					r.Body = body
+				}
+			}
+		}
+	}
+}
+
+// dailyQuotaExceeded reads the error body of a 429 response to tell whether the daily quota is
+// exhausted, leaving the body for the caller to read again
+func dailyQuotaExceeded(r *http.Request, response *http.Response) bool {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+	read := &http.Response{StatusCode: response.StatusCode, Body: io.NopCloser(bytes.NewReader(body))}
+	return IsDailyQuotaExceeded(NewAPIError(requestKind(r), "", read))
+}
+
+// retryAfter reads a Retry-After header, either seconds or an HTTP date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// RateLimit spaces requests to at most perSecond on average, letting burst through at once.
+// Zero does not limit them.
+func RateLimit(perSecond float64, burst int) Middleware {
+	if perSecond <= 0 {
+		return func(next Getter) Getter { return next }
+	}
+	var mu sync.Mutex
+	tokens, last := float64(burst), time.Now()
+	return func(next Getter) Getter {
+		return func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			now := time.Now()
+			tokens = min(float64(burst), tokens+now.Sub(last).Seconds()*perSecond)
+			last = now
+			// take the token now, waiting for it to refill when it was not there yet
+			tokens--
+			delay := time.Duration(-tokens / perSecond * float64(time.Second))
+			mu.Unlock()
+			if delay > 0 {
+				if err := sleep(r.Context(), delay); err != nil {
+					mu.Lock()
+					tokens++
+					mu.Unlock()
+					return nil, err
+				}
+			}
+			return next(r)
+		}
+	}
+}
+
+// Dump writes the headers of every request and response to w, with credentials and baseUrls
+// redacted, for debugging
+func Dump(w io.Writer) Middleware {
+	var mu sync.Mutex
+	return func(next Getter) Getter {
+		return func(r *http.Request) (*http.Response, error) {
+			response, err := next(r)
+			var b strings.Builder
+			fmt.Fprintf(&b, "> %s %s\n", r.Method, Redact(r.URL.String()))
+			dumpHeader(&b, "> ", r.Header)
+			if err != nil {
+				fmt.Fprintf(&b, "< %s\n", Redact(err.Error()))
+			} else {
+				fmt.Fprintf(&b, "< %s %s\n", response.Proto, response.Status)
+				dumpHeader(&b, "< ", response.Header)
+			}
+			mu.Lock()
+			io.WriteString(w, b.String()+"\n")
+			mu.Unlock()
+			return response, err
+		}
+	}
+}
+
+// secretHeaders are never dumped
+var secretHeaders = map[string]bool{"Authorization": true, "Cookie": true, "Set-Cookie": true}
+
+func dumpHeader(b *strings.Builder, prefix string, header http.Header) {
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		for _, value := range header[name] {
+			if secretHeaders[name] {
+				value = redacted
+			}
+			fmt.Fprintf(b, "%s%s: %s\n", prefix, name, Redact(value))
+		}
+	}
+}
+
+// sleep waits for d unless ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,236 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
+)
+
+// respondWith is a Getter answering with the statuses in turn, the last one from then on
+func respondWith(calls *atomic.Int32, statuses ...int) client.Getter {
+	return func(r *http.Request) (*http.Response, error) {
+		n := int(calls.Add(1))
+		response := httptest.NewRecorder()
+		response.WriteHeader(statuses[min(n, len(statuses))-1])
+		response.Body = bytes.NewBufferString("{}")
+		return response.Result(), nil
+	}
+}
+
+func get(t *testing.T, getter client.Getter, url string) (*http.Response, error) {
+	t.Helper()
+	r, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	require.NoError(t, err)
+	return getter(r)
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	layer := func(name string) client.Middleware {
+		return func(next client.Getter) client.Getter {
+			return func(r *http.Request) (*http.Response, error) {
+				order = append(order, name+" in")
+				defer func() { order = append(order, name+" out") }()
+				return next(r)
+			}
+		}
+	}
+	var calls atomic.Int32
+	c := client.New(respondWith(&calls, http.StatusOK), client.WithMiddleware(layer("first"), layer("second")), client.WithMiddleware(layer("third")))
+
+	_, err := c.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first in", "second in", "third in", "third out", "second out", "first out"}, order)
+}
+
+func TestLogging(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	var calls atomic.Int32
+	getter := client.Chain(respondWith(&calls, http.StatusForbidden), client.Logging(logger))
+
+	_, err := get(t, getter, "https://lh3.googleusercontent.com/secret=d?access_token=ya29.abc")
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "msg=request method=GET url=https://lh3.googleusercontent.com/REDACTED?REDACTED ")
+	assert.Contains(t, out.String(), "status=403")
+	assert.NotContains(t, out.String(), "secret")
+	assert.NotContains(t, out.String(), "ya29")
+
+	out.Reset()
+	failing := client.Chain(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("dial https://lh3.googleusercontent.com/secret: refused")
+	}, client.Logging(logger))
+	_, err = get(t, failing, "https://photoslibrary.googleapis.com/v1/mediaItems")
+	require.Error(t, err)
+	assert.Contains(t, out.String(), `msg="request failed"`)
+	assert.NotContains(t, out.String(), "secret")
+}
+
+func TestUserAgent(t *testing.T) {
+	var agent string
+	getter := client.Chain(func(r *http.Request) (*http.Response, error) {
+		agent = r.Header.Get("User-Agent")
+		return httptest.NewRecorder().Result(), nil
+	}, client.UserAgent("photogo"))
+	r := httptest.NewRequest(http.MethodGet, "https://photoslibrary.googleapis.com/v1/mediaItems", nil)
+
+	_, err := getter(r)
+	require.NoError(t, err)
+	assert.Equal(t, "photogo", agent)
+	assert.Empty(t, r.Header.Get("User-Agent"), "the request of the caller is not modified")
+}
+
+func TestRetry(t *testing.T) {
+	t.Run("retries failures of the server", func(t *testing.T) {
+		var calls atomic.Int32
+		getter := client.Chain(respondWith(&calls, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK),
+			client.Retry(3, time.Millisecond))
+
+		response, err := get(t, getter, "https://photoslibrary.googleapis.com/v1/mediaItems")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.EqualValues(t, 3, calls.Load())
+	})
+	t.Run("gives up after the attempts", func(t *testing.T) {
+		var calls atomic.Int32
+		getter := client.Chain(respondWith(&calls, http.StatusBadGateway), client.Retry(2, time.Millisecond))
+
+		response, err := get(t, getter, "https://photoslibrary.googleapis.com/v1/mediaItems")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+		assert.EqualValues(t, 2, calls.Load())
+	})
+	t.Run("retries errors of the network", func(t *testing.T) {
+		var calls atomic.Int32
+		getter := client.Chain(func(r *http.Request) (*http.Response, error) {
+			if calls.Add(1) == 1 {
+				return nil, errors.New("connection reset")
+			}
+			return httptest.NewRecorder().Result(), nil
+		}, client.Retry(2, time.Millisecond))
+
+		_, err := get(t, getter, "https://photoslibrary.googleapis.com/v1/mediaItems")
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, calls.Load())
+	})
+	t.Run("does not retry other statuses", func(t *testing.T) {
+		var calls atomic.Int32
+		getter := client.Chain(respondWith(&calls, http.StatusNotFound), client.Retry(3, time.Millisecond))
+
+		response, err := get(t, getter, "https://photoslibrary.googleapis.com/v1/mediaItems/AB12")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+		assert.EqualValues(t, 1, calls.Load())
+	})
+	t.Run("waits the Retry-After of the response", func(t *testing.T) {
+		var calls atomic.Int32
+		getter := client.Chain(func(r *http.Request) (*http.Response, error) {
+			response := httptest.NewRecorder()
+			if calls.Add(1) == 1 {
+				response.Header().Set("Retry-After", "0")
+				response.WriteHeader(http.StatusTooManyRequests)
+			}
+			return response.Result(), nil
+		}, client.Retry(2, time.Hour))
+
+		response, err := get(t, getter, "https://photoslibrary.googleapis.com/v1/mediaItems")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode, "retried at once rather than in an hour")
+		assert.EqualValues(t, 2, calls.Load())
+	})
+	t.Run("does not retry the daily quota", func(t *testing.T) {
+		const body = `{"error":{"code":429,"message":"Quota exceeded for quota metric 'All requests' and limit 'All requests per day'","status":"RESOURCE_EXHAUSTED"}}`
+		var calls atomic.Int32
+		getter := client.Chain(func(r *http.Request) (*http.Response, error) {
+			calls.Add(1)
+			response := httptest.NewRecorder()
+			response.WriteHeader(http.StatusTooManyRequests)
+			response.Body = bytes.NewBufferString(body)
+			return response.Result(), nil
+		}, client.Retry(3, time.Millisecond))
+
+		response, err := get(t, getter, "https://photoslibrary.googleapis.com/v1/mediaItems")
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, calls.Load())
+		err = client.NewAPIError(client.RequestList, "", response)
+		assert.True(t, client.IsDailyQuotaExceeded(err), "the body is left to read, got %v", err)
+	})
+	t.Run("stops waiting when the request is canceled", func(t *testing.T) {
+		var calls atomic.Int32
+		getter := client.Chain(respondWith(&calls, http.StatusServiceUnavailable), client.Retry(3, time.Hour))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://photoslibrary.googleapis.com/v1/mediaItems", nil)
+		require.NoError(t, err)
+
+		_, err = getter(r)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	var calls atomic.Int32
+	getter := client.Chain(respondWith(&calls, http.StatusOK), client.RateLimit(100, 2))
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		_, err := get(t, getter, "https://photoslibrary.googleapis.com/v1/mediaItems")
+		require.NoError(t, err)
+	}
+	// the burst goes through at once, the next two wait 10ms each
+	assert.True(t, time.Since(start) >= 20*time.Millisecond, "took %v", time.Since(start))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://photoslibrary.googleapis.com/v1/mediaItems", nil)
+	require.NoError(t, err)
+	_, err = getter(r)
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+	assert.EqualValues(t, 4, calls.Load())
+
+	t.Run("zero does not limit", func(t *testing.T) {
+		var calls atomic.Int32
+		getter := client.Chain(respondWith(&calls, http.StatusOK), client.RateLimit(0, 0))
+		for i := 0; i < 100; i++ {
+			_, err := get(t, getter, "https://photoslibrary.googleapis.com/v1/mediaItems")
+			require.NoError(t, err)
+		}
+		assert.EqualValues(t, 100, calls.Load())
+	})
+}
+
+func TestDump(t *testing.T) {
+	var out bytes.Buffer
+	getter := client.Chain(func(r *http.Request) (*http.Response, error) {
+		response := httptest.NewRecorder()
+		response.Header().Set("Content-Type", "image/jpeg")
+		response.Header().Set("Set-Cookie", "session=abc")
+		response.WriteHeader(http.StatusOK)
+		return response.Result(), nil
+	}, client.Dump(&out))
+	r := httptest.NewRequest(http.MethodGet, "https://lh3.googleusercontent.com/secret=d", nil)
+	r.Header.Set("Authorization", "Bearer ya29.abc")
+	r.Header.Set("Range", "bytes=0-")
+
+	_, err := getter(r)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		"> GET https://lh3.googleusercontent.com/REDACTED",
+		"> Authorization: REDACTED",
+		"> Range: bytes=0-",
+		"< HTTP/1.1 200 OK",
+		"< Content-Type: image/jpeg",
+		"< Set-Cookie: REDACTED",
+		"", "",
+	}, "\n"), out.String())
+}
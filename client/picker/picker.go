@@ -0,0 +1,305 @@
+// Package picker reaches media through the Google Photos Picker API. Since the Library API only
+// lists the media an app uploaded itself, the user picks what to sync in Google Photos instead:
+// a session is created, the user opens its pickerUri, and once they are done the picked media
+// can be listed and downloaded for as long as the session lasts.
+package picker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/data"
+)
+
+// DefaultBaseURL is the Google Photos Picker API
+const DefaultBaseURL = "https://photospicker.googleapis.com"
+
+// Scope is the OAuth scope of the Picker API
+const Scope = "https://www.googleapis.com/auth/photospicker.mediaitems.readonly"
+
+const (
+	pageSize = "100"
+	// defaultPollInterval is used when a session does not say how often to poll it
+	defaultPollInterval = 5 * time.Second
+)
+
+// ErrTimeout is returned by Wait when the user did not pick media before the session timed out
+var ErrTimeout = errors.New("the session timed out before media was picked")
+
+// Session is a picking session
+type Session struct {
+	ID string `json:"id"`
+	// PickerURI is where the user picks media, in a browser or the Google Photos app
+	PickerURI     string        `json:"pickerUri"`
+	PollingConfig PollingConfig `json:"pollingConfig"`
+	ExpireTime    time.Time     `json:"expireTime"`
+	// MediaItemsSet is true once the user is done picking
+	MediaItemsSet bool `json:"mediaItemsSet"`
+}
+
+// PollingConfig is how often to poll a session and for how much longer
+type PollingConfig struct {
+	PollInterval time.Duration
+	TimeoutIn    time.Duration
+}
+
+func (p *PollingConfig) UnmarshalJSON(b []byte) error {
+	var config struct {
+		PollInterval string `json:"pollInterval"`
+		TimeoutIn    string `json:"timeoutIn"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+	var err error
+	if p.PollInterval, err = parseDuration(config.PollInterval); err != nil {
+		return fmt.Errorf("invalid pollInterval: %v", err)
+	}
+	if p.TimeoutIn, err = parseDuration(config.TimeoutIn); err != nil {
+		return fmt.Errorf("invalid timeoutIn: %v", err)
+	}
+	return nil
+}
+
+// parseDuration reads a JSON duration such as "3.5s", zero when empty
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// MediaItem is a picked media item
+type MediaItem struct {
+	ID         string    `json:"id"`
+	CreateTime time.Time `json:"createTime"`
+	// Type is PHOTO or VIDEO
+	Type      string    `json:"type"`
+	MediaFile MediaFile `json:"mediaFile"`
+}
+
+type MediaFile struct {
+	BaseURL           string            `json:"baseUrl"`
+	MimeType          string            `json:"mimeType"`
+	Filename          string            `json:"filename"`
+	MediaFileMetadata MediaFileMetadata `json:"mediaFileMetadata"`
+}
+
+type MediaFileMetadata struct {
+	Width         int            `json:"width,omitempty"`
+	Height        int            `json:"height,omitempty"`
+	CameraMake    string         `json:"cameraMake,omitempty"`
+	CameraModel   string         `json:"cameraModel,omitempty"`
+	PhotoMetadata *PhotoMetadata `json:"photoMetadata,omitempty"`
+	VideoMetadata *VideoMetadata `json:"videoMetadata,omitempty"`
+}
+
+type PhotoMetadata struct {
+	FocalLength     float64 `json:"focalLength,omitempty"`
+	ApertureFNumber float64 `json:"apertureFNumber,omitempty"`
+	IsoEquivalent   int     `json:"isoEquivalent,omitempty"`
+	ExposureTime    string  `json:"exposureTime,omitempty"`
+}
+
+type VideoMetadata struct {
+	Fps float64 `json:"fps,omitempty"`
+	// ProcessingStatus is READY once the video can be downloaded
+	ProcessingStatus string `json:"processingStatus,omitempty"`
+}
+
+// ListResponse is a page of picked media items
+type ListResponse struct {
+	MediaItems    []*MediaItem `json:"mediaItems"`
+	NextPageToken string       `json:"nextPageToken"`
+}
+
+// Client calls the Picker API through a client.Client, with its middleware, and downloads with it
+type Client struct {
+	client  *client.Client
+	baseURL string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithBaseURL points the client at another Picker API, such as a pickertest.Server
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// New makes requests with c, authorized for Scope
+func New(c *client.Client, options ...Option) *Client {
+	p := &Client{client: c, baseURL: DefaultBaseURL}
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
+
+// CreateSession starts a session for the user to pick media in
+func (c *Client) CreateSession(ctx context.Context) (*Session, error) {
+	post, _ := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/v1/sessions", strings.NewReader("{}"))
+	post.Header.Set("Content-Type", "application/json")
+	var session Session
+	if err := c.call(post, client.RequestSession, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Session gets a session again, to see whether media was picked
+func (c *Client) Session(ctx context.Context, id string) (*Session, error) {
+	get, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/sessions/%s", c.baseURL, url.PathEscape(id)), nil)
+	var session Session
+	if err := c.call(get, client.RequestSession, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// DeleteSession ends a session, once its media is downloaded
+func (c *Client) DeleteSession(ctx context.Context, id string) error {
+	del, _ := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/v1/sessions/%s", c.baseURL, url.PathEscape(id)), nil)
+	return c.call(del, client.RequestSession, nil)
+}
+
+// Wait polls session as often as it says until the user is done picking. It returns ErrTimeout
+// when the session times out first.
+func (c *Client) Wait(ctx context.Context, session *Session) (*Session, error) {
+	var deadline time.Time
+	if session.PollingConfig.TimeoutIn > 0 {
+		deadline = time.Now().Add(session.PollingConfig.TimeoutIn)
+	}
+	for !session.MediaItemsSet {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+		interval := session.PollingConfig.PollInterval
+		if interval <= 0 {
+			interval = defaultPollInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		var err error
+		if session, err = c.Session(ctx, session.ID); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// ListPicked lists a page of the media picked in a session
+func (c *Client) ListPicked(ctx context.Context, sessionID, nextPageToken string) (*ListResponse, error) {
+	values := url.Values{}
+	values.Set("sessionId", sessionID)
+	values.Set("pageSize", pageSize)
+	if nextPageToken != "" {
+		values.Set("pageToken", nextPageToken)
+	}
+	get, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v1/mediaItems?%s", c.baseURL, values.Encode()), nil)
+	var picked ListResponse
+	if err := c.call(get, client.RequestPicked, &picked); err != nil {
+		return nil, err
+	}
+	return &picked, nil
+}
+
+// call makes the request of kind and decodes its JSON response into v, unless v is nil
+func (c *Client) call(r *http.Request, kind client.RequestKind, v any) error {
+	response, err := c.client.Do(r.WithContext(client.WithRequestKind(r.Context(), kind)))
+	if err != nil {
+		if response != nil && response.Body != nil {
+			response.Body.Close()
+		}
+		return fmt.Errorf("%s failed: %w", kind, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return client.NewAPIError(kind, "", response)
+	}
+	defer response.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// Media is the photos.MediaService of the media picked in a session
+func (c *Client) Media(sessionID string) *Media {
+	return &Media{client: c, sessionID: sessionID}
+}
+
+// Media lists the media picked in a session as data.MediaItem, and downloads it like client.Client.
+// The baseUrls of picked media can not be renewed, so the sync of a session has to end within the
+// hour they last.
+type Media struct {
+	client    *Client
+	sessionID string
+}
+
+func (m *Media) List(ctx context.Context, nextPageToken string) (*data.MediaResponse, error) {
+	picked, err := m.client.ListPicked(ctx, m.sessionID, nextPageToken)
+	if err != nil {
+		return nil, err
+	}
+	medias := &data.MediaResponse{NextPageToken: picked.NextPageToken}
+	for _, item := range picked.MediaItems {
+		medias.MediaItems = append(medias.MediaItems, item.mediaItem())
+	}
+	return medias, nil
+}
+
+// Get downloads like client.Client, the request counted apart from the Library API's
+func (m *Media) Get(ctx context.Context, mediaItem data.MediaItem) ([]byte, error) {
+	return m.client.client.Get(client.WithRequestKind(ctx, client.RequestPickedMedia), mediaItem)
+}
+
+// DownloadRange makes Media a photos.Downloader
+func (m *Media) DownloadRange(ctx context.Context, mediaItem data.MediaItem, start, end int64, etag string) (*client.Download, error) {
+	return m.client.client.DownloadRange(client.WithRequestKind(ctx, client.RequestPickedMedia), mediaItem, start, end, etag)
+}
+
+// Throughput makes Media photos.Throttled
+func (m *Media) Throughput() client.Throughput {
+	return m.client.client.Throughput()
+}
+
+// mediaItem is the picked item as the Library API would list it
+func (item *MediaItem) mediaItem() *data.MediaItem {
+	file := item.MediaFile
+	metadata := data.MediaMetadata{CreationTime: item.CreateTime}
+	if file.MediaFileMetadata.Width > 0 {
+		metadata.Width = strconv.Itoa(file.MediaFileMetadata.Width)
+	}
+	if file.MediaFileMetadata.Height > 0 {
+		metadata.Height = strconv.Itoa(file.MediaFileMetadata.Height)
+	}
+	switch fileMetadata := file.MediaFileMetadata; {
+	case fileMetadata.VideoMetadata != nil || item.Type == "VIDEO":
+		metadata.Video = &data.Video{CameraMake: fileMetadata.CameraMake, CameraModel: fileMetadata.CameraModel}
+		if fileMetadata.VideoMetadata != nil {
+			metadata.Video.Fps, metadata.Video.Status = fileMetadata.VideoMetadata.Fps, fileMetadata.VideoMetadata.ProcessingStatus
+		}
+	default:
+		metadata.Photo = &data.Photo{CameraMake: fileMetadata.CameraMake, CameraModel: fileMetadata.CameraModel}
+		if photo := fileMetadata.PhotoMetadata; photo != nil {
+			metadata.Photo.FocalLength, metadata.Photo.ApertureFNumber = photo.FocalLength, photo.ApertureFNumber
+			metadata.Photo.IsoEquivalent, metadata.Photo.ExposureTime = photo.IsoEquivalent, photo.ExposureTime
+		}
+	}
+	return &data.MediaItem{ID: item.ID, Filename: file.Filename, BaseUrl: file.BaseURL, MimeType: file.MimeType, Metadata: metadata}
+}
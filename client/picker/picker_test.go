@@ -0,0 +1,118 @@
+package picker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/client/picker"
+	"velocitizer.com/photogo/client/picker/pickertest"
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/photos"
+	"velocitizer.com/photogo/photos/photostest"
+	"velocitizer.com/photogo/storage"
+)
+
+func newServer() *pickertest.Server {
+	var items []photostest.Item
+	for i := 0; i < 3; i++ {
+		items = append(items, photostest.Item{
+			MediaItem: data.MediaItem{
+				ID:       fmt.Sprintf("id-%d", i),
+				Filename: fmt.Sprintf("IMG_%04d.JPG", i),
+				MimeType: "image/jpeg",
+				Metadata: data.MediaMetadata{CreationTime: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Width: "4032", Height: "3024"},
+			},
+			Content: []byte(fmt.Sprintf("image %d", i)),
+		})
+	}
+	items = append(items, photostest.Item{
+		MediaItem: data.MediaItem{ID: "id-video", Filename: "VID_0001.MP4", MimeType: "video/mp4",
+			Metadata: data.MediaMetadata{CreationTime: time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)}},
+		Content: []byte("video"),
+	})
+	return pickertest.NewServer(items...)
+}
+
+func newPicker(server *pickertest.Server) *picker.Client {
+	return picker.New(client.New(server.Client().Do), picker.WithBaseURL(server.URL))
+}
+
+func TestClient(t *testing.T) {
+	t.Run("syncs the picked media", func(t *testing.T) {
+		server := newServer()
+		defer server.Close()
+		p := newPicker(server)
+		ctx := context.Background()
+
+		session, err := p.CreateSession(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, server.URL+"/pick/"+session.ID, session.PickerURI)
+		assert.Equal(t, 10*time.Millisecond, session.PollingConfig.PollInterval)
+		assert.False(t, session.MediaItemsSet)
+		time.AfterFunc(30*time.Millisecond, func() { server.Pick(session.ID, "id-2", "id-video") })
+		session, err = p.Wait(ctx, session)
+		require.NoError(t, err)
+		assert.True(t, session.MediaItemsSet)
+
+		medias, err := p.Media(session.ID).List(ctx, "")
+		require.NoError(t, err)
+		require.Len(t, medias.MediaItems, 2)
+		assert.Equal(t, "IMG_0002.JPG", medias.MediaItems[0].Filename)
+		assert.Equal(t, "4032", medias.MediaItems[0].Metadata.Width)
+		assert.NotNil(t, medias.MediaItems[1].Metadata.Video)
+
+		store := storage.NewMemory()
+		require.NoError(t, photos.Extract(ctx, p.Media(session.ID), store, 2, false, photos.WithSource(photos.SourcePicker)))
+		b, err := store.ReadFile("2024/05/IMG_0002.JPG")
+		require.NoError(t, err)
+		assert.Equal(t, "image 2", string(b))
+		b, err = store.ReadFile("2024/05/VID_0001.MP4")
+		require.NoError(t, err)
+		assert.Equal(t, "video", string(b), "videos are downloaded with =dv")
+		index, err := photos.LoadIndex(store)
+		require.NoError(t, err)
+		require.Len(t, index.Entries(), 2)
+		for _, entry := range index.Entries() {
+			assert.Equal(t, photos.SourcePicker, entry.Source, entry.Path)
+		}
+
+		require.NoError(t, p.DeleteSession(ctx, session.ID))
+		assert.Empty(t, server.Sessions())
+	})
+	t.Run("media can not be listed before it is picked", func(t *testing.T) {
+		server := newServer()
+		defer server.Close()
+		p := newPicker(server)
+		session, err := p.CreateSession(context.Background())
+		require.NoError(t, err)
+
+		_, err = p.Media(session.ID).List(context.Background(), "")
+		var apiErr *client.APIError
+		require.True(t, errors.As(err, &apiErr), "got %v", err)
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+		assert.Equal(t, "FAILED_PRECONDITION", apiErr.Status)
+	})
+	t.Run("waiting ends with the session or the context", func(t *testing.T) {
+		server := newServer()
+		defer server.Close()
+		server.Timeout = 50 * time.Millisecond
+		p := newPicker(server)
+		session, err := p.CreateSession(context.Background())
+		require.NoError(t, err)
+
+		_, err = p.Wait(context.Background(), session)
+		assert.True(t, errors.Is(err, picker.ErrTimeout), "got %v", err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = p.Wait(ctx, session)
+		assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+	})
+}
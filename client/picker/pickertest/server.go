@@ -0,0 +1,268 @@
+// Package pickertest provides a fake Google Photos Picker API for tests that run offline.
+package pickertest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"velocitizer.com/photogo/photos/photostest"
+)
+
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+// Server is an httptest.Server implementing the Picker API: sessions, the listing of the media picked
+// in them, and content served from baseUrls. Media is picked with Pick, standing in for the user.
+type Server struct {
+	*httptest.Server
+	// PollInterval and Timeout are the pollingConfig of new sessions
+	PollInterval time.Duration
+	Timeout      time.Duration
+
+	mu       sync.Mutex
+	items    []*photostest.Item
+	sessions map[string]*session
+	next     int
+}
+
+type session struct {
+	id     string
+	picked []*photostest.Item
+	set    bool
+}
+
+// NewServer starts a Server with items to pick from. Close it when done.
+func NewServer(items ...photostest.Item) *Server {
+	s := &Server{PollInterval: 10 * time.Millisecond, Timeout: time.Minute, sessions: map[string]*session{}}
+	for _, item := range items {
+		item := item
+		s.items = append(s.items, &item)
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Pick has the user pick the items with ids in a session and be done
+func (s *Server) Pick(sessionID string, ids ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return fmt.Errorf("no session %q", sessionID)
+	}
+	for _, id := range ids {
+		item := s.find(id)
+		if item == nil {
+			return fmt.Errorf("no item %q", id)
+		}
+		session.picked = append(session.picked, item)
+	}
+	session.set = true
+	return nil
+}
+
+// Sessions returns the ids of the sessions not deleted
+func (s *Server) Sessions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case p == "/v1/sessions" && r.Method == http.MethodPost:
+		s.createSession(w)
+	case strings.HasPrefix(p, "/v1/sessions/") && r.Method == http.MethodGet:
+		s.getSession(w, strings.TrimPrefix(p, "/v1/sessions/"))
+	case strings.HasPrefix(p, "/v1/sessions/") && r.Method == http.MethodDelete:
+		s.deleteSession(w, strings.TrimPrefix(p, "/v1/sessions/"))
+	case p == "/v1/mediaItems" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case strings.HasPrefix(p, "/content/") && r.Method == http.MethodGet:
+		s.content(w, r, strings.TrimPrefix(p, "/content/"))
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unknown path "+p)
+	}
+}
+
+func (s *Server) createSession(w http.ResponseWriter) {
+	s.mu.Lock()
+	s.next++
+	session := &session{id: fmt.Sprintf("session-%d", s.next)}
+	s.sessions[session.id] = session
+	response := s.session(session)
+	s.mu.Unlock()
+	writeJSON(w, response)
+}
+
+func (s *Server) getSession(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Requested entity was not found.")
+		return
+	}
+	writeJSON(w, s.session(session))
+}
+
+func (s *Server) deleteSession(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Requested entity was not found.")
+		return
+	}
+	delete(s.sessions, id)
+	writeJSON(w, struct{}{})
+}
+
+// session is the JSON of a session, with s.mu held
+func (s *Server) session(session *session) map[string]any {
+	return map[string]any{
+		"id":        session.id,
+		"pickerUri": fmt.Sprintf("%s/pick/%s", s.URL, session.id),
+		"pollingConfig": map[string]string{
+			"pollInterval": formatDuration(s.PollInterval),
+			"timeoutIn":    formatDuration(s.Timeout),
+		},
+		"mediaItemsSet": session.set,
+	}
+}
+
+// formatDuration writes a duration as Google APIs do, in seconds such as "3.5s"
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pageSize := defaultPageSize
+	if value := query.Get("pageSize"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", fmt.Sprintf("invalid pageSize %q", value))
+			return
+		}
+		pageSize = min(max(size, 1), maxPageSize)
+	}
+	s.mu.Lock()
+	session, ok := s.sessions[query.Get("sessionId")]
+	var picked []*photostest.Item
+	set := false
+	if ok {
+		picked, set = append(picked, session.picked...), session.set
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Requested entity was not found.")
+		return
+	case !set:
+		writeError(w, http.StatusBadRequest, "FAILED_PRECONDITION", "The user has not finished picking media items.")
+		return
+	}
+	offset := 0
+	if token := query.Get("pageToken"); token != "" {
+		var err error
+		offset, err = strconv.Atoi(strings.TrimPrefix(token, "page-"))
+		if err != nil || offset < 0 || offset > len(picked) {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid pageToken")
+			return
+		}
+	}
+	end := min(offset+pageSize, len(picked))
+	items := []map[string]any{}
+	for _, item := range picked[offset:end] {
+		items = append(items, s.mediaItem(item))
+	}
+	response := map[string]any{"mediaItems": items}
+	if end < len(picked) {
+		response["nextPageToken"] = fmt.Sprintf("page-%d", end)
+	}
+	writeJSON(w, response)
+}
+
+// mediaItem is the JSON of a picked item
+func (s *Server) mediaItem(item *photostest.Item) map[string]any {
+	kind, metadata := "PHOTO", map[string]any{}
+	if strings.HasPrefix(item.MimeType, "video") {
+		kind = "VIDEO"
+		metadata["videoMetadata"] = map[string]any{"processingStatus": "READY"}
+	}
+	for key, value := range map[string]string{"width": item.Metadata.Width, "height": item.Metadata.Height} {
+		if n, err := strconv.Atoi(value); err == nil {
+			metadata[key] = n
+		}
+	}
+	return map[string]any{
+		"id":         item.ID,
+		"createTime": item.Metadata.CreationTime,
+		"type":       kind,
+		"mediaFile": map[string]any{
+			"baseUrl":           fmt.Sprintf("%s/content/%s", s.URL, item.ID),
+			"mimeType":          item.MimeType,
+			"filename":          item.Filename,
+			"mediaFileMetadata": metadata,
+		},
+	}
+}
+
+// content serves the bytes of a baseUrl, /content/{id} followed by a =d or =dv suffix, with ranges
+func (s *Server) content(w http.ResponseWriter, r *http.Request, ref string) {
+	id, suffix, _ := strings.Cut(ref, "=")
+	s.mu.Lock()
+	item := s.find(id)
+	s.mu.Unlock()
+	if item == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Requested entity was not found.")
+		return
+	}
+	video := strings.HasPrefix(item.MimeType, "video")
+	if (video && suffix != "dv") || (!video && suffix != "d") {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", fmt.Sprintf("unsupported baseUrl suffix %q for %s", suffix, item.MimeType))
+		return
+	}
+	w.Header().Set("Content-Type", item.MimeType)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(item.Content)))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(item.Content))
+}
+
+// find is the item with id, with s.mu held
+func (s *Server) find(id string) *photostest.Item {
+	for _, item := range s.items {
+		if item.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with the error body Google APIs use, name being its status such as NOT_FOUND
+func writeError(w http.ResponseWriter, status int, name, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"code": status, "message": message, "status": name},
+	})
+}
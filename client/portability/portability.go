@@ -0,0 +1,289 @@
+// Package portability exports a whole Google Photos library through the Data Portability API.
+// An archive job is initiated, polled until Google has written the archives, and the archives are
+// downloaded from their signed urls, resuming where an earlier attempt stopped. The archives are
+// in the format of Google Takeout, for photos.ImportTakeout.
+package portability
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"velocitizer.com/photogo/client"
+)
+
+// DefaultBaseURL is the Data Portability API
+const DefaultBaseURL = "https://dataportability.googleapis.com"
+
+// Resource is the resource group of Google Photos
+const Resource = "photos"
+
+// Scope is the OAuth scope of Resource
+const Scope = "https://www.googleapis.com/auth/dataportability." + Resource
+
+// States of an archive job
+const (
+	StateInProgress = "IN_PROGRESS"
+	StateComplete   = "COMPLETE"
+	StateFailed     = "FAILED"
+	StateCancelled  = "CANCELLED"
+)
+
+// ErrFailed is returned by Wait when the archive job ended without archives
+var ErrFailed = errors.New("the archive job failed")
+
+// ArchiveState is the state of an archive job, with the urls of its archives once complete
+type ArchiveState struct {
+	// Name is archiveJobs/{job}/portabilityArchiveState
+	Name  string   `json:"name"`
+	State string   `json:"state"`
+	URLs  []string `json:"urls"`
+}
+
+// JobID is the job of the state, read from its Name, empty when the Name is not a job's
+func (s *ArchiveState) JobID() string {
+	parts := strings.Split(s.Name, "/")
+	if len(parts) != 3 || parts[0] != "archiveJobs" || parts[1] == "" || parts[1] == "." || parts[1] == ".." {
+		return ""
+	}
+	return parts[1]
+}
+
+// Client calls the Data Portability API through a client.Client, with its middleware. The archives
+// are downloaded with another Getter, as their signed urls take no credentials.
+type Client struct {
+	client     *client.Client
+	baseURL    string
+	downloader client.Getter
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithBaseURL points the client at another Data Portability API, such as a portabilitytest.Server
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithDownloader downloads the archives with getter, http.DefaultClient by default
+func WithDownloader(getter client.Getter) Option {
+	return func(c *Client) {
+		c.downloader = getter
+	}
+}
+
+// New makes requests with c, authorized for Scope
+func New(c *client.Client, options ...Option) *Client {
+	p := &Client{client: c, baseURL: DefaultBaseURL, downloader: http.DefaultClient.Do}
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
+
+// Initiate starts an archive job of resources, Resource for the library, and returns its id
+func (c *Client) Initiate(ctx context.Context, resources ...string) (string, error) {
+	body, err := json.Marshal(map[string][]string{"resources": resources})
+	if err != nil {
+		return "", err
+	}
+	post, _ := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/v1/portabilityArchive:initiate", strings.NewReader(string(body)))
+	post.Header.Set("Content-Type", "application/json")
+	var initiated struct {
+		ArchiveJobID string `json:"archiveJobId"`
+	}
+	if err := c.call(post, &initiated); err != nil {
+		return "", err
+	}
+	return initiated.ArchiveJobID, nil
+}
+
+// State gets the state of an archive job
+func (c *Client) State(ctx context.Context, jobID string) (*ArchiveState, error) {
+	get, _ := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s/v1/archiveJobs/%s/portabilityArchiveState", c.baseURL, url.PathEscape(jobID)), nil)
+	var state ArchiveState
+	if err := c.call(get, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Wait polls an archive job every interval until it is complete. It returns ErrFailed when the job
+// failed or was cancelled. Archives of a whole library can take hours, or days.
+func (c *Client) Wait(ctx context.Context, jobID string, interval time.Duration) (*ArchiveState, error) {
+	for {
+		state, err := c.State(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		switch state.State {
+		case StateComplete:
+			return state, nil
+		case StateFailed, StateCancelled:
+			return nil, fmt.Errorf("%w: %s is %s", ErrFailed, jobID, state.State)
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// call makes the request and decodes its JSON response into v
+func (c *Client) call(r *http.Request, v any) error {
+	response, err := c.client.Do(r.WithContext(client.WithRequestKind(r.Context(), client.RequestArchive)))
+	if err != nil {
+		if response != nil && response.Body != nil {
+			response.Body.Close()
+		}
+		return fmt.Errorf("%s failed: %w", client.RequestArchive, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return client.NewAPIError(client.RequestArchive, "", response)
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// partialSuffix marks an archive still being downloaded
+const partialSuffix = ".partial"
+
+// Download saves the archives of a complete job in a directory of dir named after the job, and
+// returns their paths. Archives already there are kept, and one partly downloaded by an earlier
+// attempt is continued with a Range request. Each job has its own directory, so the archives of
+// an earlier job are never taken for those of a later one.
+func (c *Client) Download(ctx context.Context, state *ArchiveState, dir string) ([]string, error) {
+	jobID := state.JobID()
+	if jobID == "" {
+		return nil, fmt.Errorf("no archive job in the state name %q", state.Name)
+	}
+	dir = filepath.Join(dir, jobID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for i, archiveURL := range state.URLs {
+		name := filepath.Join(dir, archiveName(i, archiveURL))
+		if _, err := os.Stat(name); err == nil {
+			paths = append(paths, name)
+			continue
+		}
+		if err := c.download(ctx, archiveURL, name); err != nil {
+			return paths, fmt.Errorf("failed to download archive %d: %w", i+1, err)
+		}
+		paths = append(paths, name)
+	}
+	return paths, nil
+}
+
+// archiveName is the file of the i-th archive, numbered so each attempt of a job finds the same
+// file, with the extension of the url so ImportTakeout knows how to read it
+func archiveName(i int, archiveURL string) string {
+	ext := ".zip"
+	if u, err := url.Parse(archiveURL); err == nil {
+		lower := strings.ToLower(path.Base(u.Path))
+		switch {
+		case strings.HasSuffix(lower, ".tar.gz"):
+			ext = ".tar.gz"
+		case strings.HasSuffix(lower, ".tgz"):
+			ext = ".tgz"
+		}
+	}
+	return fmt.Sprintf("archive-%03d%s", i+1, ext)
+}
+
+// download writes the archive at archiveURL to name, through a partial file it continues if present
+func (c *Client) download(ctx context.Context, archiveURL, name string) error {
+	partial := name + partialSuffix
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	get, _ := http.NewRequestWithContext(client.WithRequestKind(ctx, client.RequestArchiveDownload), "GET", archiveURL, nil)
+	if offset > 0 {
+		get.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	response, err := c.downloader(get)
+	if err != nil {
+		return client.RedactError(err)
+	}
+	defer response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusPartialContent:
+		if start := contentRangeStart(response.Header.Get("Content-Range")); start != offset {
+			return fmt.Errorf("unexpected range %q for offset %d", response.Header.Get("Content-Range"), offset)
+		}
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		if contentRangeSize(response.Header.Get("Content-Range")) == offset {
+			// the archive was complete, the last attempt stopped before renaming it
+			if err := f.Close(); err != nil {
+				return err
+			}
+			return os.Rename(partial, name)
+		}
+		// the partial file is no longer a prefix of the archive, start over
+		f.Close()
+		if err := os.Remove(partial); err != nil {
+			return err
+		}
+		return c.download(ctx, archiveURL, name)
+	case response.StatusCode == http.StatusOK:
+		// the whole archive, the server ignored the range
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	default:
+		return client.NewAPIError(client.RequestArchiveDownload, "", response)
+	}
+	if _, err := io.Copy(f, response.Body); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, name)
+}
+
+// contentRangeStart is the first byte of a "bytes start-end/size" Content-Range, -1 when invalid
+func contentRangeStart(value string) int64 {
+	first, _, ok := strings.Cut(strings.TrimPrefix(value, "bytes "), "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if !ok || err != nil {
+		return -1
+	}
+	return start
+}
+
+// contentRangeSize is the size of the whole in a Content-Range such as "bytes */size", -1 when unknown
+func contentRangeSize(value string) int64 {
+	_, total, ok := strings.Cut(value, "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if !ok || err != nil {
+		return -1
+	}
+	return size
+}
@@ -0,0 +1,185 @@
+package portability_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/client/portability"
+	"velocitizer.com/photogo/client/portability/portabilitytest"
+	"velocitizer.com/photogo/photos"
+	"velocitizer.com/photogo/storage"
+)
+
+// takeout is a zip archive of media with its sidecars, as Takeout writes them
+func takeout(t *testing.T, taken time.Time, names ...string) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, name := range names {
+		w, err := zw.Create("Takeout/Google Photos/Photos from 2020/" + name)
+		require.NoError(t, err)
+		fmt.Fprintf(w, "media %s", name)
+		w, err = zw.Create("Takeout/Google Photos/Photos from 2020/" + name + ".json")
+		require.NoError(t, err)
+		fmt.Fprintf(w, `{"title":%q,"photoTakenTime":{"timestamp":"%d"}}`, name, taken.Unix())
+	}
+	require.NoError(t, zw.Close())
+	return b.Bytes()
+}
+
+func newClient(server *portabilitytest.Server) *portability.Client {
+	return portability.New(client.New(server.Client().Do), portability.WithBaseURL(server.URL),
+		portability.WithDownloader(server.Client().Do))
+}
+
+func TestClient(t *testing.T) {
+	taken := time.Date(2020, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	t.Run("exports the library into the layout of a sync", func(t *testing.T) {
+		server := portabilitytest.NewServer(takeout(t, taken, "IMG_0001.JPG", "IMG_0002.JPG"), takeout(t, taken, "VID_0003.MP4"))
+		defer server.Close()
+		server.CompleteAfter(2)
+		p := newClient(server)
+		ctx := context.Background()
+
+		jobID, err := p.Initiate(ctx, portability.Resource)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"photos"}, server.Resources(jobID))
+		state, err := p.Wait(ctx, jobID, time.Millisecond)
+		require.NoError(t, err)
+		require.Len(t, state.URLs, 2)
+		assert.Equal(t, jobID, state.JobID())
+
+		dir := t.TempDir()
+		archives, err := p.Download(ctx, state, dir)
+		require.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, jobID, "archive-001.zip"), filepath.Join(dir, jobID, "archive-002.zip")}, archives)
+
+		store := storage.NewMemory()
+		require.NoError(t, photos.ImportTakeout(ctx, store, archives))
+		for _, name := range []string{"IMG_0001.JPG", "IMG_0002.JPG", "VID_0003.MP4"} {
+			b, err := store.ReadFile("2020/03/" + name)
+			require.NoError(t, err)
+			assert.Equal(t, "media "+name, string(b))
+			info, err := store.Stat("2020/03/" + name)
+			require.NoError(t, err)
+			assert.True(t, taken.Equal(info.ModTime()), "%s has the time it was taken, got %s", name, info.ModTime())
+		}
+	})
+	t.Run("an export keeps the photos Takeout numbers for sharing a title", func(t *testing.T) {
+		var b bytes.Buffer
+		zw := zip.NewWriter(&b)
+		for name, contents := range map[string]string{
+			"IMG_0001.JPG":         "media IMG_0001.JPG",
+			"IMG_0001.JPG.json":    fmt.Sprintf(`{"title":"IMG_0001.JPG","photoTakenTime":{"timestamp":"%d"}}`, taken.Unix()),
+			"IMG_0001(1).JPG":      "media IMG_0001(1).JPG",
+			"IMG_0001.JPG(1).json": fmt.Sprintf(`{"title":"IMG_0001.JPG","photoTakenTime":{"timestamp":"%d"}}`, taken.Unix()),
+		} {
+			w, err := zw.Create("Takeout/Google Photos/Photos from 2020/" + name)
+			require.NoError(t, err)
+			fmt.Fprint(w, contents)
+		}
+		require.NoError(t, zw.Close())
+		server := portabilitytest.NewServer(b.Bytes())
+		defer server.Close()
+		p := newClient(server)
+		ctx := context.Background()
+		jobID, err := p.Initiate(ctx, portability.Resource)
+		require.NoError(t, err)
+		state, err := p.Wait(ctx, jobID, time.Millisecond)
+		require.NoError(t, err)
+		archives, err := p.Download(ctx, state, t.TempDir())
+		require.NoError(t, err)
+
+		store := storage.NewMemory()
+		require.NoError(t, photos.ImportTakeout(ctx, store, archives))
+		infos, err := store.List("2020/03")
+		require.NoError(t, err)
+		var contents []string
+		for _, info := range infos {
+			b, err := store.ReadFile("2020/03/" + info.Name())
+			require.NoError(t, err)
+			contents = append(contents, string(b))
+		}
+		assert.ElementsMatch(t, []string{"media IMG_0001.JPG", "media IMG_0001(1).JPG"}, contents, "neither photo is lost")
+	})
+	t.Run("a download continues where it stopped", func(t *testing.T) {
+		archive := takeout(t, taken, "IMG_0001.JPG")
+		server := portabilitytest.NewServer(archive)
+		defer server.Close()
+		p := newClient(server)
+		ctx := context.Background()
+		jobID, err := p.Initiate(ctx, portability.Resource)
+		require.NoError(t, err)
+		state, err := p.Wait(ctx, jobID, time.Millisecond)
+		require.NoError(t, err)
+
+		dir := t.TempDir()
+		server.TruncateNext(100)
+		_, err = p.Download(ctx, state, dir)
+		require.Error(t, err)
+		archives, err := p.Download(ctx, state, dir)
+		require.NoError(t, err)
+		b, err := os.ReadFile(archives[0])
+		require.NoError(t, err)
+		assert.Equal(t, archive, b)
+		assert.Equal(t, []string{"", "bytes=100-"}, server.Ranges())
+
+		_, err = p.Download(ctx, state, dir)
+		require.NoError(t, err)
+		assert.Len(t, server.Ranges(), 2, "a downloaded archive is not downloaded again")
+
+		// complete, but stopped before taking the place of the archive
+		require.NoError(t, os.Rename(archives[0], archives[0]+".partial"))
+		archives, err = p.Download(ctx, state, dir)
+		require.NoError(t, err)
+		b, err = os.ReadFile(archives[0])
+		require.NoError(t, err)
+		assert.Equal(t, archive, b, "kept rather than downloaded again")
+		assert.Equal(t, []string{"", "bytes=100-", fmt.Sprintf("bytes=%d-", len(archive))}, server.Ranges())
+	})
+	t.Run("a new job does not take the archives of another", func(t *testing.T) {
+		server := portabilitytest.NewServer(takeout(t, taken, "IMG_0001.JPG"))
+		defer server.Close()
+		p := newClient(server)
+		ctx := context.Background()
+		dir := t.TempDir()
+		var downloaded []string
+		for i := 0; i < 2; i++ {
+			jobID, err := p.Initiate(ctx, portability.Resource)
+			require.NoError(t, err)
+			state, err := p.Wait(ctx, jobID, time.Millisecond)
+			require.NoError(t, err)
+			archives, err := p.Download(ctx, state, dir)
+			require.NoError(t, err)
+			downloaded = append(downloaded, archives...)
+		}
+		require.Len(t, downloaded, 2)
+		assert.NotEqual(t, downloaded[0], downloaded[1])
+		assert.Len(t, server.Ranges(), 2, "each job downloads its own archive")
+	})
+	t.Run("a failed job", func(t *testing.T) {
+		server := portabilitytest.NewServer(takeout(t, taken, "IMG_0001.JPG"))
+		defer server.Close()
+		server.FailJobs()
+		p := newClient(server)
+		jobID, err := p.Initiate(context.Background(), portability.Resource)
+		require.NoError(t, err)
+
+		_, err = p.Wait(context.Background(), jobID, time.Millisecond)
+		assert.True(t, errors.Is(err, portability.ErrFailed), "got %v", err)
+		_, err = p.State(context.Background(), "unknown")
+		var apiErr *client.APIError
+		require.True(t, errors.As(err, &apiErr), "got %v", err)
+		assert.Equal(t, client.RequestArchive, apiErr.Kind)
+	})
+}
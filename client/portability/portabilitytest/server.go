@@ -0,0 +1,192 @@
+// Package portabilitytest provides a fake Google Data Portability API for tests that run offline.
+package portabilitytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is an httptest.Server implementing the archive jobs of the Data Portability API, and
+// serving their archives from signed urls with Range support.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	archives [][]byte
+	jobs     map[string]*job
+	next     int
+	polls    int
+	failJobs bool
+	truncate int
+	ranges   []string
+}
+
+type job struct {
+	resources []string
+	polls     int
+}
+
+// NewServer starts a Server whose jobs export archives, zip files in Takeout's format. Close it when done.
+func NewServer(archives ...[]byte) *Server {
+	s := &Server{archives: archives, jobs: map[string]*job{}}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// CompleteAfter keeps jobs in progress for their first polls, 0 by default
+func (s *Server) CompleteAfter(polls int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polls = polls
+}
+
+// FailJobs makes every job end as FAILED
+func (s *Server) FailJobs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failJobs = true
+}
+
+// TruncateNext cuts the next archive download after n bytes, while promising all of it
+func (s *Server) TruncateNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.truncate = n
+}
+
+// Ranges returns the Range header of every archive download, empty for a whole archive
+func (s *Server) Ranges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// Resources returns the resources job was initiated with
+func (s *Server) Resources(jobID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[jobID]; ok {
+		return job.resources
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case p == "/v1/portabilityArchive:initiate" && r.Method == http.MethodPost:
+		s.initiate(w, r)
+	case strings.HasPrefix(p, "/v1/archiveJobs/") && strings.HasSuffix(p, "/portabilityArchiveState") && r.Method == http.MethodGet:
+		s.state(w, strings.TrimSuffix(strings.TrimPrefix(p, "/v1/archiveJobs/"), "/portabilityArchiveState"))
+	case strings.HasPrefix(p, "/archives/") && r.Method == http.MethodGet:
+		s.archive(w, r, strings.TrimPrefix(p, "/archives/"))
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unknown path "+p)
+	}
+}
+
+func (s *Server) initiate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Resources []string `json:"resources"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Resources) == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "resources are required")
+		return
+	}
+	s.mu.Lock()
+	s.next++
+	id := strconv.Itoa(s.next)
+	s.jobs[id] = &job{resources: req.Resources}
+	s.mu.Unlock()
+	writeJSON(w, map[string]string{"archiveJobId": id, "accessType": "ACCESS_TYPE_ONE_TIME"})
+}
+
+func (s *Server) state(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Requested entity was not found.")
+		return
+	}
+	job.polls++
+	state := map[string]any{"name": fmt.Sprintf("archiveJobs/%s/portabilityArchiveState", id)}
+	switch {
+	case job.polls <= s.polls:
+		state["state"] = "IN_PROGRESS"
+	case s.failJobs:
+		state["state"] = "FAILED"
+	default:
+		state["state"] = "COMPLETE"
+		var urls []string
+		for i := range s.archives {
+			// the signature is what a signed url carries instead of credentials
+			urls = append(urls, fmt.Sprintf("%s/archives/%s/%d/takeout-%03d.zip?signature=secret", s.URL, id, i, i+1))
+		}
+		state["urls"] = urls
+	}
+	writeJSON(w, state)
+}
+
+// archive serves /archives/{job}/{index}/{name}, continuing from the start of a "bytes=N-" Range
+func (s *Server) archive(w http.ResponseWriter, r *http.Request, ref string) {
+	parts := strings.Split(ref, "/")
+	s.mu.Lock()
+	var body []byte
+	if len(parts) == 3 && s.jobs[parts[0]] != nil {
+		if i, err := strconv.Atoi(parts[1]); err == nil && i >= 0 && i < len(s.archives) {
+			body = s.archives[i]
+		}
+	}
+	byteRange := r.Header.Get("Range")
+	s.ranges = append(s.ranges, byteRange)
+	truncate := s.truncate
+	s.truncate = 0
+	s.mu.Unlock()
+	if body == nil || r.URL.Query().Get("signature") == "" {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "no such archive")
+		return
+	}
+	status := http.StatusOK
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Accept-Ranges", "bytes")
+	if byteRange != "" {
+		start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(byteRange, "bytes="), "-"))
+		if err != nil || start < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "unsupported range "+byteRange)
+			return
+		}
+		if start >= len(body) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(body)))
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "OUT_OF_RANGE", "range not satisfiable")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+		body, status = body[start:], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if truncate > 0 && truncate < len(body) {
+		body = body[:truncate]
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with the error body Google APIs use, name being its status such as NOT_FOUND
+func writeError(w http.ResponseWriter, status int, name, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"code": status, "message": message, "status": name},
+	})
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces what must not reach the logs
+const redacted = "REDACTED"
+
+// sensitiveKeys are attributes whose value is never logged
+var sensitiveKeys = map[string]bool{
+	"baseUrl":       true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"pageToken":     true,
+	"authorization": true,
+}
+
+var (
+	urlPattern   = regexp.MustCompile(`https?://[^\s"'<>]+`)
+	tokenPattern = regexp.MustCompile(`(ya29\.|1//)[\w.-]+|(?i:bearer) [\w.~+/-]+=*`)
+)
+
+// Redact hides the secrets in s: baseUrls, which grant access to the media without a token,
+// OAuth tokens, query strings and credentials in urls
+func Redact(s string) string {
+	s = urlPattern.ReplaceAllStringFunc(s, func(raw string) string {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return redacted
+		}
+		u.User = nil
+		if strings.HasSuffix(u.Hostname(), "googleusercontent.com") {
+			u.Path, u.RawPath = "/"+redacted, ""
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = redacted
+		}
+		return u.String()
+	})
+	return tokenPattern.ReplaceAllString(s, redacted)
+}
+
+// RedactAttr is a slog.HandlerOptions ReplaceAttr that applies Redact to strings and errors,
+// and drops the values of attributes named like tokens and baseUrls
+func RedactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[a.Key] {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return a
+}
+
+// RedactError is err with its message redacted, still matching err with errors.Is and errors.As
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err}
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e *redactedError) Error() string { return Redact(e.err.Error()) }
+func (e *redactedError) Unwrap() error { return e.err }
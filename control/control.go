@@ -0,0 +1,107 @@
+// Package control serves a photos.Controller over HTTP, for a running sync or daemon:
+//
+//	GET  /status   the photos.Status, as JSON
+//	POST /sync     starts the next sync of the daemon now
+//	POST /pause    stops starting more media
+//	POST /resume   undoes /pause
+//	POST /workers  sets the worker count, from a body like {"count": 3}
+//
+// Actions answer with the status after them, errors with a body like {"error": "..."}. They must
+// be sent with Content-Type: application/json and, when they carry an Origin, from the same
+// host, so a web page on another site can not send them through the browser.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+
+	"velocitizer.com/photogo/photos"
+)
+
+// Handler serves the endpoints of c
+func Handler(c *photos.Controller) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.Status())
+	})
+	mux.HandleFunc("POST /sync", sameSite(func(w http.ResponseWriter, r *http.Request) {
+		switch err := c.Trigger(); {
+		case errors.Is(err, photos.ErrNotScheduled), errors.Is(err, photos.ErrSyncing):
+			writeError(w, http.StatusConflict, err)
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		default:
+			writeJSON(w, http.StatusAccepted, c.Status())
+		}
+	}))
+	mux.HandleFunc("POST /pause", sameSite(func(w http.ResponseWriter, r *http.Request) {
+		c.Pause()
+		writeJSON(w, http.StatusOK, c.Status())
+	}))
+	mux.HandleFunc("POST /resume", sameSite(func(w http.ResponseWriter, r *http.Request) {
+		c.Resume()
+		writeJSON(w, http.StatusOK, c.Status())
+	}))
+	mux.HandleFunc("POST /workers", sameSite(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Count int `json:"count"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+			return
+		}
+		if err := c.SetWorkerCount(body.Count); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Status())
+	}))
+	return mux
+}
+
+// sameSite refuses actions a page on another site could make the browser send: browsers name
+// that site in Origin, and only send a JSON body across sites after a preflight this API never allows
+func sameSite(action http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				writeError(w, http.StatusForbidden, fmt.Errorf("cross-site request from %s", origin))
+				return
+			}
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("actions need Content-Type: application/json"))
+			return
+		}
+		action(w, r)
+	}
+}
+
+// Addr completes a listen address to the loopback interface when it has no host, so "8080"
+// and ":8080" listen on 127.0.0.1:8080
+func Addr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// a port alone
+		host, port = "", addr
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,225 @@
+package control_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/control"
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/photos"
+	"velocitizer.com/photogo/photos/photostest"
+	"velocitizer.com/photogo/storage"
+)
+
+// gatedService holds every download until released, signalling when one starts
+type gatedService struct {
+	photos.MediaService
+	started chan string
+	release chan struct{}
+}
+
+func (g *gatedService) Get(ctx context.Context, mediaItem data.MediaItem) ([]byte, error) {
+	g.started <- mediaItem.ID
+	select {
+	case <-g.release:
+		return g.MediaService.Get(ctx, mediaItem)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func library(count int) *photostest.Server {
+	var items []photostest.Item
+	for i := 0; i < count; i++ {
+		items = append(items, photostest.Item{
+			MediaItem: data.MediaItem{
+				ID:       fmt.Sprintf("id-%d", i),
+				Filename: fmt.Sprintf("IMG_%04d.JPG", i),
+				MimeType: "image/jpeg",
+				Metadata: data.MediaMetadata{CreationTime: time.Date(2021, 9, 13, 15, 4, 5, 0, time.UTC)},
+			},
+			Content: []byte(fmt.Sprintf("image %d", i)),
+		})
+	}
+	return photostest.NewServer(items...)
+}
+
+// call makes a request to the control API, decoding the JSON answer into v
+func call(t *testing.T, api *httptest.Server, method, path, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := api.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func status(t *testing.T, api *httptest.Server) photos.Status {
+	var s photos.Status
+	require.Equal(t, http.StatusOK, call(t, api, http.MethodGet, "/status", "", &s))
+	return s
+}
+
+// waitFor polls condition until it holds, for at most a second
+func waitFor(t *testing.T, condition func() bool, msgAndArgs ...any) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "condition never held", msgAndArgs...)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Run("steers a running sync", func(t *testing.T) {
+		server := library(10)
+		defer server.Close()
+		service := &gatedService{
+			MediaService: client.New(server.Client().Do, client.WithBaseURL(server.URL)),
+			started:      make(chan string, 10),
+			release:      make(chan struct{}),
+		}
+		c := photos.NewController()
+		api := httptest.NewServer(control.Handler(c))
+		defer api.Close()
+		done := make(chan error)
+		go func() {
+			done <- photos.Extract(context.Background(), service, storage.NewMemory(), 2, false, photos.WithController(c))
+		}()
+		<-service.started
+		<-service.started
+
+		s := status(t, api)
+		assert.Equal(t, "syncing", s.State)
+		assert.Equal(t, 2, s.WorkerCount)
+		assert.Equal(t, int64(10), s.Progress.Listed)
+		assert.Len(t, s.Workers, 2)
+
+		var paused photos.Status
+		assert.Equal(t, http.StatusOK, call(t, api, http.MethodPost, "/pause", "", &paused))
+		assert.True(t, paused.Paused)
+		close(service.release)
+		waitFor(t, func() bool { return c.Status().Progress.Saved == 2 })
+		s = status(t, api)
+		assert.Empty(t, s.Workers, "nothing starts while paused")
+		assert.Equal(t, "syncing", s.State)
+
+		var resized photos.Status
+		assert.Equal(t, http.StatusOK, call(t, api, http.MethodPost, "/workers", `{"count": 4}`, &resized))
+		assert.Equal(t, 4, resized.WorkerCount)
+		var failure map[string]string
+		assert.Equal(t, http.StatusBadRequest, call(t, api, http.MethodPost, "/workers", `{"count": 0}`, &failure))
+		assert.Contains(t, failure["error"], "invalid worker count")
+		assert.Equal(t, http.StatusConflict, call(t, api, http.MethodPost, "/sync", "", &failure), "no daemon to trigger")
+
+		assert.Equal(t, http.StatusOK, call(t, api, http.MethodPost, "/resume", "", nil))
+		require.NoError(t, <-done)
+		s = status(t, api)
+		assert.Equal(t, "idle", s.State)
+		assert.Equal(t, int64(10), s.Progress.Saved)
+		assert.Zero(t, s.Progress.Skipped)
+		assert.NotZero(t, s.Progress.Bytes)
+	})
+	t.Run("counts media already saved as skipped", func(t *testing.T) {
+		server := library(3)
+		defer server.Close()
+		service := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		store := storage.NewMemory()
+		require.NoError(t, photos.Extract(context.Background(), service, store, 2, false))
+		c := photos.NewController()
+
+		require.NoError(t, photos.Extract(context.Background(), service, store, 2, false, photos.WithController(c)))
+		assert.Zero(t, c.Status().Progress.Saved)
+		assert.Equal(t, int64(3), c.Status().Progress.Skipped)
+	})
+	t.Run("refuses actions a page on another site could send", func(t *testing.T) {
+		c := photos.NewController()
+		api := httptest.NewServer(control.Handler(c))
+		defer api.Close()
+		send := func(contentType, origin string) int {
+			req, err := http.NewRequest(http.MethodPost, api.URL+"/pause", strings.NewReader(""))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", contentType)
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			resp, err := api.Client().Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, send("text/plain", ""))
+		assert.Equal(t, http.StatusForbidden, send("application/json", "https://evil.example"))
+		assert.False(t, c.Status().Paused)
+		assert.Equal(t, http.StatusOK, send("application/json", api.URL))
+		assert.True(t, c.Status().Paused)
+	})
+	t.Run("reports failures", func(t *testing.T) {
+		server := library(3)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, Status: http.StatusInternalServerError})
+		c := photos.NewController()
+		api := httptest.NewServer(control.Handler(c))
+		defer api.Close()
+		service := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		require.Error(t, photos.Extract(context.Background(), service, storage.NewMemory(), 1, false, photos.WithController(c)))
+
+		s := status(t, api)
+		assert.Equal(t, int64(1), s.Progress.Failed)
+		require.Len(t, s.Errors, 1)
+		assert.Equal(t, "id-0", s.Errors[0].ID)
+		assert.Contains(t, s.Errors[0].Error, "500")
+	})
+	t.Run("triggers a daemon", func(t *testing.T) {
+		server := library(3)
+		defer server.Close()
+		c := photos.NewController()
+		api := httptest.NewServer(control.Handler(c))
+		defer api.Close()
+		service := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			daemon := photos.Daemon{Schedule: photos.Every(time.Hour), WorkerCount: 2, Backoff: time.Minute, MaxBackoff: time.Minute}
+			done <- daemon.Run(ctx, service, storage.NewMemory(), photos.WithController(c))
+		}()
+		waitFor(t, func() bool { return !c.Status().Next.IsZero() }, "the first sync is done")
+		assert.Equal(t, 1, server.Hits(photostest.List))
+
+		assert.Equal(t, http.StatusAccepted, call(t, api, http.MethodPost, "/sync", "", nil))
+		waitFor(t, func() bool { return server.Hits(photostest.List) == 2 }, "synced well before the hour")
+		cancel()
+		assert.True(t, errors.Is(<-done, photos.ErrInterrupted))
+	})
+}
+
+func TestAddr(t *testing.T) {
+	tests := map[string]string{
+		"8080":         "127.0.0.1:8080",
+		":8080":        "127.0.0.1:8080",
+		"0.0.0.0:8080": "0.0.0.0:8080",
+		"[::1]:8080":   "[::1]:8080",
+	}
+	for addr, want := range tests {
+		assert.Equal(t, want, control.Addr(addr), addr)
+	}
+}
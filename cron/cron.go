@@ -0,0 +1,133 @@
+// Package cron reads the five field schedules of crontab(5): minute, hour, day of month, month
+// and day of week, each a *, a number, a range a-b, a step */n or a-b/n, or a list of those.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a * day field, as crontab matches either day field when both are restricted
+	domAny, dowAny bool
+}
+
+type field struct {
+	min, max int
+}
+
+var fields = []field{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// Parse reads a five field expression such as "30 2 * * *", or one of @hourly, @daily and @weekly
+func Parse(expr string) (*Schedule, error) {
+	switch expr {
+	case "@hourly":
+		expr = "0 * * * *"
+	case "@daily", "@midnight":
+		expr = "0 0 * * *"
+	case "@weekly":
+		expr = "0 0 * * 0"
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("invalid cron expression %q, expected 5 fields", expr)
+	}
+	var bits [5]uint64
+	for i, part := range parts {
+		var err error
+		if bits[i], err = parseField(part, fields[i]); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+	}
+	schedule := &Schedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domAny: parts[2] == "*", dowAny: parts[4] == "*",
+	}
+	// such as February 30th, which Next would search for in vain
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid cron expression %q: it never matches", expr)
+	}
+	return schedule, nil
+}
+
+func parseField(value string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(value, ",") {
+		span, stepText, stepped := strings.Cut(item, "/")
+		step := 1
+		if stepped {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		first, last := f.min, f.max
+		if span != "*" {
+			from, to, ranged := strings.Cut(span, "-")
+			var err error
+			if first, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", span)
+			}
+			last = first
+			if ranged {
+				if last, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", span)
+				}
+			} else if stepped {
+				last = f.max
+			}
+		}
+		if f.max == 6 && last == 7 {
+			// Sunday is 0 or 7
+			if first == 7 {
+				first, last = 0, 0
+			} else {
+				last = 6
+				bits |= 1
+			}
+		}
+		if first < f.min || last > f.max || first > last {
+			return 0, fmt.Errorf("%q is outside %d-%d", item, f.min, f.max)
+		}
+		for n := first; n <= last; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+// Next is the first time after t that the schedule matches, in the location of t, zero when it
+// does not match within five years
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	// every combination repeats within a few years, leap days included
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
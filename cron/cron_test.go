@@ -0,0 +1,47 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/cron"
+)
+
+func TestNext(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2022, 6, 15, 10, 20, 30, 0, time.UTC)
+	for expr, expected := range map[string]time.Time{
+		"* * * * *":       time.Date(2022, 6, 15, 10, 21, 0, 0, time.UTC),
+		"30 2 * * *":      time.Date(2022, 6, 16, 2, 30, 0, 0, time.UTC),
+		"*/15 * * * *":    time.Date(2022, 6, 15, 10, 30, 0, 0, time.UTC),
+		"0 9-17/4 * * *":  time.Date(2022, 6, 15, 13, 0, 0, 0, time.UTC),
+		"0 0 * * 0":       time.Date(2022, 6, 19, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 7":       time.Date(2022, 6, 19, 0, 0, 0, 0, time.UTC),
+		"0 0 1 * *":       time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 1 * 5":       time.Date(2022, 6, 17, 0, 0, 0, 0, time.UTC),
+		"0 3 29 2 *":      time.Date(2024, 2, 29, 3, 0, 0, 0, time.UTC),
+		"5,35 1,13 * * *": time.Date(2022, 6, 15, 13, 5, 0, 0, time.UTC),
+		"@daily":          time.Date(2022, 6, 16, 0, 0, 0, 0, time.UTC),
+	} {
+		schedule, err := cron.Parse(expr)
+		require.NoError(t, err, expr)
+		assert.Equal(t, expected, schedule.Next(from), expr)
+	}
+}
+
+func TestNext_Location(t *testing.T) {
+	india := time.FixedZone("IST", 5*60*60+30*60)
+	schedule, err := cron.Parse("0 * * * *")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2022, 6, 15, 11, 0, 0, 0, india), schedule.Next(time.Date(2022, 6, 15, 10, 20, 0, 0, india)))
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "a * * * *",
+		"0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		_, err := cron.Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -16,8 +16,83 @@ type MediaItem struct {
 	BaseUrl  string        `json:"baseUrl"`
 	MimeType string        `json:"mimeType"`
 	Metadata MediaMetadata `json:"mediaMetadata"`
+	// Description is the caption added in Google Photos
+	Description string `json:"description,omitempty"`
 }
 
 type MediaMetadata struct {
 	CreationTime time.Time `json:"creationTime"`
+	Width        string    `json:"width,omitempty"`
+	Height       string    `json:"height,omitempty"`
+	Photo        *Photo    `json:"photo,omitempty"`
+	Video        *Video    `json:"video,omitempty"`
+}
+
+type Photo struct {
+	CameraMake      string  `json:"cameraMake,omitempty"`
+	CameraModel     string  `json:"cameraModel,omitempty"`
+	FocalLength     float64 `json:"focalLength,omitempty"`
+	ApertureFNumber float64 `json:"apertureFNumber,omitempty"`
+	IsoEquivalent   int     `json:"isoEquivalent,omitempty"`
+	ExposureTime    string  `json:"exposureTime,omitempty"`
+}
+
+type Video struct {
+	CameraMake  string  `json:"cameraMake,omitempty"`
+	CameraModel string  `json:"cameraModel,omitempty"`
+	Fps         float64 `json:"fps,omitempty"`
+	Status      string  `json:"status,omitempty"`
+}
+
+type SearchRequest struct {
+	AlbumID   string   `json:"albumId,omitempty"`
+	PageSize  int      `json:"pageSize,omitempty"`
+	PageToken string   `json:"pageToken,omitempty"`
+	Filters   *Filters `json:"filters,omitempty"`
+}
+
+type Filters struct {
+	DateFilter *DateFilter `json:"dateFilter,omitempty"`
+}
+
+type DateFilter struct {
+	Dates  []Date      `json:"dates,omitempty"`
+	Ranges []DateRange `json:"ranges,omitempty"`
+}
+
+type DateRange struct {
+	StartDate Date `json:"startDate"`
+	EndDate   Date `json:"endDate"`
+}
+
+type Date struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Day   int `json:"day"`
+}
+
+type BatchGetResponse struct {
+	MediaItemResults []MediaItemResult `json:"mediaItemResults"`
+}
+
+type MediaItemResult struct {
+	MediaItem *MediaItem `json:"mediaItem,omitempty"`
+	Status    *Status    `json:"status,omitempty"`
+}
+
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type Album struct {
+	ID              string `json:"id"`
+	Title           string `json:"title"`
+	ProductUrl      string `json:"productUrl,omitempty"`
+	MediaItemsCount string `json:"mediaItemsCount,omitempty"`
+}
+
+type AlbumsResponse struct {
+	Albums        []*Album `json:"albums"`
+	NextPageToken string   `json:"nextPageToken"`
 }
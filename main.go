@@ -3,58 +3,689 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/client/cassette"
+	"velocitizer.com/photogo/client/picker"
+	"velocitizer.com/photogo/client/portability"
+	"velocitizer.com/photogo/control"
+	"velocitizer.com/photogo/cron"
+	"velocitizer.com/photogo/metrics"
 	"velocitizer.com/photogo/photos"
+	"velocitizer.com/photogo/storage"
 )
 
 func main() {
-	workerCount := flag.Int("worker-count", 5, "number of fetch workers")
-	outputDir := flag.String("output", "data", "directory to write output")
-	readonly := flag.Bool("read-only", false, "list the files that would be created")
-	flag.Parse()
-	b, err := os.ReadFile("credentials.json")
+	command, args := "sync", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "sync":
+		runSync(args)
+	case "dupes":
+		runDupes(args)
+	case "import-takeout":
+		runImportTakeout(args)
+	case "fix-times":
+		runFixTimes(args)
+	case "merge-locations":
+		runMergeLocations(args)
+	case "daemon":
+		runDaemon(args)
+	case "pick":
+		runPick(args)
+	case "export":
+		runExport(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q, expected sync, daemon, pick, export, dupes, import-takeout, fix-times or merge-locations\n", command)
+		os.Exit(2)
+	}
+}
+
+// runSync downloads the library into the output, the default command
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	readonly := flags.Bool("read-only", false, "list the files that would be created")
+	syncing := addSyncFlags(flags)
+	flags.Parse(args)
+	options, store, service, flush := syncing.setup(libraryAccess)
+
+	stop, ctx, release := shutdown(*syncing.grace)
+	defer release()
+
+	err := photos.Extract(ctx, service, store, *syncing.workerCount, *readonly, append(options, photos.WithStop(stop))...)
+	flush()
+	if errors.Is(err, photos.ErrInterrupted) {
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		fatal("sync failed", err)
+	}
+}
+
+// runDaemon syncs on a schedule until interrupted, listing only new media between full syncs
+func runDaemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	every := flags.Duration("every", time.Hour, "time between the starts of two syncs")
+	cronExpr := flags.String("cron", "", `when to sync as a crontab expression in local time, e.g. "30 2 * * *", instead of -every`)
+	fullSync := flags.Duration("full-sync", 24*time.Hour, "longest time between two syncs that list the whole library, the others list only new media")
+	syncing := addSyncFlags(flags)
+	flags.Parse(args)
+	options, store, service, flush := syncing.setup(libraryAccess)
+	var schedule photos.Schedule = photos.Every(*every)
+	if *cronExpr != "" {
+		s, err := cron.Parse(*cronExpr)
+		if err != nil {
+			fatal("invalid -cron", err)
+		}
+		schedule = s
+	}
+	daemon := photos.Daemon{Schedule: schedule, WorkerCount: *syncing.workerCount, FullSync: *fullSync,
+		Backoff: time.Minute, MaxBackoff: 6 * time.Hour}
+
+	stop, ctx, release := shutdown(*syncing.grace)
+	defer release()
+
+	// a daemon stops by being interrupted, so that is a success
+	err := daemon.Run(ctx, service, store, append(options, photos.WithStop(stop))...)
+	flush()
+	if err != nil && !errors.Is(err, photos.ErrInterrupted) {
+		fatal("daemon failed", err)
+	}
+}
+
+// runPick syncs the media the user picks in Google Photos, through the Picker API, as the Library
+// API only lists the media photogo uploaded itself
+func runPick(args []string) {
+	flags := flag.NewFlagSet("pick", flag.ExitOnError)
+	readonly := flags.Bool("read-only", false, "list the files that would be created")
+	syncing := addSyncFlags(flags)
+	flags.Parse(args)
+	options, store, service, flush := syncing.setup(pickerAccess)
+	p := picker.New(service)
+
+	stop, ctx, release := shutdown(*syncing.grace)
+	defer release()
+
+	session, err := p.CreateSession(ctx)
+	if err != nil {
+		fatal("unable to create a picking session", err)
+	}
+	fmt.Printf("Pick the media to sync at the following link, then select Done: \n%v\n", session.PickerURI)
+	session, err = p.Wait(stop, session)
+	if errors.Is(err, context.Canceled) {
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		fatal("picking failed", err)
+	}
+
+	// the picked media is not the whole library, so it never makes orphans of the rest
+	err = photos.Extract(ctx, p.Media(session.ID), store, *syncing.workerCount, *readonly,
+		append(options, photos.WithSource(photos.SourcePicker), photos.WithStop(stop))...)
+	flush()
+	if deleteErr := p.DeleteSession(context.Background(), session.ID); deleteErr != nil {
+		slog.Warn("unable to delete the picking session", "err", deleteErr)
+	}
+	if errors.Is(err, photos.ErrInterrupted) {
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		fatal("sync failed", err)
+	}
+}
+
+// syncFlags are the flags of the commands that download the library
+type syncFlags struct {
+	workerCount    *int
+	orphans        *string
+	confirmDelete  *int
+	chunkThreshold *int64
+	chunkSize      *int64
+	grace          *time.Duration
+	limit          *string
+	requestRate    *float64
+	control        *string
+	metrics        *string
+	metricsFile    *string
+	dumpHTTP       *bool
+	record         *string
+	recordMedia    *bool
+	replay         *string
+	layout         *layoutFlags
+	logs           *logFlags
+}
+
+func addSyncFlags(flags *flag.FlagSet) *syncFlags {
+	return &syncFlags{
+		workerCount:    flags.Int("worker-count", 5, "number of fetch workers"),
+		orphans:        flags.String("orphans", string(photos.OrphansKeep), "what to do with saved media deleted from Google Photos: keep, report, trash or delete"),
+		confirmDelete:  flags.Int("confirm-delete", -1, "with -orphans delete, the number of orphans expected to be deleted"),
+		chunkThreshold: flags.Int64("chunk-threshold", 64, "size in MiB above which media is downloaded as concurrent ranges, 0 to disable"),
+		chunkSize:      flags.Int64("chunk-size", 16, "size in MiB of each range of a chunked download"),
+		grace:          flags.Duration("grace", 30*time.Second, "after an interrupt, how long running downloads may finish before they are aborted; a second interrupt aborts at once"),
+		limit:          flags.String("limit", "unlimited", "download bandwidth shared by all workers, e.g. 2MB, or by time of day, e.g. 01:00-06:00=unlimited,2MB"),
+		requestRate:    flags.Float64("request-rate", 10, "most requests started per second, retries included, 0 for no limit"),
+		control:        flags.String("control", "", "address of the HTTP control and status API, e.g. 8080 for 127.0.0.1:8080; off when empty"),
+		metrics:        flags.String("metrics", "", "address to serve Prometheus metrics at /metrics, e.g. 9090 for 127.0.0.1:9090; off when empty"),
+		metricsFile:    flags.String("metrics-file", "", "file to write Prometheus metrics to on exit, for the node_exporter textfile collector, e.g. photogo.prom"),
+		dumpHTTP:       flags.Bool("dump-http", false, "write the headers of every request and response to stderr, redacted"),
+		record:         flags.String("record", "", "directory to record the API requests to as a cassette, with tokens and baseUrls scrubbed"),
+		recordMedia:    flags.Bool("record-media", false, "with -record, record the media too rather than placeholders"),
+		replay:         flags.String("replay", "", "directory of a cassette to answer the API requests from, offline and without credentials"),
+		layout:         addLayoutFlags(flags),
+		logs:           addLogFlags(flags),
+	}
+}
+
+// setup reads the flags into the options of Extract, the output and a client authorized for access.
+// flush writes the metrics file, if any, and is to be called on exit.
+func (s *syncFlags) setup(access access) (options []photos.Option, store storage.Storage, service *client.Client, flush func()) {
+	logger := s.logs.logger()
+	orphanPolicy, err := photos.ParseOrphanPolicy(*s.orphans)
+	if err != nil {
+		fatal("invalid -orphans", err)
+	}
+	schedule, err := client.ParseSchedule(*s.limit)
+	if err != nil {
+		fatal("invalid -limit", err)
+	}
+	registry := metrics.NewRegistry()
+	options = append(s.layout.options(logger), photos.WithOrphans(orphanPolicy), photos.WithDeleteConfirmation(*s.confirmDelete),
+		photos.WithChunks(*s.chunkThreshold<<20, *s.chunkSize<<20), photos.WithMetrics(registry))
+	if *s.control != "" {
+		options = append(options, photos.WithController(serveControl(*s.control, logger)))
+	}
+	if *s.metrics != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", registry)
+		serve("metrics", *s.metrics, mux, logger)
+	}
+	store = s.layout.storage()
+	clientOptions := []client.Option{
+		client.WithLimiter(client.NewLimiter(schedule)), client.WithLogger(logger),
+		// inside Retry, every attempt waits its turn
+		client.WithMiddleware(client.UserAgent(userAgent), client.Logging(logger), client.Retry(3, time.Second),
+			client.RateLimit(*s.requestRate, max(1, int(*s.requestRate)))),
+		// inside Retry, every attempt counts against the quota
+		client.WithMetrics(registry),
+	}
+	if *s.dumpHTTP {
+		clientOptions = append(clientOptions, client.WithMiddleware(client.Dump(os.Stderr)))
+	}
+	if *s.record != "" {
+		clientOptions = append(clientOptions, client.WithMiddleware(cassette.Record(*s.record, cassette.WithMedia(*s.recordMedia))))
+	}
+	if *s.replay != "" {
+		replay, err := cassette.Replay(*s.replay)
+		if err != nil {
+			fatal("invalid -replay", err)
+		}
+		service = client.New(replay, clientOptions...)
+	} else {
+		service = newClient(access, clientOptions...)
+	}
+	return options, store, service, func() {
+		if *s.metricsFile == "" {
+			return
+		}
+		if err := registry.WriteFile(*s.metricsFile); err != nil {
+			logger.Error("failed to write -metrics-file", "err", err)
+		}
+	}
+}
+
+// serveControl serves the control API of a new controller on addr, for as long as the process runs
+func serveControl(addr string, logger *slog.Logger) *photos.Controller {
+	controller := photos.NewController()
+	serve("control API", addr, control.Handler(controller), logger)
+	return controller
+}
+
+// serve serves handler on addr, the loopback interface unless addr names a host, for as long as the process runs
+func serve(name, addr string, handler http.Handler, logger *slog.Logger) {
+	listener, err := net.Listen("tcp", control.Addr(addr))
+	if err != nil {
+		fatal("failed to listen for the "+name, err)
+	}
+	logger.Info("serving the "+name, "addr", "http://"+listener.Addr().String())
+	go func() {
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		if err := server.Serve(listener); err != nil {
+			logger.Error(name+" failed", "err", err)
+		}
+	}()
+}
+
+// userAgent identifies photogo to the APIs
+const userAgent = "photogo"
+
+// exitInterrupted is the exit code of a sync stopped by a signal, like a shell's for SIGINT
+const exitInterrupted = 130
+
+// shutdown returns the contexts of a two stage shutdown: stop is done at the first interrupt or
+// termination signal, abort at the second or once grace has passed since the first
+func shutdown(grace time.Duration) (stop, abort context.Context, release func()) {
+	stop, requestStop := context.WithCancel(context.Background())
+	abort, requestAbort := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+		slog.Warn("stopping once running downloads finish, interrupt again to abort", "grace", grace)
+		requestStop()
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-signals:
+			slog.Warn("aborting")
+		case <-timer.C:
+			slog.Warn("aborting, the grace period is over")
+		case <-done:
+			return
+		}
+		requestAbort()
+	}()
+	return stop, abort, func() {
+		signal.Stop(signals)
+		close(done)
+		requestStop()
+		requestAbort()
+	}
+}
+
+// runFixTimes resets the times of media already in the output, without downloading it again
+func runFixTimes(args []string) {
+	flags := flag.NewFlagSet("fix-times", flag.ExitOnError)
+	readonly := flags.Bool("read-only", false, "report the times that would be fixed")
+	offline := flags.Bool("offline", false, "only use the dates embedded in the files, without listing the library")
+	layout := addLayoutFlags(flags)
+	logs := addLogFlags(flags)
+	flags.Parse(args)
+	logger := logs.logger()
+	options := layout.options(logger)
+	store := layout.storage()
+	var service photos.MediaService
+	if !*offline {
+		service = newClient(libraryAccess, client.WithLogger(logger))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := photos.FixTimes(ctx, service, store, *readonly, options...); err != nil {
+		fatal("fix-times failed", err)
+	}
+}
+
+// runDupes prints the groups of identical media recorded by earlier syncs
+func runDupes(args []string) {
+	flags := flag.NewFlagSet("dupes", flag.ExitOnError)
+	outputDir := flags.String("output", "data", "directory, or WebDAV url, media was written to")
+	flags.Parse(args)
+	store, err := newStorage(*outputDir)
+	if err != nil {
+		fatal("unable to use output", err, "output", *outputDir)
+	}
+	idx, err := photos.LoadIndex(store)
+	if err != nil {
+		fatal("unable to load the index", err)
+	}
+	groups := idx.Duplicates()
+	for _, group := range groups {
+		fmt.Printf("sha256:%s\n", group.SHA256)
+		for _, entry := range group.Entries {
+			location := entry.Path
+			if location == "" {
+				location = "(skipped)"
+			}
+			fmt.Printf("  %s\t%s\n", entry.ID, location)
+		}
+	}
+	fmt.Printf("%d media have duplicates\n", len(groups))
+}
+
+// runImportTakeout saves the media in Google Takeout archives with the same layout as sync
+func runImportTakeout(args []string) {
+	flags := flag.NewFlagSet("import-takeout", flag.ExitOnError)
+	layout := addLayoutFlags(flags)
+	logs := addLogFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: photogo import-takeout [flags] takeout-001.zip [takeout-002.tgz ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	options := layout.options(logs.logger())
+	store := layout.storage()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := photos.ImportTakeout(ctx, store, flags.Args(), options...); err != nil {
+		fatal("import-takeout failed", err)
+	}
+}
+
+// runExport has the Data Portability API archive the whole library, downloads the archives and
+// imports them like import-takeout
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	archives := flags.String("archives", "archives", "directory to download the archives to, in a directory per job, kept to continue an interrupted export")
+	jobID := flags.String("job", "", "id of an archive job initiated by an earlier run, to continue it rather than start another")
+	poll := flags.Duration("poll", time.Minute, "time between two checks of whether the archives are ready")
+	limit := flags.String("limit", "unlimited", "archive download bandwidth, e.g. 2MB, or by time of day, e.g. 01:00-06:00=unlimited,2MB")
+	layout := addLayoutFlags(flags)
+	logs := addLogFlags(flags)
+	flags.Parse(args)
+	logger := logs.logger()
+	options := layout.options(logger)
+	store := layout.storage()
+	schedule, err := client.ParseSchedule(*limit)
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		fatal("invalid -limit", err)
 	}
+	middleware := []client.Middleware{client.UserAgent(userAgent), client.Logging(logger), client.Retry(3, time.Second)}
+	service := newClient(portabilityAccess, client.WithLogger(logger), client.WithMiddleware(middleware...))
+	// the signed urls of the archives take no credentials
+	downloader := client.Chain(http.DefaultClient.Do, append(middleware, client.Throttle(client.NewLimiter(schedule)))...)
+	p := portability.New(service, portability.WithDownloader(downloader))
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/photoslibrary.readonly")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *jobID == "" {
+		id, err := p.Initiate(ctx, portability.Resource)
+		if err != nil {
+			fatal("unable to initiate an archive job", err)
+		}
+		*jobID = id
+		logger.Info("archive job initiated, add -job to continue it if interrupted", "job", id)
+	}
+	state, err := p.Wait(ctx, *jobID, *poll)
+	if errors.Is(err, context.Canceled) {
+		logger.Warn("interrupted, add -job to continue waiting for the archives", "job", *jobID)
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		fatal("archive job failed", err, "job", *jobID)
+	}
+	paths, err := p.Download(ctx, state, *archives)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		fatal("unable to download the archives, run again with -job to continue", err, "job", *jobID)
 	}
-	httpclient := getClient(config)
-	client := client.New(httpclient.Do)
+	if err := photos.ImportTakeout(ctx, store, paths, options...); err != nil {
+		fatal("import failed", err)
+	}
+}
+
+// runMergeLocations writes the locations in Takeout sidecars into media the sync saved without them
+func runMergeLocations(args []string) {
+	flags := flag.NewFlagSet("merge-locations", flag.ExitOnError)
+	to := flags.String("to", string(photos.LocationsEXIF), "where to write locations: exif (into JPEG and MP4/MOV, an XMP sidecar for the rest) or xmp (sidecars only)")
+	readonly := flags.Bool("read-only", false, "report the locations that would be written")
+	layout := addLayoutFlags(flags)
+	logs := addLogFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: photogo merge-locations [flags] takeout-001.zip [Takeout/ ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	logger := logs.logger()
+	target, err := photos.ParseLocationTarget(*to)
+	if err != nil {
+		fatal("invalid -to", err)
+	}
+	options := layout.options(logger)
+	store := layout.storage()
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	err = photos.Extract(ctx, client, *outputDir, *workerCount, *readonly)
+	if err := photos.MergeLocations(ctx, store, flags.Args(), target, *readonly, options...); err != nil {
+		fatal("merge-locations failed", err)
+	}
+}
+
+// layoutFlags are the flags of the commands that write media, deciding where and under what name
+type layoutFlags struct {
+	output     *string
+	duplicates *string
+	names      *string
+	name       *string
+	dates      *string
+	metadata   *bool
+}
+
+func addLayoutFlags(flags *flag.FlagSet) *layoutFlags {
+	return &layoutFlags{
+		output:     flags.String("output", "data", "directory to write output, or a WebDAV url such as https://user@nas:5006/photo, with the password in $"+webdavPasswordEnv),
+		duplicates: flags.String("duplicates", string(photos.DuplicatesReport), "what to do with media identical to media already saved: report, skip or link"),
+		names:      flags.String("names", string(photos.NamesPOSIX), "filename rules of the output: posix, smb or windows"),
+		dates:      flags.String("dates", string(photos.DatesAPI), "which time places media and sets its file time: api, exif (embedded in the file) or earliest"),
+		metadata:   flags.Bool("write-metadata", false, "add the creation time and description to JPEG and MP4/MOV files that do not record them"),
+		name:       flags.String("name", "", `template to rename media with, e.g. {{.Created.Format "20060102_150405"}}_{{short .ID}}{{ext}}`),
+	}
+}
+
+func (l *layoutFlags) options(logger *slog.Logger) []photos.Option {
+	policy, err := photos.ParseDuplicatePolicy(*l.duplicates)
+	if err != nil {
+		fatal("invalid -duplicates", err)
+	}
+	profile, err := photos.ParseNameProfile(*l.names)
+	if err != nil {
+		fatal("invalid -names", err)
+	}
+	dates, err := photos.ParseDatePolicy(*l.dates)
+	if err != nil {
+		fatal("invalid -dates", err)
+	}
+	options := []photos.Option{photos.WithDuplicates(policy), photos.WithNameProfile(profile), photos.WithDates(dates),
+		photos.WithMetadataWrite(*l.metadata), photos.WithLogger(logger)}
+	if *l.name != "" {
+		t, err := photos.ParseNameTemplate(*l.name)
+		if err != nil {
+			fatal("invalid -name", err)
+		}
+		options = append(options, photos.WithNameTemplate(t))
+	}
+	return options
+}
+
+func (l *layoutFlags) storage() storage.Storage {
+	store, err := newStorage(*l.output)
 	if err != nil {
-		log.Panic(err)
+		fatal("unable to use output", err, "output", *l.output)
+	}
+	if _, ok := store.(*storage.WebDAV); ok {
+		slog.Warn("WebDAV can not change the time of files: their time is kept in the Win32LastModifiedTime property, " +
+			"which Windows clients show but the NAS itself does not")
+	}
+	return store
+}
+
+// logFlags choose the level and format of the log on stderr
+type logFlags struct {
+	level  *string
+	format *string
+}
+
+func addLogFlags(flags *flag.FlagSet) *logFlags {
+	return &logFlags{
+		level:  flags.String("log-level", "info", "least severe messages logged: debug, info, warn or error"),
+		format: flags.String("log-format", "text", "log format: text or json"),
 	}
 }
 
+// logger builds the logger of the flags, which also becomes the default. Tokens, baseUrls and
+// credentials in urls are redacted.
+func (l *logFlags) logger() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*l.level)); err != nil {
+		fatal("invalid -log-level", err)
+	}
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: client.RedactAttr}
+	var handler slog.Handler
+	switch *l.format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		fatal("invalid -log-format", fmt.Errorf("unknown format %q, expected text or json", *l.format))
+	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// fatal logs err with the default logger and exits
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append(args, "err", err)...)
+	os.Exit(1)
+}
+
+// Environment variables with the WebDAV password, so it is not in the url shown by ps
+const (
+	webdavPasswordEnv     = "PHOTOGO_WEBDAV_PASSWORD"
+	webdavPasswordFileEnv = "PHOTOGO_WEBDAV_PASSWORD_FILE"
+)
+
+// newStorage picks the storage backend for the output flag: a WebDAV server for http(s) urls,
+// otherwise the local (or mounted) directory.
+func newStorage(output string) (storage.Storage, error) {
+	if strings.HasPrefix(output, "http://") || strings.HasPrefix(output, "https://") {
+		endpoint, err := webdavEndpoint(output)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewWebDAV(endpoint, http.DefaultClient)
+	}
+	return storage.NewLocal(output), nil
+}
+
+// webdavEndpoint adds the password of the environment to the user of the url
+func webdavEndpoint(output string) (string, error) {
+	u, err := url.Parse(output)
+	if err != nil || u.User == nil {
+		return output, nil
+	}
+	if _, ok := u.User.Password(); ok {
+		slog.Warn("the WebDAV password in -output is visible to other users of this machine, set " + webdavPasswordEnv + " instead")
+		return output, nil
+	}
+	password, ok := os.LookupEnv(webdavPasswordEnv)
+	if file := os.Getenv(webdavPasswordFileEnv); !ok && file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the WebDAV password: %v", err)
+		}
+		password, ok = strings.TrimRight(string(b), "\r\n"), true
+	}
+	if ok {
+		u.User = url.UserPassword(u.User.Username(), password)
+	}
+	return u.String(), nil
+}
+
+// access is an OAuth scope, and the file its token is saved in
+type access struct {
+	scope     string
+	tokenFile string
+}
+
+var (
+	libraryAccess = access{scope: "https://www.googleapis.com/auth/photoslibrary.readonly", tokenFile: "token.json"}
+	// the picker has a token of its own, so neither command asks again for the scope of the other
+	pickerAccess      = access{scope: picker.Scope, tokenFile: "token-picker.json"}
+	portabilityAccess = access{scope: portability.Scope, tokenFile: "token-portability.json"}
+)
+
+// newClient authorizes with credentials.json, and the token saved by an earlier run
+func newClient(access access, options ...client.Option) *client.Client {
+	b, err := os.ReadFile("credentials.json")
+	if err != nil {
+		fatal("unable to read client secret file", err)
+	}
+
+	// If modifying these scopes, delete your previously saved token file.
+	config, err := google.ConfigFromJSON(b, access.scope)
+	if err != nil {
+		fatal("unable to parse client secret file to config", err)
+	}
+	httpclient := getClient(config, access.tokenFile)
+	return client.New(httpclient.Do, options...)
+}
+
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
+func getClient(config *oauth2.Config, tokFile string) *http.Client {
+	// The token file stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
-	tokFile := "token.json"
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
 		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+		if err := saveToken(tokFile, tok); err != nil {
+			fatal("unable to cache oauth token", err)
+		}
+	}
+	saving := &savingTokenSource{source: config.TokenSource(context.Background(), tok), path: tokFile, last: tok.AccessToken}
+	return oauth2.NewClient(context.Background(), oauth2.ReuseTokenSource(tok, saving))
+}
+
+// savingTokenSource saves the token each time it is refreshed, so a daemon running for days,
+// and the next run, start from the latest one
+type savingTokenSource struct {
+	source oauth2.TokenSource
+	path   string
+
+	mu   sync.Mutex
+	last string
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok.AccessToken != s.last {
+		s.last = tok.AccessToken
+		if err := saveToken(s.path, tok); err != nil {
+			slog.Warn("unable to save the refreshed oauth token", "path", s.path, "err", err)
+		}
 	}
-	return config.Client(context.Background(), tok)
+	return tok, nil
 }
 
 // Request a token from the web, then returns the retrieved token.
@@ -65,12 +696,12 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 
 	var authCode string
 	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+		fatal("unable to read authorization code", err)
 	}
 
 	tok, err := config.Exchange(context.TODO(), authCode)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		fatal("unable to retrieve token from web", err)
 	}
 	return tok
 }
@@ -88,12 +719,15 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 }
 
 // Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
+func saveToken(path string, token *oauth2.Token) error {
+	slog.Info("saving credential file", "path", path)
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	if err := json.NewEncoder(f).Encode(token); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
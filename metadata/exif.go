@@ -0,0 +1,220 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTime         = 0x9010
+	tagOffsetTimeOriginal = 0x9011
+)
+
+// exifHeader starts the APP1 segment holding EXIF
+var exifHeader = []byte("Exif\x00\x00")
+
+func readJPEG(r *skipReader) (Info, error) {
+	if _, err := readFull(r, 2); err != nil {
+		return Info{}, err
+	}
+	for {
+		marker, err := readFull(r, 2)
+		if err != nil {
+			return Info{}, err
+		}
+		if marker[0] != 0xFF {
+			return Info{}, fmt.Errorf("invalid jpeg marker %x", marker)
+		}
+		// start of scan, image data follows and no more metadata
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return Info{}, ErrNotFound
+		}
+		b, err := readFull(r, 2)
+		if err != nil {
+			return Info{}, err
+		}
+		length := int64(binary.BigEndian.Uint16(b)) - 2
+		if length < 0 {
+			return Info{}, fmt.Errorf("invalid jpeg segment length")
+		}
+		if marker[1] != 0xE1 || length < int64(len(exifHeader)) {
+			if err := r.skip(length); err != nil {
+				return Info{}, err
+			}
+			continue
+		}
+		segment, err := readFull(r, int(length))
+		if err != nil {
+			return Info{}, err
+		}
+		if !bytes.HasPrefix(segment, exifHeader) {
+			// XMP also lives in APP1
+			continue
+		}
+		return parseExif(segment[len(exifHeader):])
+	}
+}
+
+// parseExif reads the TIFF structure of an EXIF block
+func parseExif(tiff []byte) (Info, error) {
+	if len(tiff) < 8 {
+		return Info{}, fmt.Errorf("truncated exif")
+	}
+	var order byteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return Info{}, fmt.Errorf("invalid exif byte order")
+	}
+	tags := map[uint16]string{}
+	ifd0 := order.Uint32(tiff[4:])
+	exifIFD, err := readIFD(tiff, order, ifd0, tags)
+	if err != nil {
+		return Info{}, err
+	}
+	if exifIFD != 0 {
+		if _, err := readIFD(tiff, order, exifIFD, tags); err != nil {
+			return Info{}, err
+		}
+	}
+	info := Info{Source: "exif", CameraMake: tags[tagMake], CameraModel: tags[tagModel], Description: tags[tagImageDescription]}
+	info.Location = readGPS(tiff, order, ifd0)
+	value, offset := tags[tagDateTimeOriginal], tags[tagOffsetTimeOriginal]
+	if value == "" {
+		value, offset = tags[tagDateTime], tags[tagOffsetTime]
+	}
+	captured, ok := parseExifTime(value)
+	if !ok {
+		return info, ErrNotFound
+	}
+	info.Captured = captured
+	if loc, ok := parseOffset(offset); ok {
+		c := captured
+		info.Captured = time.Date(c.Year(), c.Month(), c.Day(), c.Hour(), c.Minute(), c.Second(), 0, loc).UTC()
+		info.HasOffset = true
+	}
+	return info, nil
+}
+
+// readIFD collects the ASCII tags of the IFD at offset, returning the offset of the EXIF sub-IFD
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32, tags map[uint16]string) (uint32, error) {
+	if int(offset)+2 > len(tiff) {
+		return 0, fmt.Errorf("invalid exif ifd offset")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	var exifIFD uint32
+	for i := 0; i < count; i++ {
+		entry := int(offset) + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, fmt.Errorf("truncated exif ifd")
+		}
+		tag := order.Uint16(tiff[entry:])
+		kind := order.Uint16(tiff[entry+2:])
+		n := order.Uint32(tiff[entry+4:])
+		switch {
+		case tag == tagExifIFD:
+			exifIFD = order.Uint32(tiff[entry+8:])
+		case kind == 2: // ASCII
+			var value []byte
+			if n <= 4 {
+				value = tiff[entry+8 : entry+8+int(n)]
+			} else {
+				at := order.Uint32(tiff[entry+8:])
+				if int(at)+int(n) > len(tiff) {
+					continue
+				}
+				value = tiff[at : at+n]
+			}
+			tags[tag] = strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+		}
+	}
+	return exifIFD, nil
+}
+
+func parseExifTime(value string) (time.Time, bool) {
+	if value == "" || strings.HasPrefix(value, "0000") {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// parseOffset reads an EXIF offset such as "+02:00"
+func parseOffset(value string) (*time.Location, bool) {
+	t, err := time.Parse("-07:00", value)
+	if err != nil {
+		return nil, false
+	}
+	_, seconds := t.Zone()
+	return time.FixedZone(value, seconds), true
+}
+
+// readGPS returns the location in the GPS IFD, if the IFD at ifd0 points to one
+func readGPS(tiff []byte, order byteOrder, ifd0 uint32) *Location {
+	entries, _, err := readEntries(tiff, order, ifd0)
+	if err != nil {
+		return nil
+	}
+	var gps []ifdEntry
+	for _, entry := range entries {
+		if entry.tag == tagGPSIFD {
+			gps, _, _ = readEntries(tiff, order, order.Uint32(entry.value[:]))
+		}
+	}
+	values := map[uint16][]float64{}
+	refs := map[uint16]byte{}
+	for _, entry := range gps {
+		switch entry.kind {
+		case 2, 1: // ASCII references, or the BYTE altitude reference
+			refs[entry.tag] = entry.value[0]
+		case 5: // RATIONAL
+			at := int(order.Uint32(entry.value[:]))
+			if at+int(entry.count)*8 > len(tiff) {
+				continue
+			}
+			for i := 0; i < int(entry.count); i++ {
+				numerator, denominator := order.Uint32(tiff[at+i*8:]), order.Uint32(tiff[at+i*8+4:])
+				if denominator == 0 {
+					break
+				}
+				values[entry.tag] = append(values[entry.tag], float64(numerator)/float64(denominator))
+			}
+		}
+	}
+	latitude, longitude := values[gpsLatitude], values[gpsLongitude]
+	if len(latitude) != 3 || len(longitude) != 3 {
+		return nil
+	}
+	location := &Location{
+		Latitude:  latitude[0] + latitude[1]/60 + latitude[2]/3600,
+		Longitude: longitude[0] + longitude[1]/60 + longitude[2]/3600,
+	}
+	if refs[gpsLatitudeRef] == 'S' {
+		location.Latitude = -location.Latitude
+	}
+	if refs[gpsLongitudeRef] == 'W' {
+		location.Longitude = -location.Longitude
+	}
+	if altitude := values[gpsAltitude]; len(altitude) == 1 {
+		location.Altitude = altitude[0]
+		if refs[gpsAltitudeRef] == 1 {
+			location.Altitude = -location.Altitude
+		}
+	}
+	return location
+}
@@ -0,0 +1,340 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// epoch1904 is where QuickTime and MP4 times count from
+var epoch1904 = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxMetaSize limits how much of a HEIC meta box is read into memory
+const maxMetaSize = 16 << 20
+
+// readISOBMFF finds the EXIF item of a HEIC, or the movie header (moov/mvhd) of an MP4 or MOV,
+// skipping over the media data
+func readISOBMFF(r *skipReader) (Info, error) {
+	for {
+		kind, size, err := readBoxHeader(r)
+		if err == io.EOF {
+			return Info{}, ErrNotFound
+		}
+		if err != nil {
+			return Info{}, err
+		}
+		switch {
+		case kind == "moov":
+			return readMoov(r, size)
+		case kind == "meta" && size >= 0 && size <= maxMetaSize:
+			meta, err := readFull(r, int(size))
+			if err != nil {
+				return Info{}, err
+			}
+			info, err := readHEIFExif(r, meta)
+			if err != ErrNotFound {
+				return info, err
+			}
+			continue
+		case size < 0:
+			return Info{}, ErrNotFound
+		}
+		if err := r.skip(size); err != nil {
+			return Info{}, err
+		}
+	}
+}
+
+// readHEIFExif reads the item of type Exif listed in the meta box of a HEIC
+func readHEIFExif(r *skipReader, meta []byte) (Info, error) {
+	if len(meta) < 4 {
+		return Info{}, fmt.Errorf("truncated meta")
+	}
+	boxes := children(meta[4:])
+	id, ok := exifItemID(boxes["iinf"])
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	location, err := itemLocation(boxes["iloc"], id)
+	if err != nil {
+		return Info{}, err
+	}
+	var item []byte
+	if location.method == 1 {
+		idat := boxes["idat"]
+		if location.offset+location.length > uint64(len(idat)) {
+			return Info{}, fmt.Errorf("exif item outside idat")
+		}
+		item = idat[location.offset : location.offset+location.length]
+	} else {
+		if err := r.skipTo(int64(location.offset)); err != nil {
+			return Info{}, err
+		}
+		if item, err = readFull(r, int(location.length)); err != nil {
+			return Info{}, err
+		}
+	}
+	// the item starts with the offset of the TIFF header
+	if len(item) < 4 {
+		return Info{}, fmt.Errorf("truncated exif item")
+	}
+	start := 4 + uint64(binary.BigEndian.Uint32(item))
+	if start > uint64(len(item)) {
+		return Info{}, fmt.Errorf("invalid exif item header")
+	}
+	return parseExif(item[start:])
+}
+
+// children returns the bodies of the boxes in b by type, the first of each type
+func children(b []byte) map[string][]byte {
+	boxes := map[string][]byte{}
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		kind := string(b[4:8])
+		header := uint64(8)
+		if size == 1 && len(b) >= 16 {
+			size, header = binary.BigEndian.Uint64(b[8:]), 16
+		} else if size == 0 {
+			size = uint64(len(b))
+		}
+		if size < header || size > uint64(len(b)) {
+			break
+		}
+		if _, ok := boxes[kind]; !ok {
+			boxes[kind] = b[header:size]
+		}
+		b = b[size:]
+	}
+	return boxes
+}
+
+// exifItemID finds the item of type Exif in an item information box
+func exifItemID(iinf []byte) (uint32, bool) {
+	if len(iinf) < 6 {
+		return 0, false
+	}
+	entries := iinf[6:]
+	if iinf[0] != 0 {
+		if len(iinf) < 8 {
+			return 0, false
+		}
+		entries = iinf[8:]
+	}
+	for len(entries) >= 8 {
+		size := binary.BigEndian.Uint32(entries)
+		if size < 8 || uint64(size) > uint64(len(entries)) {
+			return 0, false
+		}
+		infe := entries[8:size]
+		entries = entries[size:]
+		if len(infe) < 4 {
+			continue
+		}
+		version := infe[0]
+		switch {
+		case version == 2 && len(infe) >= 12 && string(infe[8:12]) == "Exif":
+			return uint32(binary.BigEndian.Uint16(infe[4:])), true
+		case version == 3 && len(infe) >= 14 && string(infe[10:14]) == "Exif":
+			return binary.BigEndian.Uint32(infe[4:]), true
+		}
+	}
+	return 0, false
+}
+
+type location struct {
+	method         int
+	offset, length uint64
+}
+
+// itemLocation finds the first extent of item id in an item location box
+func itemLocation(iloc []byte, id uint32) (location, error) {
+	invalid := fmt.Errorf("invalid iloc")
+	if len(iloc) < 8 {
+		return location{}, invalid
+	}
+	version := iloc[0]
+	offsetSize, lengthSize := int(iloc[4]>>4), int(iloc[4]&0xF)
+	baseOffsetSize, indexSize := int(iloc[5]>>4), int(iloc[5]&0xF)
+	if version == 0 {
+		indexSize = 0
+	}
+	p := 6
+	read := func(size int) (uint64, bool) {
+		if p+size > len(iloc) {
+			return 0, false
+		}
+		var v uint64
+		for _, b := range iloc[p : p+size] {
+			v = v<<8 | uint64(b)
+		}
+		p += size
+		return v, true
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count, ok := read(idSize)
+	if !ok {
+		return location{}, invalid
+	}
+	for i := uint64(0); i < count; i++ {
+		itemID, ok := read(idSize)
+		if !ok {
+			return location{}, invalid
+		}
+		var l location
+		if version > 0 {
+			method, ok := read(2)
+			if !ok {
+				return location{}, invalid
+			}
+			l.method = int(method & 0xF)
+		}
+		read(2) // data reference index
+		base, _ := read(baseOffsetSize)
+		extents, ok := read(2)
+		if !ok {
+			return location{}, invalid
+		}
+		for j := uint64(0); j < extents; j++ {
+			read(indexSize)
+			offset, _ := read(offsetSize)
+			length, ok := read(lengthSize)
+			if !ok {
+				return location{}, invalid
+			}
+			if j == 0 {
+				l.offset, l.length = base+offset, length
+			}
+		}
+		if uint32(itemID) == id {
+			if extents == 0 {
+				return location{}, invalid
+			}
+			return l, nil
+		}
+	}
+	return location{}, ErrNotFound
+}
+
+func readMoov(r *skipReader, size int64) (Info, error) {
+	var info Info
+	err := error(ErrNotFound)
+	for size > 8 {
+		kind, boxSize, boxErr := readBoxHeader(r)
+		if boxErr != nil {
+			return Info{}, boxErr
+		}
+		size -= boxSize + 8
+		switch kind {
+		case "mvhd":
+			body, readErr := readFull(r, int(boxSize))
+			if readErr != nil {
+				return Info{}, readErr
+			}
+			location := info.Location
+			info, err = parseMvhd(body)
+			info.Location = location
+		case "udta":
+			body, readErr := readFull(r, int(boxSize))
+			if readErr != nil {
+				return Info{}, readErr
+			}
+			if xyz, ok := child(body, xyzAtom); ok {
+				info.Location = parseXYZ(body[xyz.body:xyz.end])
+			}
+		default:
+			if skipErr := r.skip(boxSize); skipErr != nil {
+				return Info{}, skipErr
+			}
+		}
+	}
+	return info, err
+}
+
+// parseXYZ reads an ISO 6709 location such as +37.334900-122.009000+10.000/ from a ©xyz atom
+func parseXYZ(atom []byte) *Location {
+	if len(atom) < 4 {
+		return nil
+	}
+	text := string(atom[4:])
+	var values []float64
+	for start := 0; start < len(text); {
+		end := start + 1
+		for end < len(text) && text[end] != '+' && text[end] != '-' && text[end] != '/' {
+			end++
+		}
+		v, err := strconv.ParseFloat(text[start:end], 64)
+		if err != nil {
+			break
+		}
+		values = append(values, v)
+		if end < len(text) && text[end] == '/' {
+			break
+		}
+		start = end
+	}
+	if len(values) < 2 {
+		return nil
+	}
+	location := &Location{Latitude: values[0], Longitude: values[1]}
+	if len(values) > 2 {
+		location.Altitude = values[2]
+	}
+	return location
+}
+
+func parseMvhd(body []byte) (Info, error) {
+	if len(body) < 8 {
+		return Info{}, fmt.Errorf("truncated mvhd")
+	}
+	var seconds uint64
+	if body[0] == 1 {
+		if len(body) < 12 {
+			return Info{}, fmt.Errorf("truncated mvhd")
+		}
+		seconds = binary.BigEndian.Uint64(body[4:])
+	} else {
+		seconds = uint64(binary.BigEndian.Uint32(body[4:]))
+	}
+	if seconds == 0 {
+		return Info{}, ErrNotFound
+	}
+	return Info{
+		Captured:  epoch1904.Add(time.Duration(seconds) * time.Second),
+		HasOffset: true,
+		Source:    "mvhd",
+	}, nil
+}
+
+// readBoxHeader returns the type of the next box and the size of its body, -1 when it runs to the end
+func readBoxHeader(r io.Reader) (string, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return "", 0, fmt.Errorf("truncated box header")
+		}
+		return "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header))
+	kind := string(header[4:])
+	switch size {
+	case 0:
+		return kind, -1, nil
+	case 1:
+		large := make([]byte, 8)
+		if _, err := io.ReadFull(r, large); err != nil {
+			return "", 0, fmt.Errorf("truncated box header")
+		}
+		size = int64(binary.BigEndian.Uint64(large)) - 16
+	default:
+		size -= 8
+	}
+	if size < 0 {
+		return "", 0, fmt.Errorf("invalid %s box size", kind)
+	}
+	return kind, size, nil
+}
@@ -0,0 +1,119 @@
+// Package metadata reads the capture time and camera embedded in media files, without
+// decoding the image or video itself.
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the media has no embedded capture time
+var ErrNotFound = errors.New("no embedded capture time")
+
+// ErrUnsupported is returned for formats that can not be read
+var ErrUnsupported = errors.New("unsupported media format")
+
+// Info is the metadata embedded in a media file
+type Info struct {
+	// Captured is when the media was captured. When HasOffset is false the camera only recorded
+	// its local wall clock, which is returned as if it were UTC.
+	Captured  time.Time
+	HasOffset bool
+	// Source names where Captured came from, e.g. "exif" or "mvhd"
+	Source      string
+	CameraMake  string
+	CameraModel string
+	Description string
+	// Location is where the media was captured, nil when it was not recorded
+	Location *Location
+}
+
+// Location is a GPS position, in degrees north and east, and meters above sea level
+type Location struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
+// In returns Captured, placing a wall clock time without an offset in loc
+func (i Info) In(loc *time.Location) time.Time {
+	if i.HasOffset {
+		return i.Captured
+	}
+	c := i.Captured
+	return time.Date(c.Year(), c.Month(), c.Day(), c.Hour(), c.Minute(), c.Second(), c.Nanosecond(), loc)
+}
+
+// Read returns the metadata of a JPEG, or of an ISO base media file such as HEIC, MP4 or MOV.
+// Readers that can Seek skip over media data instead of reading through it.
+func Read(r io.Reader) (Info, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(12)
+	if err != nil && len(head) < 2 {
+		return Info{}, ErrUnsupported
+	}
+	skipper := &skipReader{r: br, seeker: r}
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		return readJPEG(skipper)
+	case len(head) >= 8 && (string(head[4:8]) == "ftyp" || string(head[4:8]) == "moov" || string(head[4:8]) == "wide" || string(head[4:8]) == "mdat"):
+		return readISOBMFF(skipper)
+	}
+	return Info{}, ErrUnsupported
+}
+
+// skipReader reads through a buffered reader and can skip ahead, seeking when the
+// underlying reader allows it. It keeps count of the position from the start of the media.
+type skipReader struct {
+	r      *bufio.Reader
+	seeker io.Reader
+	pos    int64
+}
+
+func (s *skipReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *skipReader) skip(n int64) error {
+	if n <= int64(s.r.Buffered()) {
+		discarded, err := s.r.Discard(int(n))
+		s.pos += int64(discarded)
+		return err
+	}
+	if seeker, ok := s.seeker.(io.Seeker); ok {
+		if _, err := seeker.Seek(n-int64(s.r.Buffered()), io.SeekCurrent); err != nil {
+			return err
+		}
+		s.r.Reset(s.seeker)
+		s.pos += n
+		return nil
+	}
+	copied, err := io.CopyN(io.Discard, s.r, n)
+	s.pos += copied
+	if err == io.EOF && copied < n {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// skipTo moves ahead to offset from the start of the media
+func (s *skipReader) skipTo(offset int64) error {
+	if offset < s.pos {
+		return fmt.Errorf("can not go back to offset %d", offset)
+	}
+	return s.skip(offset - s.pos)
+}
+
+func readFull(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("truncated media: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,378 @@
+package metadata_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/metadata"
+)
+
+type tag struct {
+	id    uint16
+	value string
+}
+
+// ifd encodes ASCII tags as a TIFF IFD at offset, followed by the values that do not fit inline
+func ifd(order binary.ByteOrder, offset int, tags []tag, exifIFD int) []byte {
+	count := len(tags)
+	if exifIFD > 0 {
+		count++
+	}
+	entries := &bytes.Buffer{}
+	values := &bytes.Buffer{}
+	valuesAt := offset + 2 + count*12 + 4
+	binary.Write(entries, order, uint16(count))
+	for _, t := range tags {
+		value := append([]byte(t.value), 0)
+		binary.Write(entries, order, t.id)
+		binary.Write(entries, order, uint16(2))
+		binary.Write(entries, order, uint32(len(value)))
+		if len(value) <= 4 {
+			entries.Write(append(value, make([]byte, 4-len(value))...))
+			continue
+		}
+		binary.Write(entries, order, uint32(valuesAt+values.Len()))
+		values.Write(value)
+	}
+	if exifIFD > 0 {
+		binary.Write(entries, order, uint16(0x8769))
+		binary.Write(entries, order, uint16(4))
+		binary.Write(entries, order, uint32(1))
+		binary.Write(entries, order, uint32(exifIFD))
+	}
+	binary.Write(entries, order, uint32(0))
+	return append(entries.Bytes(), values.Bytes()...)
+}
+
+// tiff builds an EXIF block holding ifd0 tags, and exif tags in the EXIF sub-IFD
+func tiff(order binary.ByteOrder, ifd0, exif []tag) []byte {
+	tiff := &bytes.Buffer{}
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(tiff, order, uint16(42))
+	binary.Write(tiff, order, uint32(8))
+	first := ifd(order, 8, ifd0, 1)
+	exifAt := 8 + len(first)
+	tiff.Write(ifd(order, 8, ifd0, exifAt))
+	tiff.Write(ifd(order, exifAt, exif, 0))
+	return tiff.Bytes()
+}
+
+// jpeg builds a JPEG with a tiff EXIF block
+func jpeg(order binary.ByteOrder, ifd0, exif []tag) []byte {
+	app1 := append([]byte("Exif\x00\x00"), tiff(order, ifd0, exif)...)
+	out := &bytes.Buffer{}
+	out.Write([]byte{0xFF, 0xD8})
+	// a JFIF segment before the EXIF is skipped
+	out.Write([]byte{0xFF, 0xE0, 0x00, 0x04, 0x00, 0x00})
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(out, binary.BigEndian, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write([]byte{0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9})
+	return out.Bytes()
+}
+
+func box(kind string, body ...[]byte) []byte {
+	contents := bytes.Join(body, nil)
+	out := make([]byte, 8, 8+len(contents))
+	binary.BigEndian.PutUint32(out, uint32(8+len(contents)))
+	copy(out[4:], kind)
+	return append(out, contents...)
+}
+
+func u16(v int) []byte { return binary.BigEndian.AppendUint16(nil, uint16(v)) }
+func u32(v int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(v)) }
+
+// heic builds a HEIF image whose Exif item is in the media data, or in the meta box with inIdat
+func heic(exif []byte, inIdat bool) []byte {
+	item := append(u32(6), append([]byte("Exif\x00\x00"), exif...)...)
+	ftyp := box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	iinf := box("iinf", u32(0), u16(2),
+		box("infe", []byte{2, 0, 0, 0}, u16(1), u16(0), []byte("hvc1")),
+		box("infe", []byte{2, 0, 0, 0}, u16(2), u16(0), []byte("Exif"), []byte{0}))
+	iloc := func(method, offset int) []byte {
+		return box("iloc", []byte{1, 0, 0, 0, 0x44, 0x00}, u16(2),
+			u16(1), u16(0), u16(0), u16(1), u32(0), u32(0),
+			u16(2), u16(method), u16(0), u16(1), u32(offset), u32(len(item)))
+	}
+	hdlr := box("hdlr", make([]byte, 12))
+	if inIdat {
+		meta := box("meta", u32(0), hdlr, iinf, iloc(1, 0), box("idat", item))
+		return bytes.Join([][]byte{ftyp, meta, box("mdat", make([]byte, 1000))}, nil)
+	}
+	// the location depends on the size of the meta box, which does not depend on the location
+	meta := box("meta", u32(0), hdlr, iinf, iloc(0, 0))
+	offset := len(ftyp) + len(meta) + 8 + 1000
+	meta = box("meta", u32(0), hdlr, iinf, iloc(0, offset))
+	return bytes.Join([][]byte{ftyp, meta, box("mdat", make([]byte, 1000), item)}, nil)
+}
+
+// mp4 builds a movie created at created, with the movie header after the media data
+func mp4(created time.Time) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[4:], uint32(created.Unix()+2082844800))
+	return bytes.Join([][]byte{
+		box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41")),
+		box("mdat", bytes.Repeat([]byte{0}, 100_000)),
+		box("moov", box("mvhd", mvhd), box("trak")),
+	}, nil)
+}
+
+// stream hides Seek, like media read from WebDAV
+type stream struct {
+	io.Reader
+}
+
+func Test_Read(t *testing.T) {
+	t.Parallel()
+	t.Run("jpeg DateTimeOriginal with offset", func(t *testing.T) {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			img := jpeg(order,
+				[]tag{{0x010F, "Google"}, {0x0110, "Pixel 6"}, {0x0132, "2023:01:01 00:00:00"}},
+				[]tag{{0x9003, "2021:09:13 15:04:05"}, {0x9011, "+02:00"}})
+			info, err := metadata.Read(bytes.NewReader(img))
+			require.NoError(t, err)
+			assert.True(t, time.Date(2021, 9, 13, 13, 4, 5, 0, time.UTC).Equal(info.Captured), info.Captured)
+			assert.True(t, info.HasOffset)
+			assert.Equal(t, "exif", info.Source)
+			assert.Equal(t, "Google", info.CameraMake)
+			assert.Equal(t, "Pixel 6", info.CameraModel)
+		}
+	})
+	t.Run("jpeg without offset is a wall clock", func(t *testing.T) {
+		img := jpeg(binary.LittleEndian, nil, []tag{{0x9003, "2021:09:13 15:04:05"}})
+		info, err := metadata.Read(bytes.NewReader(img))
+		require.NoError(t, err)
+		assert.False(t, info.HasOffset)
+		loc := time.FixedZone("test", -5*3600)
+		assert.True(t, time.Date(2021, 9, 13, 20, 4, 5, 0, time.UTC).Equal(info.In(loc)))
+	})
+	t.Run("jpeg falls back to DateTime", func(t *testing.T) {
+		img := jpeg(binary.BigEndian, []tag{{0x0132, "2020:02:03 04:05:06"}}, nil)
+		info, err := metadata.Read(bytes.NewReader(img))
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC), info.Captured)
+	})
+	t.Run("jpeg without a date", func(t *testing.T) {
+		img := jpeg(binary.BigEndian, nil, []tag{{0x9003, "0000:00:00 00:00:00"}})
+		_, err := metadata.Read(bytes.NewReader(img))
+		assert.Equal(t, metadata.ErrNotFound, err)
+
+		_, err = metadata.Read(bytes.NewReader([]byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}))
+		assert.Equal(t, metadata.ErrNotFound, err, "no exif at all")
+	})
+	t.Run("mp4 movie header", func(t *testing.T) {
+		created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+		for name, r := range map[string]io.Reader{
+			"seeker": bytes.NewReader(mp4(created)),
+			"stream": stream{bytes.NewReader(mp4(created))},
+		} {
+			info, err := metadata.Read(r)
+			require.NoError(t, err, name)
+			assert.True(t, created.Equal(info.Captured), name)
+			assert.Equal(t, "mvhd", info.Source, name)
+		}
+	})
+	t.Run("heic exif item", func(t *testing.T) {
+		exif := tiff(binary.BigEndian, []tag{{0x010F, "Apple"}}, []tag{{0x9003, "2021:09:13 15:04:05"}, {0x9011, "-04:00"}})
+		for _, inIdat := range []bool{false, true} {
+			for name, r := range map[string]io.Reader{
+				"seeker": bytes.NewReader(heic(exif, inIdat)),
+				"stream": stream{bytes.NewReader(heic(exif, inIdat))},
+			} {
+				info, err := metadata.Read(r)
+				require.NoError(t, err, name)
+				assert.True(t, time.Date(2021, 9, 13, 19, 4, 5, 0, time.UTC).Equal(info.Captured), name)
+				assert.Equal(t, "Apple", info.CameraMake, name)
+			}
+		}
+	})
+	t.Run("truncated and unknown media", func(t *testing.T) {
+		movie := mp4(time.Now())
+		_, err := metadata.Read(bytes.NewReader(movie[:1000]))
+		assert.Error(t, err)
+
+		_, err = metadata.Read(bytes.NewReader([]byte("GIF89a......")))
+		assert.Equal(t, metadata.ErrUnsupported, err)
+		_, err = metadata.Read(bytes.NewReader(nil))
+		assert.Equal(t, metadata.ErrUnsupported, err)
+	})
+}
+
+// movie builds an MP4 with its movie header before the media data, which a track points into
+func movie(created time.Time, udta ...[]byte) ([]byte, []byte) {
+	mvhd := make([]byte, 100)
+	if !created.IsZero() {
+		binary.BigEndian.PutUint32(mvhd[4:], uint32(created.Unix()+2082844800))
+	}
+	media := bytes.Repeat([]byte("frame"), 20)
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	moov := func(offset int) []byte {
+		stco := box("stco", u32(0), u32(1), u32(offset))
+		trak := box("trak", box("tkhd", make([]byte, 84)), box("mdia", box("minf", box("stbl", box("stsd", u32(0), u32(0)), stco))))
+		return box("moov", append([][]byte{box("mvhd", mvhd), trak}, udta...)...)
+	}
+	offset := len(ftyp) + len(moov(0)) + 8
+	return bytes.Join([][]byte{ftyp, moov(offset), box("mdat", media)}, nil), media
+}
+
+// chunkOffset is the first stco entry of a movie
+func chunkOffset(t *testing.T, movie []byte) int {
+	i := bytes.Index(movie, []byte("stco"))
+	require.True(t, i > 0)
+	return int(binary.BigEndian.Uint32(movie[i+12:]))
+}
+
+func Test_Inject(t *testing.T) {
+	t.Parallel()
+	captured := time.Date(2021, 9, 13, 15, 4, 5, 0, time.FixedZone("", -4*3600))
+	tags := metadata.Tags{Captured: captured, Description: "birthday cake"}
+
+	t.Run("jpeg without exif", func(t *testing.T) {
+		img := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x04, 0x4A, 0x46, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9}
+		out, changed, err := metadata.Inject(img, tags)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, img[:8], out[:8], "JFIF stays first")
+		assert.Equal(t, img[8:], out[len(out)-len(img)+8:], "image data is untouched")
+		info, err := metadata.Read(bytes.NewReader(out))
+		require.NoError(t, err)
+		assert.True(t, captured.Equal(info.Captured))
+		assert.True(t, info.HasOffset)
+		assert.Equal(t, "birthday cake", info.Description)
+
+		again, changed, err := metadata.Inject(out, tags)
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, out, again)
+	})
+	t.Run("jpeg exif without a capture time", func(t *testing.T) {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			img := jpeg(order, []tag{{0x010F, "Google"}, {0x0110, "Pixel 6"}}, []tag{{0xA420, "0123456789abcdef"}})
+			out, changed, err := metadata.Inject(img, tags)
+			require.NoError(t, err)
+			assert.True(t, changed)
+			info, err := metadata.Read(bytes.NewReader(out))
+			require.NoError(t, err)
+			assert.True(t, captured.Equal(info.Captured))
+			assert.Equal(t, "Google", info.CameraMake)
+			assert.Equal(t, "Pixel 6", info.CameraModel)
+			assert.Equal(t, "birthday cake", info.Description)
+			// the original TIFF block follows its header unchanged
+			tiffAt := bytes.Index(img, []byte("Exif\x00\x00")) + 6
+			assert.Equal(t, img[tiffAt+8:len(img)-8], out[tiffAt+8:len(img)-8])
+			assert.Equal(t, img[len(img)-8:], out[len(out)-8:])
+		}
+	})
+	t.Run("jpeg with a capture time is left alone", func(t *testing.T) {
+		img := jpeg(binary.BigEndian, []tag{{0x010E, "original caption"}}, []tag{{0x9003, "2020:01:01 00:00:00"}})
+		out, changed, err := metadata.Inject(img, tags)
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, img, out)
+	})
+	t.Run("mp4 without a creation time", func(t *testing.T) {
+		mov, media := movie(time.Time{})
+		out, changed, err := metadata.Inject(mov, tags)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		info, err := metadata.Read(bytes.NewReader(out))
+		require.NoError(t, err)
+		assert.True(t, captured.Equal(info.Captured))
+		assert.Contains(t, string(out), "2021-09-13T15:04:05-0400")
+		offset := chunkOffset(t, out)
+		assert.Equal(t, media, out[offset:offset+len(media)], "chunk offsets follow the media data")
+		assert.Equal(t, len(mov)+36+8, len(out))
+
+		again, changed, err := metadata.Inject(out, tags)
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, out, again)
+	})
+	t.Run("mp4 with user data", func(t *testing.T) {
+		mov, media := movie(captured, box("udta", box("\xa9xyz", []byte("abc"))))
+		out, changed, err := metadata.Inject(mov, tags)
+		require.NoError(t, err)
+		assert.True(t, changed, "the recording date is added")
+		offset := chunkOffset(t, out)
+		assert.Equal(t, media, out[offset:offset+len(media)])
+		assert.Contains(t, string(out), "\xa9xyz")
+	})
+	t.Run("mp4 with a 64-bit movie header size", func(t *testing.T) {
+		udta := box("udta", box("\xa9xyz", []byte("abc")))
+		mov, media := movie(time.Time{}, udta)
+		at := bytes.Index(mov, []byte("moov")) - 4
+		size := int(binary.BigEndian.Uint32(mov[at:]))
+		large := bytes.Join([][]byte{mov[:at], u32(1), []byte("moov"), binary.BigEndian.AppendUint64(nil, uint64(size+8)), mov[at+8:]}, nil)
+		stco := bytes.Index(large, []byte("stco")) + 12
+		binary.BigEndian.PutUint32(large[stco:], uint32(chunkOffset(t, large)+8))
+
+		out, changed, err := metadata.Inject(large, tags)
+		require.NoError(t, err)
+		assert.True(t, changed, "the movie header gets the creation time")
+		info, err := metadata.Read(bytes.NewReader(out))
+		require.NoError(t, err)
+		assert.True(t, captured.Equal(info.Captured))
+		assert.Equal(t, len(large), len(out), "no user data is added")
+		assert.Contains(t, string(out), string(udta), "user data is unchanged")
+		offset := chunkOffset(t, out)
+		assert.Equal(t, media, out[offset:offset+len(media)])
+	})
+	t.Run("location", func(t *testing.T) {
+		where := metadata.Tags{Location: &metadata.Location{Latitude: -33.856784, Longitude: 151.215297, Altitude: -4.5}}
+		mov, _ := movie(captured)
+		for name, media := range map[string][]byte{
+			"jpeg":      jpeg(binary.LittleEndian, []tag{{0x010F, "Google"}}, nil),
+			"bare jpeg": {0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9},
+			"mp4":       mov,
+		} {
+			out, changed, err := metadata.Inject(media, where)
+			require.NoError(t, err, name)
+			assert.True(t, changed, name)
+			info, _ := metadata.Read(bytes.NewReader(out))
+			require.NotNil(t, info.Location, name)
+			assert.InDelta(t, -33.856784, info.Location.Latitude, 0.00001, name)
+			assert.InDelta(t, 151.215297, info.Location.Longitude, 0.00001, name)
+			assert.InDelta(t, -4.5, info.Location.Altitude, 0.01, name)
+
+			_, changed, err = metadata.Inject(out, metadata.Tags{Location: &metadata.Location{Latitude: 1, Longitude: 2}})
+			require.NoError(t, err, name)
+			assert.False(t, changed, "%s: a recorded location is kept", name)
+		}
+	})
+	t.Run("xmp sidecar", func(t *testing.T) {
+		xmp := string(metadata.XMP(metadata.Location{Latitude: 37.3349, Longitude: -122.009, Altitude: 10}))
+		assert.Contains(t, xmp, "<exif:GPSLatitude>37,20.094000N</exif:GPSLatitude>")
+		assert.Contains(t, xmp, "<exif:GPSLongitude>122,0.540000W</exif:GPSLongitude>")
+		assert.Contains(t, xmp, "<exif:GPSAltitude>1000/100</exif:GPSAltitude>")
+		assert.True(t, strings.HasPrefix(xmp, "<?xpacket begin=\"\xef\xbb\xbf\" "), "begins with a byte order mark")
+	})
+	t.Run("streams the same bytes Inject returns", func(t *testing.T) {
+		mov, _ := movie(time.Time{})
+		img := jpeg(binary.LittleEndian, []tag{{0x010F, "Google"}}, nil)
+		for name, media := range map[string][]byte{"mp4": mov, "jpeg": img, "gif": []byte("GIF89a")} {
+			want, wantChanged, err := metadata.Inject(media, tags)
+			require.NoError(t, err, name)
+			var out bytes.Buffer
+			changed, err := metadata.InjectTo(&out, bytes.NewReader(media), tags)
+			require.NoError(t, err, name)
+			assert.Equal(t, wantChanged, changed, name)
+			assert.Equal(t, want, out.Bytes(), name)
+		}
+	})
+	t.Run("unsupported media is unchanged", func(t *testing.T) {
+		out, changed, err := metadata.Inject([]byte("GIF89a"), tags)
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, []byte("GIF89a"), out)
+	})
+}
@@ -0,0 +1,624 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const tagImageDescription = 0x010E
+
+// tags of the GPS IFD
+const (
+	gpsVersionID    = 0x0000
+	gpsLatitudeRef  = 0x0001
+	gpsLatitude     = 0x0002
+	gpsLongitudeRef = 0x0003
+	gpsLongitude    = 0x0004
+	gpsAltitudeRef  = 0x0005
+	gpsAltitude     = 0x0006
+)
+
+// Tags are the values Inject adds to media that does not have them
+type Tags struct {
+	// Captured is written in its own location, with its offset
+	Captured    time.Time
+	Description string
+	Location    *Location
+}
+
+// Inject returns content with the Tags it is missing, copying the image and video data and all
+// other metadata byte for byte. JPEG gets EXIF DateTimeOriginal, OffsetTimeOriginal and
+// ImageDescription and GPS. MP4 and MOV get the mvhd creation time, and a udta ©day and ©xyz.
+// It returns false when
+// nothing was missing or the format can not be written.
+func Inject(content []byte, tags Tags) ([]byte, bool, error) {
+	switch {
+	case bytes.HasPrefix(content, []byte{0xFF, 0xD8}):
+		return injectJPEG(content, tags)
+	case isISOBMFF(content):
+		return injectISOBMFF(content, tags)
+	}
+	return content, false, nil
+}
+
+// ErrTags is returned by InjectTo when the media could not take the tags, after it was copied unchanged
+var ErrTags = errors.New("failed to add tags")
+
+// InjectTo copies the media read from r to w with the Tags it is missing, like Inject. MP4 and
+// MOV are copied box by box, holding only their moov box in memory, other media is read whole.
+// When it returns false what was written is a copy of the media, complete unless reading or
+// writing failed.
+func InjectTo(w io.Writer, r io.Reader, tags Tags) (bool, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(8)
+	if isISOBMFF(head) {
+		return injectISOBMFFTo(w, br, tags)
+	}
+	content, err := io.ReadAll(br)
+	if err != nil {
+		return false, err
+	}
+	out, changed, tagErr := Inject(content, tags)
+	if tagErr != nil {
+		out, changed = content, false
+	}
+	if _, err := w.Write(out); err != nil {
+		return false, err
+	}
+	if tagErr != nil {
+		return false, fmt.Errorf("%w: %v", ErrTags, tagErr)
+	}
+	return changed, nil
+}
+
+// isISOBMFF is true when content starts with a top level box of an MP4 or MOV
+func isISOBMFF(content []byte) bool {
+	if len(content) < 8 {
+		return false
+	}
+	switch string(content[4:8]) {
+	case "ftyp", "moov", "wide", "mdat":
+		return true
+	}
+	return false
+}
+
+// maxSegment is the most a JPEG segment can hold after its length
+const maxSegment = 0xFFFF - 2
+
+func injectJPEG(content []byte, tags Tags) ([]byte, bool, error) {
+	pos, insertAt := 2, 2
+	for pos+4 <= len(content) {
+		if content[pos] != 0xFF {
+			return nil, false, fmt.Errorf("invalid jpeg marker at %d", pos)
+		}
+		marker := content[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(content[pos+2:]))
+		if end > len(content) {
+			return nil, false, fmt.Errorf("truncated jpeg segment")
+		}
+		if marker == 0xE0 && pos == 2 {
+			// JFIF must stay the first segment
+			insertAt = end
+		}
+		if marker == 0xE1 && bytes.HasPrefix(content[pos+4:end], exifHeader) {
+			tiff, changed, err := addTags(content[pos+4+len(exifHeader):end], tags)
+			if err != nil || !changed {
+				return content, false, err
+			}
+			segment, err := app1(tiff)
+			if err != nil {
+				return content, false, err
+			}
+			return join(content[:pos], segment, content[end:]), true, nil
+		}
+		pos = end
+	}
+	if tags.Captured.IsZero() && tags.Description == "" && tags.Location == nil {
+		return content, false, nil
+	}
+	// an empty big endian TIFF to add the tags to
+	empty := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0}
+	tiff, _, err := addTags(empty, tags)
+	if err != nil {
+		return content, false, err
+	}
+	segment, err := app1(tiff)
+	if err != nil {
+		return content, false, err
+	}
+	return join(content[:insertAt], segment, content[insertAt:]), true, nil
+}
+
+func app1(tiff []byte) ([]byte, error) {
+	length := 2 + len(exifHeader) + len(tiff)
+	if length > maxSegment+2 {
+		return nil, fmt.Errorf("exif too large for a jpeg segment")
+	}
+	segment := []byte{0xFF, 0xE1, byte(length >> 8), byte(length)}
+	return join(segment, exifHeader, tiff), nil
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// ifdEntry is a TIFF tag. Entries read from the file keep their value, or value offset, as is.
+// New entries have data, stored after the IFD when it does not fit in the value.
+type ifdEntry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value [4]byte
+	data  []byte
+}
+
+func ascii(tag uint16, value string) ifdEntry {
+	data := append([]byte(value), 0)
+	return ifdEntry{tag: tag, kind: 2, count: uint32(len(data)), data: data}
+}
+
+// addTags adds the missing tags to an EXIF TIFF block. The old IFDs are left in place and new
+// ones appended, so every offset in the block, including those in maker notes, stays valid.
+func addTags(tiff []byte, tags Tags) ([]byte, bool, error) {
+	if len(tiff) < 8 {
+		return nil, false, fmt.Errorf("truncated exif")
+	}
+	var order byteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, false, fmt.Errorf("invalid exif byte order")
+	}
+	ifd0, next, err := readEntries(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, false, err
+	}
+	var exif []ifdEntry
+	exifAt := -1
+	for i, entry := range ifd0 {
+		if entry.tag == tagExifIFD {
+			exifAt = i
+			if exif, _, err = readEntries(tiff, order, order.Uint32(entry.value[:])); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	var addIFD0, addExif []ifdEntry
+	if tags.Description != "" && !hasTag(ifd0, tagImageDescription) {
+		addIFD0 = append(addIFD0, ascii(tagImageDescription, tags.Description))
+	}
+	if !tags.Captured.IsZero() && !hasTag(exif, tagDateTimeOriginal) {
+		addExif = append(addExif, ascii(tagDateTimeOriginal, tags.Captured.Format("2006:01:02 15:04:05")))
+		if !hasTag(exif, tagOffsetTimeOriginal) {
+			addExif = append(addExif, ascii(tagOffsetTimeOriginal, tags.Captured.Format("-07:00")))
+		}
+	}
+	addGPS := tags.Location != nil && !hasTag(ifd0, tagGPSIFD)
+	if len(addIFD0) == 0 && len(addExif) == 0 && !addGPS {
+		return tiff, false, nil
+	}
+
+	out := append([]byte{}, tiff...)
+	if addGPS {
+		var offset uint32
+		out, offset = appendIFD(out, order, gpsEntries(order, *tags.Location), 0)
+		pointer := ifdEntry{tag: tagGPSIFD, kind: 4, count: 1}
+		order.PutUint32(pointer.value[:], offset)
+		ifd0 = append(ifd0, pointer)
+	}
+	if len(addExif) > 0 {
+		var offset uint32
+		out, offset = appendIFD(out, order, append(exif, addExif...), 0)
+		pointer := ifdEntry{tag: tagExifIFD, kind: 4, count: 1}
+		order.PutUint32(pointer.value[:], offset)
+		if exifAt >= 0 {
+			ifd0[exifAt] = pointer
+		} else {
+			ifd0 = append(ifd0, pointer)
+		}
+	}
+	out, offset := appendIFD(out, order, append(ifd0, addIFD0...), next)
+	order.PutUint32(out[4:], offset)
+	return out, true, nil
+}
+
+// gpsEntries are the tags of a GPS IFD for location
+func gpsEntries(order byteOrder, location Location) []ifdEntry {
+	latitudeRef, longitudeRef, altitudeRef := "N", "E", byte(0)
+	if location.Latitude < 0 {
+		latitudeRef = "S"
+	}
+	if location.Longitude < 0 {
+		longitudeRef = "W"
+	}
+	if location.Altitude < 0 {
+		altitudeRef = 1
+	}
+	rationals := func(denominator uint32, values ...float64) ifdEntry {
+		entry := ifdEntry{kind: 5, count: uint32(len(values))}
+		for _, v := range values {
+			entry.data = order.AppendUint32(entry.data, uint32(math.Round(math.Abs(v)*float64(denominator))))
+			entry.data = order.AppendUint32(entry.data, denominator)
+		}
+		return entry
+	}
+	degrees := func(tag uint16, v float64) ifdEntry {
+		v = math.Abs(v)
+		d, m := math.Floor(v), math.Floor(math.Mod(v*60, 60))
+		entry := rationals(1, d, m)
+		seconds := rationals(10000, (v-d)*3600-m*60)
+		entry.tag, entry.count, entry.data = tag, 3, append(entry.data, seconds.data...)
+		return entry
+	}
+	altitude := rationals(100, location.Altitude)
+	altitude.tag = gpsAltitude
+	return []ifdEntry{
+		{tag: gpsVersionID, kind: 1, count: 4, value: [4]byte{2, 3, 0, 0}},
+		ascii(gpsLatitudeRef, latitudeRef),
+		degrees(gpsLatitude, location.Latitude),
+		ascii(gpsLongitudeRef, longitudeRef),
+		degrees(gpsLongitude, location.Longitude),
+		{tag: gpsAltitudeRef, kind: 1, count: 1, value: [4]byte{altitudeRef}},
+		altitude,
+	}
+}
+
+func hasTag(entries []ifdEntry, tag uint16) bool {
+	for _, entry := range entries {
+		if entry.tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// readEntries returns the entries of the IFD at offset, and the offset of the next IFD
+func readEntries(tiff []byte, order byteOrder, offset uint32) ([]ifdEntry, uint32, error) {
+	if int(offset)+2 > len(tiff) {
+		return nil, 0, fmt.Errorf("invalid exif ifd offset")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	end := int(offset) + 2 + count*12
+	if end+4 > len(tiff) {
+		return nil, 0, fmt.Errorf("truncated exif ifd")
+	}
+	entries := make([]ifdEntry, count)
+	for i := range entries {
+		raw := tiff[int(offset)+2+i*12:]
+		entries[i] = ifdEntry{tag: order.Uint16(raw), kind: order.Uint16(raw[2:]), count: order.Uint32(raw[4:])}
+		copy(entries[i].value[:], raw[8:12])
+	}
+	return entries, order.Uint32(tiff[end:]), nil
+}
+
+// appendIFD writes entries, sorted by tag as TIFF requires, at the end of tiff
+func appendIFD(tiff []byte, order byteOrder, entries []ifdEntry, next uint32) ([]byte, uint32) {
+	if len(tiff)%2 == 1 {
+		tiff = append(tiff, 0)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	offset := uint32(len(tiff))
+	dataAt := len(tiff) + 2 + len(entries)*12 + 4
+	var data []byte
+	tiff = order.AppendUint16(tiff, uint16(len(entries)))
+	for _, entry := range entries {
+		tiff = order.AppendUint16(tiff, entry.tag)
+		tiff = order.AppendUint16(tiff, entry.kind)
+		tiff = order.AppendUint32(tiff, entry.count)
+		switch {
+		case entry.data == nil:
+			tiff = append(tiff, entry.value[:]...)
+		case len(entry.data) <= 4:
+			var value [4]byte
+			copy(value[:], entry.data)
+			tiff = append(tiff, value[:]...)
+		default:
+			tiff = order.AppendUint32(tiff, uint32(dataAt+len(data)))
+			data = append(data, entry.data...)
+			if len(data)%2 == 1 {
+				data = append(data, 0)
+			}
+		}
+	}
+	tiff = order.AppendUint32(tiff, next)
+	return append(tiff, data...), offset
+}
+
+// box is the position of an ISO base media box within its parent
+type box struct {
+	kind             string
+	start, body, end int
+}
+
+// boxes lists the boxes in b, stopping at anything malformed
+func boxes(b []byte) []box {
+	var found []box
+	for pos := 0; pos+8 <= len(b); {
+		size := uint64(binary.BigEndian.Uint32(b[pos:]))
+		header := 8
+		switch size {
+		case 0:
+			size = uint64(len(b) - pos)
+		case 1:
+			if pos+16 > len(b) {
+				return found
+			}
+			size, header = binary.BigEndian.Uint64(b[pos+8:]), 16
+		}
+		if size < uint64(header) || size > uint64(len(b)-pos) {
+			return found
+		}
+		found = append(found, box{kind: string(b[pos+4 : pos+8]), start: pos, body: pos + header, end: pos + int(size)})
+		pos += int(size)
+	}
+	return found
+}
+
+func child(b []byte, kind string) (box, bool) {
+	for _, c := range boxes(b) {
+		if c.kind == kind {
+			return c, true
+		}
+	}
+	return box{}, false
+}
+
+// QuickTime user data atoms holding when and where the movie was recorded
+const (
+	dayAtom = "\xa9day"
+	xyzAtom = "\xa9xyz"
+)
+
+func injectISOBMFF(content []byte, tags Tags) ([]byte, bool, error) {
+	moov, ok := child(content, "moov")
+	if !ok {
+		return content, false, nil
+	}
+	out, changed, err := injectMoov(content[moov.start:moov.end], uint64(moov.start), tags)
+	if err != nil || !changed {
+		return content, false, err
+	}
+	return join(content[:moov.start], out, content[moov.end:]), true, nil
+}
+
+// maxMoov is the largest moov box injectISOBMFFTo reads into memory, a movie header of hours of video
+const maxMoov = 256 << 20
+
+// injectISOBMFFTo is injectISOBMFF on a stream, copying every box but the first moov as it is read
+func injectISOBMFFTo(w io.Writer, r io.Reader, tags Tags) (bool, error) {
+	var offset uint64
+	var tagErr error
+	changed, injected := false, false
+	finish := func() (bool, error) {
+		if tagErr != nil {
+			return false, fmt.Errorf("%w: %v", ErrTags, tagErr)
+		}
+		return changed, nil
+	}
+	for {
+		header := make([]byte, 8, 16)
+		n, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return finish()
+		}
+		if err != nil {
+			// trailing bytes too short to be a box are copied as they are
+			if _, err := w.Write(header[:n]); err != nil {
+				return false, err
+			}
+			return finish()
+		}
+		size := uint64(binary.BigEndian.Uint32(header))
+		if size == 1 {
+			header = header[:16]
+			if _, err := io.ReadFull(r, header[8:]); err != nil {
+				return false, fmt.Errorf("truncated box header: %v", err)
+			}
+			size = binary.BigEndian.Uint64(header[8:])
+		}
+		if string(header[4:8]) == "moov" && !injected && size >= uint64(len(header)) && size <= maxMoov {
+			box := make([]byte, size)
+			copy(box, header)
+			if _, err := io.ReadFull(r, box[len(header):]); err != nil {
+				return false, fmt.Errorf("truncated moov: %v", err)
+			}
+			out, ok, err := injectMoov(box, offset, tags)
+			if err != nil {
+				// copied as it is, the error is returned once the rest is copied
+				out, tagErr = box, err
+			}
+			if _, err := w.Write(out); err != nil {
+				return false, err
+			}
+			changed, injected = ok && err == nil, true
+			offset += size
+			continue
+		}
+		if _, err := w.Write(header); err != nil {
+			return false, err
+		}
+		if size == 0 || size < uint64(len(header)) {
+			// the last box, or something malformed: the rest is copied as it is
+			if _, err := io.Copy(w, r); err != nil {
+				return false, err
+			}
+			return finish()
+		}
+		if _, err := io.CopyN(w, r, int64(size)-int64(len(header))); err != nil {
+			return false, err
+		}
+		offset += size
+	}
+}
+
+// injectMoov adds the tags to a moov box found at offset in its file
+func injectMoov(content []byte, offset uint64, tags Tags) ([]byte, bool, error) {
+	moov, ok := child(content, "moov")
+	if !ok {
+		return content, false, nil
+	}
+	out := append([]byte{}, content...)
+	body := out[moov.body:moov.end]
+	changed := false
+	if mvhd, ok := child(body, "mvhd"); ok && mvhd.end-mvhd.body >= 12 && !tags.Captured.IsZero() {
+		header := body[mvhd.body:]
+		seconds := uint64(tags.Captured.Sub(epoch1904) / time.Second)
+		if header[0] == 1 && binary.BigEndian.Uint64(header[4:]) == 0 {
+			binary.BigEndian.PutUint64(header[4:], seconds)
+			changed = true
+		} else if header[0] == 0 && binary.BigEndian.Uint32(header[4:]) == 0 {
+			binary.BigEndian.PutUint32(header[4:], uint32(seconds))
+			changed = true
+		}
+	}
+
+	udta, hasUdta := child(body, "udta")
+	var existing []byte
+	if hasUdta {
+		existing = body[udta.body:udta.end]
+	}
+	var atoms []byte
+	if _, ok := child(existing, dayAtom); !ok && !tags.Captured.IsZero() {
+		atoms = append(atoms, textAtom(dayAtom, tags.Captured.Format("2006-01-02T15:04:05-0700"))...)
+	}
+	if _, ok := child(existing, xyzAtom); !ok && tags.Location != nil {
+		l := tags.Location
+		atoms = append(atoms, textAtom(xyzAtom, fmt.Sprintf("%+010.6f%+011.6f%+.3f/", l.Latitude, l.Longitude, l.Altitude))...)
+	}
+	if len(atoms) == 0 {
+		return out, changed, nil
+	}
+	insert, at := atoms, len(body)
+	if hasUdta {
+		at = udta.end
+	} else {
+		insert = join(binary.BigEndian.AppendUint32(nil, uint32(8+len(atoms))), []byte("udta"), atoms)
+	}
+	// 64-bit sizes are left alone, like sizes that would need them, before anything is changed
+	if hasUdta && (udta.body-udta.start != 8 || udta.end-udta.start+len(atoms) > 0xFFFFFFFF) {
+		return out, changed, nil
+	}
+	if moov.body-moov.start != 8 || moov.end-moov.start+len(insert) > 0xFFFFFFFF {
+		return out, changed, nil
+	}
+	// media data after the movie header moves along with everything after it
+	if err := shiftChunkOffsets(body, offset+uint64(moov.end), uint64(len(insert))); err != nil {
+		return content, false, err
+	}
+	if hasUdta {
+		binary.BigEndian.PutUint32(body[udta.start:], uint32(udta.end-udta.start+len(atoms)))
+	}
+	binary.BigEndian.PutUint32(out[moov.start:], uint32(moov.end-moov.start+len(insert)))
+	return join(out[:moov.body+at], insert, out[moov.body+at:]), true, nil
+}
+
+// textAtom is a QuickTime user data text atom
+func textAtom(kind, text string) []byte {
+	atom := make([]byte, 12, 12+len(text))
+	binary.BigEndian.PutUint32(atom, uint32(len(atom)+len(text)))
+	copy(atom[4:], kind)
+	binary.BigEndian.PutUint16(atom[8:], uint16(len(text)))
+	binary.BigEndian.PutUint16(atom[10:], 0x55C4) // undetermined language
+	return append(atom, text...)
+}
+
+// shiftChunkOffsets adds delta to the sample chunk offsets at or past from, in the tracks of a moov body
+func shiftChunkOffsets(moov []byte, from, delta uint64) error {
+	for _, trak := range boxes(moov) {
+		if trak.kind != "trak" {
+			continue
+		}
+		stbl := moov[trak.body:trak.end]
+		for _, kind := range []string{"mdia", "minf", "stbl"} {
+			b, ok := child(stbl, kind)
+			if !ok {
+				stbl = nil
+				break
+			}
+			stbl = stbl[b.body:b.end]
+		}
+		for _, table := range boxes(stbl) {
+			b := stbl[table.body:table.end]
+			if (table.kind != "stco" && table.kind != "co64") || len(b) < 8 {
+				continue
+			}
+			size := 4
+			if table.kind == "co64" {
+				size = 8
+			}
+			count := int(binary.BigEndian.Uint32(b[4:]))
+			if 8+count*size > len(b) {
+				return fmt.Errorf("truncated %s", table.kind)
+			}
+			for i := 0; i < count; i++ {
+				entry := b[8+i*size:]
+				if size == 8 {
+					if offset := binary.BigEndian.Uint64(entry); offset >= from {
+						binary.BigEndian.PutUint64(entry, offset+delta)
+					}
+					continue
+				}
+				offset := uint64(binary.BigEndian.Uint32(entry))
+				if offset < from {
+					continue
+				}
+				if offset+delta > 0xFFFFFFFF {
+					return fmt.Errorf("chunk offset overflows stco")
+				}
+				binary.BigEndian.PutUint32(entry, uint32(offset+delta))
+			}
+		}
+	}
+	return nil
+}
+
+// XMP is a sidecar holding location, for media Inject can not write it into
+func XMP(location Location) []byte {
+	coordinate := func(v float64, positive, negative string) string {
+		direction := positive
+		if v < 0 {
+			direction = negative
+		}
+		v = math.Abs(v)
+		degrees := math.Floor(v)
+		return fmt.Sprintf("%d,%.6f%s", int(degrees), (v-degrees)*60, direction)
+	}
+	altitudeRef := 0
+	if location.Altitude < 0 {
+		altitudeRef = 1
+	}
+	// the packet begins with a byte order mark, in UTF-8
+	return []byte(fmt.Sprintf("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n"+`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:exif="http://ns.adobe.com/exif/1.0/">
+   <exif:GPSVersionID>2.3.0.0</exif:GPSVersionID>
+   <exif:GPSLatitude>%s</exif:GPSLatitude>
+   <exif:GPSLongitude>%s</exif:GPSLongitude>
+   <exif:GPSAltitudeRef>%d</exif:GPSAltitudeRef>
+   <exif:GPSAltitude>%d/100</exif:GPSAltitude>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`, coordinate(location.Latitude, "N", "S"), coordinate(location.Longitude, "E", "W"), altitudeRef, int(math.Round(math.Abs(location.Altitude)*100))))
+}
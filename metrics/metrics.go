@@ -0,0 +1,287 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the Prometheus text
+// format, either served at /metrics or to a file for the textfile collector of node_exporter.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics, each registered once by name. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]*metric{}}
+}
+
+type kind string
+
+const (
+	counter   kind = "counter"
+	gauge     kind = "gauge"
+	histogram kind = "histogram"
+)
+
+type metric struct {
+	name, help string
+	kind       kind
+	labels     []string
+	// buckets are the upper bounds of a histogram, ascending
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is the value of one combination of label values
+type series struct {
+	values []string
+	value  float64
+	// counts are per bucket of a histogram, not cumulative
+	counts []uint64
+	count  uint64
+}
+
+// register returns the metric of name, creating it the first time. Registering a name again
+// with another type or labels is a programming error and panics.
+func (r *Registry) register(name, help string, k kind, buckets []float64, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		if m.kind != k || !slices.Equal(m.labels, labels) {
+			panic(fmt.Sprintf("metrics: %s registered again as another %s", name, k))
+		}
+		return m
+	}
+	m := &metric{name: name, help: help, kind: k, labels: labels, buckets: buckets, series: map[string]*series{}}
+	r.metrics[name] = m
+	return m
+}
+
+// with returns the series of values, one per label
+func (m *metric) with(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got values %v", m.name, m.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if m.kind == histogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a total that only goes up
+type Counter struct {
+	m *metric
+}
+
+// Counter registers a counter, its name ending in _total by convention
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, counter, nil, labels)}
+}
+
+// Add adds delta to the series of the label values
+func (c *Counter) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: %s decreased by %v", c.m.name, delta))
+	}
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.with(values).value += delta
+}
+
+// Inc adds one to the series of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	m *metric
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, gauge, nil, labels)}
+}
+
+// Set sets the series of the label values
+func (g *Gauge) Set(value float64, values ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.with(values).value = value
+}
+
+// Histogram counts observations, such as durations, in buckets
+type Histogram struct {
+	m *metric
+}
+
+// Histogram registers a histogram with the upper bounds of its buckets, to which +Inf is added
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &Histogram{r.register(name, help, histogram, buckets, labels)}
+}
+
+// Observe counts value in the series of the label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.with(values)
+	if i, _ := slices.BinarySearch(h.m.buckets, value); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.count++
+	s.value += value
+}
+
+// WriteTo writes every metric in the Prometheus text format, sorted by name and label values
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	slices.Sort(names)
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, name := range names {
+		r.mu.Lock()
+		m := r.metrics[name]
+		r.mu.Unlock()
+		m.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.(*bufio.Writer).Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (m *metric) write(w *countingWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.series) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escape(m.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	all := make([]*series, 0, len(m.series))
+	for _, s := range m.series {
+		all = append(all, s)
+	}
+	slices.SortFunc(all, func(a, b *series) int {
+		return slices.Compare(a.values, b.values)
+	})
+	for _, s := range all {
+		if m.kind != histogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelSet(s.values, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, upper := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelSet(s.values, formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelSet(s.values, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelSet(s.values, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelSet(s.values, ""), s.count)
+	}
+}
+
+// labelSet formats the labels of values, with the le label of a histogram bucket unless empty
+func (m *metric) labelSet(values []string, le string) string {
+	var pairs []string
+	for i, label := range m.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escape(values[i], true)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escape escapes help text, or a label value when quoted
+func escape(s string, quoted bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quoted {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP writes the metrics, making the Registry the handler of a /metrics endpoint
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// WriteFile writes the metrics to name, replacing it at once so the textfile collector never
+// reads it half written. The name should end in .prom.
+func (r *Registry) WriteFile(name string) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := r.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// countingWriter keeps the first error, so the writes of a metric need no checks
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
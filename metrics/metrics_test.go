@@ -0,0 +1,91 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/metrics"
+)
+
+func text(t *testing.T, registry *metrics.Registry) string {
+	var b strings.Builder
+	_, err := registry.WriteTo(&b)
+	require.NoError(t, err)
+	return b.String()
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run("writes the text format", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		requests := registry.Counter("requests_total", "Requests by code.", "endpoint", "code")
+		requests.Inc("list", "200")
+		requests.Add(2, "get", "200")
+		requests.Inc("get", `4"0\4`)
+		registry.Gauge("last_seconds", "Last time.").Set(1.5)
+		registry.Counter("unused_total", "Never counted.")
+
+		assert.Equal(t, `# HELP last_seconds Last time.
+# TYPE last_seconds gauge
+last_seconds 1.5
+# HELP requests_total Requests by code.
+# TYPE requests_total counter
+requests_total{endpoint="get",code="200"} 2
+requests_total{endpoint="get",code="4\"0\\4"} 1
+requests_total{endpoint="list",code="200"} 1
+`, text(t, registry))
+	})
+	t.Run("histograms are cumulative", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		h := registry.Histogram("duration_seconds", "Durations.", []float64{1, 0.5})
+		for _, v := range []float64{0.1, 0.5, 0.7, 3} {
+			h.Observe(v)
+		}
+		assert.Equal(t, `# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.5"} 2
+duration_seconds_bucket{le="1"} 3
+duration_seconds_bucket{le="+Inf"} 4
+duration_seconds_sum 4.3
+duration_seconds_count 4
+`, text(t, registry))
+	})
+	t.Run("registering again returns the same metric", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		registry.Counter("items_total", "Items.", "outcome").Inc("saved")
+		registry.Counter("items_total", "Items.", "outcome").Inc("saved")
+		assert.Contains(t, text(t, registry), `items_total{outcome="saved"} 2`)
+		assert.Panics(t, func() { registry.Gauge("items_total", "Items.", "outcome") })
+		assert.Panics(t, func() { registry.Counter("items_total", "Items.").Inc() })
+	})
+	t.Run("serves /metrics", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		registry.Counter("items_total", "Items.").Inc()
+		recorder := httptest.NewRecorder()
+		registry.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+		assert.Contains(t, recorder.Body.String(), "items_total 1\n")
+	})
+	t.Run("writes a textfile", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		registry.Counter("items_total", "Items.").Inc()
+		dir := t.TempDir()
+		name := filepath.Join(dir, "photogo.prom")
+		require.NoError(t, registry.WriteFile(name))
+		registry.Counter("items_total", "Items.").Inc()
+		require.NoError(t, registry.WriteFile(name))
+
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.Contains(t, string(b), "items_total 2\n")
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1, "no temporary files are left")
+	})
+}
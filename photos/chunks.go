@@ -0,0 +1,170 @@
+package photos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/storage"
+)
+
+// WithChunks downloads media larger than threshold bytes as concurrent ranges of size bytes,
+// on servers that accept ranges and storage that can write out of order. Zero disables it, the default.
+// The ranges share the worker count of Extract with the other downloads.
+func WithChunks(threshold, size int64) Option {
+	return func(e *extraction) {
+		e.chunkThreshold, e.chunkSize = threshold, size
+	}
+}
+
+// chunk is a range of the media, from start to end inclusive
+type chunk struct {
+	start, end int64
+}
+
+// chunked is whether the rest of the first response is better fetched as concurrent chunks
+func (e *extraction) chunked(download *client.Download) bool {
+	_, ok := e.store.(storage.RandomWriter)
+	return ok && e.chunkThreshold > 0 && e.chunkSize > 0 && download.Offset == 0 && download.Ranges &&
+		download.Size > e.chunkThreshold && download.Size > e.chunkSize
+}
+
+// chunksSuffix marks the file chunks are written into, until every chunk arrived
+const chunksSuffix = ".chunks"
+
+// downloadChunks writes the media to name in chunks: the first read from the response that announced
+// the size, the others requested concurrently. The chunks are written into a preallocated file that
+// only becomes the partial file once every chunk arrived. Each chunk is recorded in the state of
+// the partial file as it completes, so a failure keeps what arrived for resumeChunks.
+func (e *extraction) downloadChunks(ctx context.Context, d Downloader, mediaItem data.MediaItem, name string, first *client.Download) error {
+	if err := e.store.MkdirAll(PartialDir); err != nil {
+		return err
+	}
+	w, err := e.store.(storage.RandomWriter).CreateSized(name+chunksSuffix, first.Size)
+	if err != nil {
+		return err
+	}
+	state := partialState{ETag: first.ETag, Size: first.Size, ChunkSize: e.chunkSize}
+	if err := e.savePartial(name, state); err != nil {
+		w.Close()
+		return err
+	}
+	return e.fetchChunks(ctx, d, mediaItem, name, w, state, first)
+}
+
+// resumeChunks continues downloadChunks of an earlier attempt or run, requesting the chunks its state does not record
+func (e *extraction) resumeChunks(ctx context.Context, d Downloader, mediaItem data.MediaItem, name string, state partialState) error {
+	w, err := e.store.(storage.RandomWriter).OpenSized(name + chunksSuffix)
+	if err != nil {
+		return err
+	}
+	return e.fetchChunks(ctx, d, mediaItem, name, w, state, nil)
+}
+
+// fetchChunks writes the chunks missing from state into w, the first from the body of first when
+// there is one, and renames the complete file to name
+func (e *extraction) fetchChunks(ctx context.Context, d Downloader, mediaItem data.MediaItem, name string,
+	w storage.WriterAtCloser, state partialState, first *client.Download) error {
+	written := map[int64]bool{}
+	for _, start := range state.Chunks {
+		written[start] = true
+	}
+	var missing []chunk
+	for start := int64(0); start < state.Size; start += state.ChunkSize {
+		if !written[start] {
+			missing = append(missing, chunk{start: start, end: min(start+state.ChunkSize, state.Size) - 1})
+		}
+	}
+	if first != nil {
+		// the first response holds the first chunk
+		missing = missing[1:]
+	}
+	queue := make(chan chunk, len(missing))
+	for _, c := range missing {
+		queue <- c
+	}
+	close(queue)
+
+	var mu sync.Mutex
+	record := func(c chunk) error {
+		mu.Lock()
+		defer mu.Unlock()
+		state.Chunks = append(state.Chunks, c.start)
+		return e.savePartial(name, state)
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	fetch := func(c chunk) error {
+		download, err := d.DownloadRange(ctx, mediaItem, c.start, c.end, state.ETag)
+		if err != nil {
+			return err
+		}
+		defer download.Body.Close()
+		if download.Offset != c.start || (state.ETag != "" && download.ETag != "" && download.ETag != state.ETag) {
+			// the media changed since the other chunks were written, the next attempt starts over
+			e.store.Remove(name + ".json")
+			return fmt.Errorf("%w: range %d-%d was not honored", errIncomplete, c.start, c.end)
+		}
+		if err := writeChunk(w, download.Body, c); err != nil {
+			return err
+		}
+		return record(c)
+	}
+	work := func() error {
+		for c := range queue {
+			if err := fetch(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// this worker already holds its share of the budget, helpers only take what is spare
+	// so a large item never waits on other downloads
+	eg.Go(func() error {
+		if first != nil {
+			c := chunk{start: 0, end: min(state.ChunkSize, state.Size) - 1}
+			err := writeChunk(w, first.Body, c)
+			first.Body.Close()
+			if err == nil {
+				err = record(c)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return work()
+	})
+	for i := 1; i < len(missing) && e.budget != nil && e.budget.tryAcquire(); i++ {
+		eg.Go(func() error {
+			defer e.budget.release()
+			return work()
+		})
+	}
+	err := eg.Wait()
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := e.store.Rename(name+chunksSuffix, name); err != nil {
+		return err
+	}
+	return e.savePartial(name, partialState{ETag: state.ETag, Size: state.Size})
+}
+
+// writeChunk copies the chunk from r to its place in w
+func writeChunk(w io.WriterAt, r io.Reader, c chunk) error {
+	size := c.end - c.start + 1
+	written, err := io.Copy(io.NewOffsetWriter(w, c.start), io.LimitReader(r, size))
+	if err != nil {
+		return fmt.Errorf("%w at %d: %v", errIncomplete, c.start+written, err)
+	}
+	if written != size {
+		return fmt.Errorf("%w, %d of %d bytes from %d", errIncomplete, written, size, c.start)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package photos
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotScheduled is returned by Controller.Trigger when no Daemon runs with the controller
+	ErrNotScheduled = errors.New("no daemon is running to sync")
+	// ErrSyncing is returned by Controller.Trigger during a sync
+	ErrSyncing = errors.New("a sync is already running")
+)
+
+// maxFailures is how many of the latest failures a Controller keeps
+const maxFailures = 20
+
+// Controller reports on, and steers, the syncs it is given to with WithController: pausing them,
+// resizing their workers, and starting the next sync of a Daemon early. It is safe for concurrent use.
+type Controller struct {
+	mu          sync.Mutex
+	syncing     bool
+	paused      bool
+	workerCount int
+	started     time.Time
+	next        time.Time
+	progress    Progress
+	workers     []*Worker
+	failures    []Failure
+	// pool is the pool of the running Extract
+	pool *pool
+	// trigger is the channel of a running Daemon
+	trigger chan struct{}
+}
+
+// Status is a snapshot of a Controller
+type Status struct {
+	// State is "syncing" or "idle"
+	State       string    `json:"state"`
+	Paused      bool      `json:"paused"`
+	WorkerCount int       `json:"workerCount"`
+	Started     time.Time `json:"started"`
+	// Next is when a Daemon syncs next
+	Next     time.Time `json:"next"`
+	Progress Progress  `json:"progress"`
+	Workers  []Worker  `json:"workers"`
+	// Errors are the latest failures, oldest first
+	Errors []Failure `json:"errors"`
+}
+
+// Progress counts the media of the current, or last, sync
+type Progress struct {
+	Listed int64 `json:"listed"`
+	Saved  int64 `json:"saved"`
+	// Skipped media was saved already, or deleted since the listing
+	Skipped int64 `json:"skipped"`
+	Failed  int64 `json:"failed"`
+	// Bytes is how much was written
+	Bytes int64 `json:"bytes"`
+}
+
+// Worker is what one worker is saving
+type Worker struct {
+	Slot     int       `json:"slot"`
+	ID       string    `json:"id"`
+	Filename string    `json:"filename"`
+	Since    time.Time `json:"since"`
+}
+
+// Failure is media that failed to save, or a sync that failed
+type Failure struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id,omitempty"`
+	Filename string    `json:"filename,omitempty"`
+	Error    string    `json:"error"`
+}
+
+func NewController() *Controller {
+	return &Controller{}
+}
+
+// WithController reports the sync to c and lets c steer it
+func WithController(c *Controller) Option {
+	return func(e *extraction) {
+		e.control = c
+	}
+}
+
+// Status returns the current state
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := Status{
+		State:       "idle",
+		Paused:      c.paused,
+		WorkerCount: c.workerCount,
+		Started:     c.started,
+		Next:        c.next,
+		Progress:    c.progress,
+		Workers:     []Worker{},
+		Errors:      append([]Failure{}, c.failures...),
+	}
+	if c.syncing {
+		status.State = "syncing"
+	}
+	for _, w := range c.workers {
+		if w != nil {
+			status.Workers = append(status.Workers, *w)
+		}
+	}
+	return status
+}
+
+// Pause stops the sync from starting more media, letting what is running finish. It holds for
+// the syncs after too, until Resume.
+func (c *Controller) Pause() {
+	c.setPaused(true)
+}
+
+// Resume undoes Pause
+func (c *Controller) Resume() {
+	c.setPaused(false)
+}
+
+func (c *Controller) setPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+	if c.pool != nil {
+		c.pool.setPaused(paused)
+	}
+}
+
+// SetWorkerCount changes how many media are saved at once, in the running sync and the next ones.
+// Lowering it lets running downloads finish.
+func (c *Controller) SetWorkerCount(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid worker count %d, expected at least 1", n)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workerCount = n
+	if c.pool != nil {
+		c.pool.setLimit(n)
+	}
+	return nil
+}
+
+// Trigger starts the next sync of a running Daemon now
+func (c *Controller) Trigger() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.trigger == nil:
+		return ErrNotScheduled
+	case c.syncing:
+		return ErrSyncing
+	}
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+		// triggered already
+	}
+	return nil
+}
+
+// begin starts reporting an Extract, returning the pool its workers share
+func (c *Controller) begin(workerCount int) *pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.workerCount == 0 {
+		c.workerCount = workerCount
+	}
+	c.pool = newPool(c.workerCount)
+	c.pool.paused = c.paused
+	c.syncing = true
+	c.started = time.Now()
+	c.next = time.Time{}
+	c.progress = Progress{}
+	return c.pool
+}
+
+// end stops reporting an Extract
+func (c *Controller) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.syncing = false
+	c.pool = nil
+	c.workers = nil
+}
+
+// listed counts media listed for the sync
+func (c *Controller) listed(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress.Listed += int64(n)
+}
+
+// wrote counts bytes written
+func (c *Controller) wrote(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress.Bytes += n
+}
+
+// working records a worker starting media, returning its slot for done
+func (c *Controller) working(id, filename string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &Worker{ID: id, Filename: filename, Since: time.Now()}
+	for slot, running := range c.workers {
+		if running == nil {
+			w.Slot = slot
+			c.workers[slot] = w
+			return slot
+		}
+	}
+	w.Slot = len(c.workers)
+	c.workers = append(c.workers, w)
+	return w.Slot
+}
+
+// done records the worker of slot finishing its media, or giving up on it when not finished
+func (c *Controller) done(slot int, err error, finished bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := c.workers[slot]
+	c.workers[slot] = nil
+	switch {
+	case !finished:
+		return
+	case err == nil:
+		// counted by the outcome of save
+		return
+	}
+	c.progress.Failed++
+	c.fail(Failure{Time: time.Now(), ID: w.ID, Filename: w.Filename, Error: err.Error()})
+}
+
+// counted counts media saved or skipped, by its metrics outcome
+func (c *Controller) counted(outcome string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch outcome {
+	case outcomeDownloaded:
+		c.progress.Saved++
+	case outcomeSkipped:
+		c.progress.Skipped++
+	}
+}
+
+// failed records a sync that failed
+func (c *Controller) failed(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail(Failure{Time: time.Now(), Error: err.Error()})
+}
+
+func (c *Controller) fail(f Failure) {
+	c.failures = append(c.failures, f)
+	if len(c.failures) > maxFailures {
+		c.failures = c.failures[len(c.failures)-maxFailures:]
+	}
+}
+
+// schedule makes c trigger a Daemon through the returned channel, until stopped
+func (c *Controller) schedule() (trigger <-chan struct{}, stop func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	c.trigger = ch
+	return ch, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.trigger = nil
+		c.next = time.Time{}
+	}
+}
+
+// scheduled records when a Daemon syncs next
+func (c *Controller) scheduled(next time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.next = next
+}
@@ -0,0 +1,120 @@
+package photos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"velocitizer.com/photogo/metrics"
+	"velocitizer.com/photogo/storage"
+)
+
+// Schedule decides when the next sync of a Daemon starts, like a cron.Schedule
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// Every is a Schedule of a fixed interval
+type Every time.Duration
+
+func (e Every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// defaultFullSync is the FullSync of a Daemon that sets none
+const defaultFullSync = 24 * time.Hour
+
+// Daemon syncs on a schedule until stopped. The first sync lists the whole library, the next
+// ones only the media added since (WithIncremental), until FullSync has passed.
+type Daemon struct {
+	Schedule    Schedule
+	WorkerCount int
+	// FullSync is the longest the daemon goes without listing the whole library, which finds the
+	// media an incremental sync stops short of and what was deleted. A day when zero.
+	FullSync time.Duration
+	// Backoff is the wait after a failed sync, doubled for each failure in a row up to MaxBackoff.
+	// A failure never delays the sync past its schedule.
+	Backoff, MaxBackoff time.Duration
+}
+
+// Run syncs client into store until ctx is done, or the stop of WithStop. Failed syncs are logged
+// and retried. The Controller of WithController can start the next sync early. It returns
+// ErrInterrupted once stopped, and an error when the schedule has no next sync.
+func (d Daemon) Run(ctx context.Context, client MediaService, store storage.Storage, options ...Option) error {
+	// the options of Extract also tell the daemon how to log, when to stop and what controls it
+	settings := &extraction{log: slog.Default(), stop: context.Background(), control: NewController(),
+		metrics: newSyncMetrics(metrics.NewRegistry())}
+	for _, option := range options {
+		option(settings)
+	}
+	log, stop, control := settings.log, settings.stop, settings.control
+	// every sync reports to the same controller
+	options = append(options, WithController(control))
+	trigger, unschedule := control.schedule()
+	defer unschedule()
+
+	fullSync := d.FullSync
+	if fullSync <= 0 {
+		fullSync = defaultFullSync
+	}
+
+	failures := 0
+	var listed time.Time // start of the last sync that listed the whole library
+	for {
+		start := time.Now()
+		incremental := !listed.IsZero() && start.Sub(listed) < fullSync
+		err := Extract(ctx, client, store, d.WorkerCount, false, append(options, WithIncremental(incremental))...)
+		if errors.Is(err, ErrInterrupted) || ctx.Err() != nil || stop.Err() != nil {
+			return ErrInterrupted
+		}
+		next := d.Schedule.Next(start)
+		if now := time.Now(); !next.IsZero() && next.Before(now) {
+			// the sync took longer than the interval
+			next = d.Schedule.Next(now)
+		}
+		if next.IsZero() {
+			return fmt.Errorf("the schedule has no sync after %s", start.Format(time.DateTime))
+		}
+		if err != nil {
+			failures++
+			if retry := time.Now().Add(d.backoff(failures)); retry.Before(next) {
+				next = retry
+			}
+			log.Error("sync failed", "err", err, "failures", failures, "next", next)
+			control.failed(err)
+			settings.metrics.retries.Inc("sync")
+		} else {
+			failures = 0
+			if !incremental {
+				listed = start
+			}
+			log.Info("sync done", "duration", time.Since(start), "incremental", incremental, "next", next)
+		}
+
+		control.scheduled(next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-trigger:
+			timer.Stop()
+			log.Info("sync triggered")
+		case <-ctx.Done():
+			timer.Stop()
+			return ErrInterrupted
+		case <-stop.Done():
+			timer.Stop()
+			return ErrInterrupted
+		}
+	}
+}
+
+// backoff is the wait after failures in a row
+func (d Daemon) backoff(failures int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < failures && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, d.MaxBackoff)
+}
@@ -0,0 +1,128 @@
+package photos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/metadata"
+)
+
+// DatePolicy decides which time places media in the output and becomes its modification time
+type DatePolicy string
+
+const (
+	// DatesAPI uses the creationTime of Google Photos, the default
+	DatesAPI DatePolicy = "api"
+	// DatesEXIF uses the capture time embedded in the file, when it has one
+	DatesEXIF DatePolicy = "exif"
+	// DatesEarliest uses the earlier of the two
+	DatesEarliest DatePolicy = "earliest"
+)
+
+// discrepancyThreshold is how far apart the API and embedded times may be before they are reported
+const discrepancyThreshold = time.Minute
+
+// ParseDatePolicy validates a policy name
+func ParseDatePolicy(name string) (DatePolicy, error) {
+	switch policy := DatePolicy(name); policy {
+	case DatesAPI, DatesEXIF, DatesEarliest:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown date policy %q, expected api, exif or earliest", name)
+}
+
+// WithDates sets the DatePolicy, DatesAPI by default. Other policies download media before
+// deciding where it goes.
+func WithDates(policy DatePolicy) Option {
+	return func(e *extraction) {
+		e.dates = policy
+	}
+}
+
+// WithMetadataWrite adds the creation time and description to downloads that do not record them,
+// leaving the image and video data as it was
+func WithMetadataWrite(enabled bool) Option {
+	return func(e *extraction) {
+		e.writeMetadata = enabled
+	}
+}
+
+// Discrepancy is media whose embedded capture time disagrees with the time Google Photos has
+type Discrepancy struct {
+	Path     string
+	API      time.Time
+	Embedded time.Time
+	// Source is where the embedded time came from, e.g. "exif" or "mvhd"
+	Source string
+}
+
+// embeddedTimeOf reads the capture time recorded in content, in local time when it has no offset
+func embeddedTimeOf(r io.Reader) (time.Time, string, bool) {
+	info, err := metadata.Read(r)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return info.In(time.Local), info.Source, true
+}
+
+// pick returns the time the policy chooses between the API time and the embedded time, if found
+func (policy DatePolicy) pick(api, embedded time.Time, found bool) time.Time {
+	if !found {
+		return api
+	}
+	switch policy {
+	case DatesEXIF:
+		return embedded
+	case DatesEarliest:
+		if embedded.Before(api) {
+			return embedded
+		}
+	}
+	return api
+}
+
+// crossCheck records a Discrepancy when the time embedded in the media written to name, read
+// from r, is far from the API time
+func (e *extraction) crossCheck(name string, api time.Time, r io.Reader) {
+	embedded, source, found := embeddedTimeOf(r)
+	if !found {
+		return
+	}
+	if diff := embedded.Sub(api); diff < discrepancyThreshold && diff > -discrepancyThreshold {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.discrepancies = append(e.discrepancies, Discrepancy{Path: name, API: api, Embedded: embedded, Source: source})
+}
+
+// embed copies the media from r to w with its creation time and description added where it has none
+func (e *extraction) embed(w io.Writer, r io.Reader, name string, mediaItem data.MediaItem) error {
+	_, err := metadata.InjectTo(w, r, metadata.Tags{
+		Captured:    mediaItem.Metadata.CreationTime.In(time.Local),
+		Description: mediaItem.Description,
+	})
+	if errors.Is(err, metadata.ErrTags) {
+		e.log.Warn("kept as downloaded, failed to add metadata", "id", mediaItem.ID, "path", name, "err", err)
+		return nil
+	}
+	return err
+}
+
+// reportDates prints the discrepancies found while saving media
+func (e *extraction) reportDates() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.discrepancies) == 0 {
+		return
+	}
+	sort.Slice(e.discrepancies, func(i, j int) bool { return e.discrepancies[i].Path < e.discrepancies[j].Path })
+	e.log.Warn("media have a creation time that disagrees with the file", "count", len(e.discrepancies), "dates", e.dates)
+	for _, d := range e.discrepancies {
+		e.log.Warn("creation time disagrees", "path", d.Path, "api", d.API, "embedded", d.Embedded, "source", d.Source)
+	}
+}
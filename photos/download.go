@@ -0,0 +1,203 @@
+package photos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+
+	"velocitizer.com/photogo/client"
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/storage"
+)
+
+// PartialDir holds downloads that have not completed, relative to the storage root
+const PartialDir = ".photogo/partial"
+
+// downloadAttempts is how many times a run continues an interrupted download before giving up
+// on it until the next run
+const downloadAttempts = 3
+
+// Downloader is a MediaService that can download a range of the media, like client.Client,
+// to continue a download part way through
+type Downloader interface {
+	// DownloadRange requests the bytes from start to end inclusive, to the end of the media when end is -1
+	DownloadRange(ctx context.Context, mediaItem data.MediaItem, start, end int64, etag string) (*client.Download, error)
+}
+
+// Throttled is a MediaService that limits its downloads, like client.Client with client.WithLimiter
+type Throttled interface {
+	Throughput() client.Throughput
+}
+
+// throughput is what the client downloaded so far, zero when it is not Throttled
+func (e *extraction) throughput() client.Throughput {
+	if throttled, ok := e.client.(Throttled); ok {
+		return throttled.Throughput()
+	}
+	return client.Throughput{}
+}
+
+// reportThroughput prints how much was downloaded since start, against the limit in force now.
+// before is the throughput at start, as a daemon's client keeps counting across syncs.
+func (e *extraction) reportThroughput(start time.Time, before client.Throughput) {
+	throughput := e.throughput()
+	bytes := throughput.Bytes - before.Bytes
+	if bytes <= 0 {
+		return
+	}
+	average := client.Rate(float64(bytes) / time.Since(start).Seconds())
+	e.log.Info("downloaded", "bytes", bytes, "rate", average, "limit", throughput.Limit)
+}
+
+// partialState is what is known of the media being downloaded to a partial file, to check
+// the rest of it belongs to the same media
+type partialState struct {
+	ETag string `json:"etag,omitempty"`
+	Size int64  `json:"size"`
+	// ChunkSize is set while the media is downloaded in chunks, with the start of every chunk
+	// written so far in Chunks
+	ChunkSize int64   `json:"chunkSize,omitempty"`
+	Chunks    []int64 `json:"chunks,omitempty"`
+}
+
+// errIncomplete is returned when a download ended before the size the server promised
+var errIncomplete = errors.New("download incomplete")
+
+// partialPath is where the media is downloaded to until it completes
+func partialPath(mediaItem data.MediaItem) string {
+	return path.Join(PartialDir, mediaItem.ID)
+}
+
+// download fetches the media into its partial file, continuing what earlier attempts and runs left,
+// and opens the complete file. Once complete, it opens it again without downloading.
+func (e *extraction) download(ctx context.Context, d Downloader, mediaItem data.MediaItem) (io.ReadCloser, error) {
+	name := partialPath(mediaItem)
+	var err error
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		if err = e.downloadPartial(ctx, d, mediaItem, name); err == nil {
+			return e.store.Open(name)
+		}
+		if ctx.Err() != nil || !errors.Is(err, errIncomplete) {
+			break
+		}
+		e.log.Warn("continuing download", "id", mediaItem.ID, "filename", mediaItem.Filename, "attempt", attempt+1, "err", err)
+		e.metrics.retries.Inc("download")
+	}
+	return nil, err
+}
+
+// downloadPartial makes one request for the rest of the media, appending it to the partial file
+func (e *extraction) downloadPartial(ctx context.Context, d Downloader, mediaItem data.MediaItem, name string) error {
+	appender := e.store.(storage.Appender)
+	state, offset := e.loadPartial(name)
+	if state.ChunkSize > 0 {
+		return e.resumeChunks(ctx, d, mediaItem, name, state)
+	}
+	if state.Size > 0 && offset == state.Size {
+		// complete, but not yet saved when the last run stopped
+		return nil
+	}
+	download, err := d.DownloadRange(ctx, mediaItem, offset, -1, state.ETag)
+	if err != nil {
+		return err
+	}
+	defer download.Body.Close()
+	if download.Offset > 0 && state.ETag == "" && download.Size != state.Size {
+		// without an etag a different size is all that tells another version of the media apart
+		download.Body.Close()
+		if download, err = d.DownloadRange(ctx, mediaItem, 0, -1, ""); err != nil {
+			return err
+		}
+		defer download.Body.Close()
+	}
+	if e.chunked(download) {
+		return e.downloadChunks(ctx, d, mediaItem, name, download)
+	}
+
+	var w io.WriteCloser
+	if download.Offset == 0 {
+		// a fresh start, either the first attempt or the server sent the whole media
+		offset = 0
+		if err := e.store.MkdirAll(PartialDir); err != nil {
+			return err
+		}
+		if err := e.savePartial(name, partialState{ETag: download.ETag, Size: download.Size}); err != nil {
+			return err
+		}
+		w, err = e.store.Create(name)
+	} else {
+		w, err = appender.Append(name)
+	}
+	if err != nil {
+		return err
+	}
+	written, copyErr := io.Copy(w, download.Body)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if copyErr != nil {
+		return fmt.Errorf("%w after %d bytes: %v", errIncomplete, offset+written, copyErr)
+	}
+	if download.Size >= 0 && offset+written != download.Size {
+		return fmt.Errorf("%w, %d of %d bytes", errIncomplete, offset+written, download.Size)
+	}
+	return nil
+}
+
+// savePartial records the state of the partial file at name
+func (e *extraction) savePartial(name string, state partialState) error {
+	contents, _ := json.Marshal(state)
+	return writeFile(e.store, name+".json", contents)
+}
+
+// loadPartial returns the state of the partial file at name, and how much of it was written.
+// Chunked downloads are written into a file of the full size, whose chunks the state records.
+func (e *extraction) loadPartial(name string) (partialState, int64) {
+	var state partialState
+	contents, err := readAll(e.store, name+".json")
+	if err != nil || json.Unmarshal(contents, &state) != nil {
+		return partialState{}, 0
+	}
+	if state.ChunkSize > 0 {
+		info, err := e.store.Stat(name + chunksSuffix)
+		if _, ok := e.store.(storage.RandomWriter); err != nil || !ok || info.Size() != state.Size {
+			return partialState{}, 0
+		}
+		return state, 0
+	}
+	info, err := e.store.Stat(name)
+	if err != nil || (state.Size >= 0 && info.Size() > state.Size) {
+		return partialState{}, 0
+	}
+	return state, info.Size()
+}
+
+// countPartial is the number of downloads kept in PartialDir to continue
+func (e *extraction) countPartial() int {
+	infos, err := e.store.List(PartialDir)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, info := range infos {
+		if path.Ext(info.Name()) == "" {
+			count++
+		}
+	}
+	return count
+}
+
+// removePartial deletes the partial file of saved media
+func (e *extraction) removePartial(mediaItem data.MediaItem) {
+	name := partialPath(mediaItem)
+	for _, file := range []string{name, name + ".json", name + chunksSuffix} {
+		if err := e.store.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			e.log.Warn("failed to remove partial download", "id", mediaItem.ID, "path", file, "err", err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package photos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"velocitizer.com/photogo/metadata"
+	"velocitizer.com/photogo/metrics"
+	"velocitizer.com/photogo/storage"
+)
+
+// timeTolerance is how far a file time may be from the intended time before it is fixed,
+// covering storage that keeps times at a coarser resolution than the API
+const timeTolerance = 2 * time.Second
+
+// FixTimes resets the modification time of media already in the output to when it was created,
+// without downloading anything. Times come from a listing of the library, matching files by path,
+// and otherwise from the capture time embedded in the file. A nil client only uses embedded times.
+// The DatePolicy of WithDates chooses between the two like it does when saving.
+func FixTimes(ctx context.Context, client MediaService, store storage.Storage, readOnly bool, options ...Option) error {
+	e := &extraction{client: client, store: store, dates: DatesAPI, log: slog.Default(), control: NewController(),
+		metrics: newSyncMetrics(metrics.NewRegistry())}
+	for _, option := range options {
+		option(e)
+	}
+	var err error
+	e.index, err = LoadIndex(store)
+	if err != nil {
+		return err
+	}
+	intended := map[string]time.Time{}
+	if client != nil {
+		if intended, err = e.listTimes(ctx); err != nil {
+			return err
+		}
+	}
+
+	files, err := walk(store, "")
+	if err != nil {
+		return err
+	}
+	var fixed, unresolved, failed int
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		listed, ok := intended[file.name]
+		want, source := listed, "listing"
+		if !ok || e.dates != DatesAPI {
+			info, err := embeddedTime(store, file.name)
+			if err != nil && !ok {
+				e.log.Warn("no time", "path", file.name, "err", err)
+				unresolved++
+				continue
+			}
+			if err == nil && (!ok || !e.dates.pick(listed, info.In(time.Local), true).Equal(listed)) {
+				want, source = info.In(time.Local), info.Source
+			}
+		}
+		if diff := file.modTime.Sub(want); diff < timeTolerance && diff > -timeTolerance {
+			continue
+		}
+		if !readOnly {
+			if err := store.SetModTime(file.name, want); err != nil {
+				e.log.Error("failed to fix time", "path", file.name, "err", err)
+				failed++
+				continue
+			}
+		}
+		e.log.Info("fixed time", "path", file.name, "from", file.modTime, "to", want, "source", source)
+		fixed++
+	}
+	e.log.Info("files checked", "count", len(files), "fixed", fixed, "without_time", unresolved)
+	if failed > 0 {
+		return fmt.Errorf("failed to fix the time of %d files", failed)
+	}
+	return nil
+}
+
+// listTimes pages through the library, returning the creation time of the media by the paths
+// it may have been written to
+func (e *extraction) listTimes(ctx context.Context) (map[string]time.Time, error) {
+	byID := map[string]time.Time{}
+	byPath := map[string]time.Time{}
+	var nextPageToken string
+	for {
+		medias, err := e.client.List(ctx, nextPageToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get mediaitems: %s", err)
+		}
+		for _, media := range medias.MediaItems {
+			name, err := e.mediaPath(*media)
+			if err != nil {
+				return nil, err
+			}
+			createdAt := media.Metadata.CreationTime
+			byID[media.ID] = createdAt
+			byPath[name] = createdAt
+			if e.nameTemplate == nil {
+				byPath[path.Join(path.Dir(name), legacyName(media.Filename))] = createdAt
+			}
+		}
+		nextPageToken = medias.NextPageToken
+		if nextPageToken == "" {
+			break
+		}
+	}
+	// the index knows where media went when the layout changed since it was saved
+	for _, entry := range e.index.Entries() {
+		if createdAt, ok := byID[entry.ID]; ok && entry.Path != "" {
+			byPath[entry.Path] = createdAt
+		}
+	}
+	return byPath, nil
+}
+
+// embeddedTime reads the capture time recorded in the file itself
+func embeddedTime(store storage.Storage, name string) (metadata.Info, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return metadata.Info{}, err
+	}
+	defer f.Close()
+	info, err := metadata.Read(f)
+	if errors.Is(err, metadata.ErrUnsupported) || errors.Is(err, metadata.ErrNotFound) {
+		return info, err
+	}
+	if err != nil {
+		return info, fmt.Errorf("failed to read metadata: %v", err)
+	}
+	return info, nil
+}
+
+type walkedFile struct {
+	name    string
+	modTime time.Time
+}
+
+// walk lists the media files under dir, sorted by name, leaving out XMP sidecars and the
+// hidden directories photogo keeps its own state in
+func walk(store storage.Storage, dir string) ([]walkedFile, error) {
+	infos, err := store.List(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %v", dir, err)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	var files []walkedFile
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") || (!info.IsDir() && strings.HasSuffix(info.Name(), ".xmp")) {
+			continue
+		}
+		name := path.Join(dir, info.Name())
+		if !info.IsDir() {
+			files = append(files, walkedFile{name: name, modTime: info.ModTime()})
+			continue
+		}
+		children, err := walk(store, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, children...)
+	}
+	return files, nil
+}
@@ -0,0 +1,262 @@
+package photos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+
+	"velocitizer.com/photogo/storage"
+)
+
+// IndexPath is where the index is kept, relative to the storage root
+const IndexPath = ".photogo/index.json"
+
+// IndexEntry records a media item that has been saved
+type IndexEntry struct {
+	ID   string `json:"id"`
+	Path string `json:"path,omitempty"`
+	// SHA256 is empty for media found on disk from before the index existed
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size"`
+	// DuplicateOf is the ID of the first item saved with the same content
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+	// Source is where the media came from when it was not the Library API, such as SourceTakeout
+	Source string `json:"source,omitempty"`
+}
+
+// Index is the record of saved media by ID and content hash. It lives alongside the media
+// so later runs, on any machine, know what is already there.
+type Index struct {
+	mu      sync.Mutex
+	entries map[string]*IndexEntry
+	byHash  map[string]string
+	byPath  map[string]string
+	dirty   bool
+}
+
+func NewIndex() *Index {
+	return &Index{entries: map[string]*IndexEntry{}, byHash: map[string]string{}, byPath: map[string]string{}}
+}
+
+// LoadIndex reads the index from store, an empty index when there is none yet
+func LoadIndex(store storage.Storage) (*Index, error) {
+	idx := NewIndex()
+	contents, err := readAll(store, IndexPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %v", err)
+	}
+	var entries []*IndexEntry
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse index %s: %v", IndexPath, err)
+	}
+	for _, entry := range entries {
+		idx.add(entry)
+	}
+	return idx, nil
+}
+
+// Save writes the index to store when it has changed, replacing the previous one only once fully written
+func (idx *Index) Save(store storage.Storage) error {
+	idx.mu.Lock()
+	if !idx.dirty {
+		idx.mu.Unlock()
+		return nil
+	}
+	idx.dirty = false
+	entries := make([]*IndexEntry, 0, len(idx.entries))
+	for _, entry := range idx.entries {
+		entries = append(entries, entry)
+	}
+	idx.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	contents, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(store, IndexPath, contents); err != nil {
+		idx.mu.Lock()
+		idx.dirty = true
+		idx.mu.Unlock()
+		return fmt.Errorf("failed to save index: %v", err)
+	}
+	return nil
+}
+
+// writeFile replaces name with contents through a temporary file, so a failure leaves the old file intact
+func writeFile(store storage.Storage, name string, contents []byte) error {
+	if err := store.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	f, err := store.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return store.Rename(tmp, name)
+}
+
+// Lookup returns the entry for a media item ID
+func (idx *Index) Lookup(id string) (IndexEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entry, ok := idx.entries[id]
+	if !ok {
+		return IndexEntry{}, false
+	}
+	return *entry, true
+}
+
+// LookupPath returns the entry of the media saved at path
+func (idx *Index) LookupPath(path string) (IndexEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	id, ok := idx.byPath[path]
+	if !ok {
+		return IndexEntry{}, false
+	}
+	return *idx.entries[id], true
+}
+
+// Add records entry. When content with the same hash was saved before, entry is marked
+// as its duplicate and the first entry is returned.
+func (idx *Index) Add(entry IndexEntry) (IndexEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.dirty = true
+	if firstID, ok := idx.byHash[entry.SHA256]; ok && firstID != entry.ID && entry.SHA256 != "" {
+		entry.DuplicateOf = firstID
+		idx.put(&entry)
+		return *idx.entries[firstID], true
+	}
+	idx.add(&entry)
+	return IndexEntry{}, false
+}
+
+// Update replaces the entry with the same ID
+func (idx *Index) Update(entry IndexEntry) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.dirty = true
+	idx.put(&entry)
+}
+
+// Remove forgets a media item. When it was the first copy of duplicated content the next
+// copy takes its place.
+func (idx *Index) Remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entry, ok := idx.entries[id]
+	if !ok {
+		return
+	}
+	idx.dirty = true
+	idx.forgetPath(entry)
+	delete(idx.entries, id)
+	if entry.SHA256 == "" || idx.byHash[entry.SHA256] != id {
+		return
+	}
+	delete(idx.byHash, entry.SHA256)
+	var copies []*IndexEntry
+	for _, other := range idx.entries {
+		if other.DuplicateOf == id {
+			copies = append(copies, other)
+		}
+	}
+	sort.Slice(copies, func(i, j int) bool { return copies[i].ID < copies[j].ID })
+	for i, other := range copies {
+		if i == 0 {
+			other.DuplicateOf = ""
+			idx.byHash[other.SHA256] = other.ID
+		} else {
+			other.DuplicateOf = copies[0].ID
+		}
+	}
+}
+
+// Entries returns a copy of every entry
+func (idx *Index) Entries() []IndexEntry {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entries := make([]IndexEntry, 0, len(idx.entries))
+	for _, entry := range idx.entries {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+func (idx *Index) add(entry *IndexEntry) {
+	idx.put(entry)
+	if entry.SHA256 == "" {
+		return
+	}
+	if _, ok := idx.byHash[entry.SHA256]; !ok && entry.DuplicateOf == "" {
+		idx.byHash[entry.SHA256] = entry.ID
+	}
+}
+
+// put replaces the entry with the same ID, keeping byPath in step
+func (idx *Index) put(entry *IndexEntry) {
+	if old, ok := idx.entries[entry.ID]; ok {
+		idx.forgetPath(old)
+	}
+	idx.entries[entry.ID] = entry
+	if entry.Path != "" {
+		idx.byPath[entry.Path] = entry.ID
+	}
+}
+
+func (idx *Index) forgetPath(entry *IndexEntry) {
+	if idx.byPath[entry.Path] == entry.ID {
+		delete(idx.byPath, entry.Path)
+	}
+}
+
+// DuplicateGroup is media saved more than once with identical content, first saved first
+type DuplicateGroup struct {
+	SHA256  string
+	Entries []IndexEntry
+}
+
+// Duplicates returns the groups of media sharing content
+func (idx *Index) Duplicates() []DuplicateGroup {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	groups := map[string][]IndexEntry{}
+	for _, entry := range idx.entries {
+		if entry.DuplicateOf != "" {
+			groups[entry.SHA256] = append(groups[entry.SHA256], *entry)
+		}
+	}
+	var result []DuplicateGroup
+	for hash, entries := range groups {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+		first := *idx.entries[idx.byHash[hash]]
+		result = append(result, DuplicateGroup{SHA256: hash, Entries: append([]IndexEntry{first}, entries...)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Entries[0].Path < result[j].Entries[0].Path })
+	return result
+}
+
+func readAll(store storage.Storage, name string) ([]byte, error) {
+	r, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
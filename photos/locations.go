@@ -0,0 +1,234 @@
+package photos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"time"
+
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/metadata"
+	"velocitizer.com/photogo/metrics"
+	"velocitizer.com/photogo/storage"
+)
+
+// LocationTarget decides where MergeLocations writes locations
+type LocationTarget string
+
+const (
+	// LocationsEXIF writes into the file when its format allows it, JPEG EXIF or MP4/MOV user data,
+	// and otherwise into an XMP sidecar
+	LocationsEXIF LocationTarget = "exif"
+	// LocationsXMP always writes an XMP sidecar, leaving the media untouched
+	LocationsXMP LocationTarget = "xmp"
+)
+
+// locationTolerance is how far the time of a saved file may be from the time Takeout recorded for it
+const locationTolerance = time.Minute
+
+// ParseLocationTarget validates a target name
+func ParseLocationTarget(name string) (LocationTarget, error) {
+	switch target := LocationTarget(name); target {
+	case LocationsEXIF, LocationsXMP:
+		return target, nil
+	}
+	return "", fmt.Errorf("unknown location target %q, expected exif or xmp", name)
+}
+
+// xmpPath is the sidecar of the media at name, keeping its extension so IMG_1.HEIC and IMG_1.MOV
+// each have their own
+func xmpPath(name string) string {
+	return name + ".xmp"
+}
+
+// MergeLocations copies the locations recorded in the json sidecars of Google Takeout archives,
+// which the Library API download leaves out, into the media already saved in store. Sidecars are
+// matched to files by filename, and by the file time being the time the media was taken. Pass the
+// same name options as the sync. A name template is evaluated with what the sidecar records, so
+// templates that name media by its ID or camera match nothing. Sidecars without a matching file
+// are reported.
+func MergeLocations(ctx context.Context, store storage.Storage, archives []string, target LocationTarget, readOnly bool, options ...Option) error {
+	e := &extraction{store: store, dates: DatesAPI, log: slog.Default(), control: NewController(),
+		metrics: newSyncMetrics(metrics.NewRegistry())}
+	for _, option := range options {
+		option(e)
+	}
+	var located []*sidecar
+	for _, archive := range archives {
+		err := walkArchive(archive, isSidecar, func(name string, r io.Reader) error {
+			s, ok := readSidecar(r)
+			if ok && s.location() != nil {
+				s.archive, s.name = archive, name
+				located = append(located, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(located, func(i, j int) bool {
+		if located[i].archive != located[j].archive {
+			return located[i].archive < located[j].archive
+		}
+		return located[i].name < located[j].name
+	})
+
+	files, err := walk(store, "")
+	if err != nil {
+		return err
+	}
+	byName := map[string][]walkedFile{}
+	for _, file := range files {
+		byName[path.Base(file.name)] = append(byName[path.Base(file.name)], file)
+	}
+
+	var merged, existing, unmatched int
+	for _, s := range located {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		file, ok := e.matchSidecar(s, byName)
+		if !ok {
+			unmatched++
+			taken, _ := s.takenTime()
+			e.log.Warn("no file for location", "title", s.Title, "taken", taken, "metadata", s.name, "archive", s.archive)
+			continue
+		}
+		wrote, err := e.mergeLocation(file, *s.location(), target, readOnly)
+		if err != nil {
+			return fmt.Errorf("failed to merge location into %s: %v", file.name, err)
+		}
+		if wrote == "" {
+			existing++
+			continue
+		}
+		merged++
+		e.log.Info("located", "path", file.name, "in", wrote)
+	}
+	e.log.Info("locations merged", "count", merged, "already_located", existing, "without_file", unmatched)
+	return nil
+}
+
+// matchSidecar finds the saved file with the name the sidecar's title was saved under, or the
+// name template gives it, and the time closest to when it was taken
+func (e *extraction) matchSidecar(s *sidecar, byName map[string][]walkedFile) (walkedFile, bool) {
+	taken, ok := s.takenTime()
+	if !ok {
+		return walkedFile{}, false
+	}
+	names := []string{e.nameCleaner(s.Title), legacyName(s.Title)}
+	if e.nameTemplate != nil {
+		mediaItem := data.MediaItem{Filename: s.Title, MimeType: mimeType(s.Title), Metadata: data.MediaMetadata{CreationTime: taken}}
+		if name, err := e.mediaPath(mediaItem); err == nil {
+			names = append(names, path.Base(name))
+		}
+	}
+	var best walkedFile
+	bestDiff := locationTolerance + 1
+	for _, name := range names {
+		for _, file := range byName[name] {
+			diff := file.modTime.Sub(taken)
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff < bestDiff {
+				best, bestDiff = file, diff
+			}
+		}
+	}
+	return best, bestDiff <= locationTolerance
+}
+
+// mergeLocation writes location for the file, returning where it went, or nothing when the file
+// already has a location. A file whose metadata cannot be added to gets an XMP sidecar.
+func (e *extraction) mergeLocation(file walkedFile, location metadata.Location, target LocationTarget, readOnly bool) (string, error) {
+	store := e.store
+	sidecar := xmpPath(file.name)
+	if _, err := store.Stat(sidecar); err == nil {
+		return "", nil
+	}
+	if target == LocationsEXIF {
+		located, err := hasLocation(store, file.name)
+		if err != nil || located {
+			return "", err
+		}
+		changed, err := injectLocation(store, file.name, location, readOnly)
+		if errors.Is(err, metadata.ErrTags) {
+			e.log.Warn("failed to add location to the file, writing a sidecar", "path", file.name, "err", err)
+		} else if err != nil {
+			return "", err
+		}
+		if changed {
+			if readOnly {
+				return file.name, nil
+			}
+			// the time it had put back
+			return file.name, store.SetModTime(file.name, file.modTime)
+		}
+	}
+	if readOnly {
+		return sidecar, nil
+	}
+	if err := writeFile(store, sidecar, metadata.XMP(location)); err != nil {
+		return "", err
+	}
+	return sidecar, store.SetModTime(sidecar, file.modTime)
+}
+
+// hasLocation is true when the file records where it was taken
+func hasLocation(store storage.Storage, name string) (bool, error) {
+	r, err := store.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	info, _ := metadata.Read(r)
+	return info.Location != nil, nil
+}
+
+// injectLocation writes location into the file, streamed into a copy that replaces it once
+// complete. When readOnly it only finds out whether the file would change.
+func injectLocation(store storage.Storage, name string, location metadata.Location, readOnly bool) (bool, error) {
+	r, err := store.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	tags := metadata.Tags{Location: &location}
+	if readOnly {
+		return metadata.InjectTo(io.Discard, r, tags)
+	}
+	tmp := name + ".tmp"
+	f, err := store.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	changed, err := metadata.InjectTo(f, r, tags)
+	// both closed before the copy takes the place of the file
+	r.Close()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !changed {
+		if removeErr := store.Remove(tmp); removeErr != nil && err == nil {
+			err = removeErr
+		}
+		return false, err
+	}
+	return true, store.Rename(tmp, name)
+}
+
+// location is where the media was taken, as placed in Google Photos or else as recorded by the camera
+func (s *sidecar) location() *metadata.Location {
+	for _, geo := range []takeoutGeo{s.GeoData, s.GeoDataExif} {
+		if geo.Latitude != 0 || geo.Longitude != 0 {
+			return &metadata.Location{Latitude: geo.Latitude, Longitude: geo.Longitude, Altitude: geo.Altitude}
+		}
+	}
+	return nil
+}
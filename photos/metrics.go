@@ -0,0 +1,34 @@
+package photos
+
+import "velocitizer.com/photogo/metrics"
+
+// Outcomes of an item in the photogo_items_total metric
+const (
+	outcomeDownloaded = "downloaded"
+	outcomeSkipped    = "skipped"
+	outcomeFailed     = "failed"
+)
+
+// WithMetrics counts the items, retries and successful syncs in registry
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(e *extraction) {
+		e.metrics = newSyncMetrics(registry)
+	}
+}
+
+type syncMetrics struct {
+	items       *metrics.Counter
+	itemSeconds *metrics.Histogram
+	retries     *metrics.Counter
+	lastSuccess *metrics.Gauge
+}
+
+func newSyncMetrics(registry *metrics.Registry) *syncMetrics {
+	return &syncMetrics{
+		items: registry.Counter("photogo_items_total", "Media items by outcome: downloaded, skipped as already saved or deleted, or failed.", "outcome"),
+		itemSeconds: registry.Histogram("photogo_item_duration_seconds", "Time to save a media item, or find it saved already.",
+			[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}),
+		retries:     registry.Counter("photogo_retries_total", "Retries by reason: a continued download, a renewed baseUrl or a failed sync.", "reason"),
+		lastSuccess: registry.Gauge("photogo_last_success_timestamp_seconds", "Unix time the last successful sync finished."),
+	}
+}
@@ -0,0 +1,132 @@
+package photos
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// TrashDir is where orphaned media is quarantined, relative to the storage root
+const TrashDir = ".trash"
+
+// OrphanPolicy decides what happens to saved media that no longer exists in Google Photos
+type OrphanPolicy string
+
+const (
+	// OrphansKeep leaves everything in place without reconciling, the default
+	OrphansKeep OrphanPolicy = "keep"
+	// OrphansReport lists orphans without touching them
+	OrphansReport OrphanPolicy = "report"
+	// OrphansTrash moves orphans into TrashDir/<date>/
+	OrphansTrash OrphanPolicy = "trash"
+	// OrphansDelete removes orphans, only when the count was confirmed with WithDeleteConfirmation
+	OrphansDelete OrphanPolicy = "delete"
+)
+
+// ParseOrphanPolicy validates a policy name
+func ParseOrphanPolicy(name string) (OrphanPolicy, error) {
+	switch policy := OrphanPolicy(name); policy {
+	case OrphansKeep, OrphansReport, OrphansTrash, OrphansDelete:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown orphan policy %q, expected keep, report, trash or delete", name)
+}
+
+// WithOrphans reconciles the output with a full listing of the library once it completes
+func WithOrphans(policy OrphanPolicy) Option {
+	return func(e *extraction) {
+		e.orphans = policy
+	}
+}
+
+// WithDeleteConfirmation is the number of orphans the user expects OrphansDelete to delete.
+// Nothing is deleted unless it matches the number found.
+func WithDeleteConfirmation(count int) Option {
+	return func(e *extraction) {
+		e.confirmDelete = count
+	}
+}
+
+// reconcile handles media in the index whose ID was not in the complete listing seen
+func (e *extraction) reconcile(seen map[string]bool, readOnly bool) error {
+	if e.orphans == "" || e.orphans == OrphansKeep || e.source != "" {
+		return nil
+	}
+	var orphans []IndexEntry
+	inUse := map[string]bool{}
+	for _, entry := range e.index.Entries() {
+		if seen[entry.ID] || entry.Source != "" {
+			inUse[entry.Path] = true
+		} else {
+			orphans = append(orphans, entry)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Path < orphans[j].Path })
+	e.log.Info("media no longer in Google Photos", "count", len(orphans))
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	policy := e.orphans
+	if readOnly {
+		policy = OrphansReport
+	}
+	if policy != OrphansReport && len(seen) == 0 {
+		return fmt.Errorf("refusing to %s %d media: Google Photos listed nothing, check the account and scopes", policy, len(orphans))
+	}
+	if policy == OrphansDelete && e.confirmDelete != len(orphans) {
+		return fmt.Errorf("refusing to delete %d media without confirmation, review them with -orphans report and confirm the count", len(orphans))
+	}
+
+	trash := path.Join(TrashDir, time.Now().Format("2006-01-02"))
+	for _, orphan := range orphans {
+		switch {
+		case orphan.Path == "":
+			// a skipped duplicate has nothing on disk
+		case inUse[orphan.Path]:
+			e.log.Info("orphan kept, also saved for other media", "id", orphan.ID, "path", orphan.Path)
+			continue
+		case policy == OrphansReport:
+			e.log.Info("orphan", "id", orphan.ID, "path", orphan.Path)
+			continue
+		case policy == OrphansTrash:
+			target := e.trashPath(trash, orphan)
+			if err := e.store.MkdirAll(path.Dir(target)); err != nil {
+				return fmt.Errorf("failed to create trash for %s: %v", orphan.Path, err)
+			}
+			if err := e.store.Rename(orphan.Path, target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to move %s to trash: %v", orphan.Path, err)
+			}
+			e.log.Info("trashed", "id", orphan.ID, "path", orphan.Path, "trash", target)
+		case policy == OrphansDelete:
+			if err := e.store.Remove(orphan.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to delete %s: %v", orphan.Path, err)
+			}
+			e.log.Info("deleted", "id", orphan.ID, "path", orphan.Path)
+		}
+		if policy != OrphansReport {
+			e.index.Remove(orphan.ID)
+		}
+	}
+	return nil
+}
+
+// trashPath is where orphan goes in trash, under a name of its own when media of the same path
+// was already trashed that day
+func (e *extraction) trashPath(trash string, orphan IndexEntry) string {
+	target := path.Join(trash, orphan.Path)
+	for n := 1; ; n++ {
+		if _, err := e.store.Stat(target); err != nil {
+			// free, or the move reports what is wrong
+			return target
+		}
+		id := orphan.ID
+		if n > 1 {
+			id = fmt.Sprintf("%s-%d", orphan.ID, n)
+		}
+		target = e.distinctName(path.Join(trash, orphan.Path), id)
+	}
+}
@@ -1,17 +1,26 @@
 package photos
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/text/language"
-	"golang.org/x/text/message"
+	"velocitizer.com/photogo/client"
 	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/metrics"
+	"velocitizer.com/photogo/storage"
 )
 
 type MediaService interface {
@@ -19,108 +28,704 @@ type MediaService interface {
 	Get(ctx context.Context, mediaItem data.MediaItem) ([]byte, error)
 }
 
-func Extract(ctx context.Context, client MediaService, outputDir string, workerCount int, readOnly bool) error {
+// Refresher is a MediaService that can get a single item again, like client.Client, to renew
+// a baseUrl that expired before its media was downloaded
+type Refresher interface {
+	Item(ctx context.Context, id string) (*data.MediaItem, error)
+}
+
+// DuplicatePolicy decides what happens to media whose content was already saved under another item
+type DuplicatePolicy string
+
+const (
+	// DuplicatesReport writes every copy and records it in the duplicates report
+	DuplicatesReport DuplicatePolicy = "report"
+	// DuplicatesSkip keeps only the first copy
+	DuplicatesSkip DuplicatePolicy = "skip"
+	// DuplicatesLink hard links to the first copy, on storage that supports it
+	DuplicatesLink DuplicatePolicy = "link"
+)
+
+// ParseDuplicatePolicy validates a policy name
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(name); policy {
+	case DuplicatesReport, DuplicatesSkip, DuplicatesLink:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q, expected report, skip or link", name)
+}
+
+// ErrInterrupted is returned by Extract when it was stopped, or aborted, before it went through the library
+var ErrInterrupted = errors.New("interrupted")
+
+// Option configures Extract
+type Option func(*extraction)
+
+// WithLogger sets the logger of progress and problems, slog.Default() by default
+func WithLogger(logger *slog.Logger) Option {
+	return func(e *extraction) {
+		e.log = logger
+	}
+}
+
+// WithStop stops Extract from starting more media once stop is done, letting what already started
+// finish until the context of Extract is canceled. Extract then returns ErrInterrupted.
+func WithStop(stop context.Context) Option {
+	return func(e *extraction) {
+		e.stop = stop
+	}
+}
+
+// WithIncremental lists only until a page of media that is all in the index already, as the library
+// lists the newest media first. Such a listing is not complete, so orphans are left alone.
+func WithIncremental(enabled bool) Option {
+	return func(e *extraction) {
+		e.incremental = enabled
+	}
+}
+
+// SourcePicker marks index entries picked by the user through the Photos Picker API
+const SourcePicker = "picker"
+
+// WithSource records source in the index for the media Extract saves, such as SourcePicker, when
+// client is not the Library API. Such a listing is not the whole library, so orphans are left alone.
+func WithSource(source string) Option {
+	return func(e *extraction) {
+		e.source = source
+	}
+}
+
+// WithDuplicates sets the DuplicatePolicy, DuplicatesReport by default
+func WithDuplicates(policy DuplicatePolicy) Option {
+	return func(e *extraction) {
+		e.duplicates = policy
+	}
+}
+
+type extraction struct {
+	client     MediaService
+	store      storage.Storage
+	index      *Index
+	duplicates DuplicatePolicy
+	log        *slog.Logger
+
+	orphans       OrphanPolicy
+	confirmDelete int
+
+	// source is recorded in the index for media that does not come from the Library API
+	source       string
+	names        NameProfile
+	nameTemplate *NameTemplate
+
+	// budget is shared by the workers of Extract and the chunks of large downloads
+	budget         *pool
+	chunkThreshold int64
+	chunkSize      int64
+
+	// incremental ends the listing at a page of known media
+	incremental bool
+	// stop ends the scheduling of new media, the context of Extract aborts what is running
+	stop    context.Context
+	control *Controller
+	metrics *syncMetrics
+
+	dates         DatePolicy
+	writeMetadata bool
+	mu            sync.Mutex
+	discrepancies []Discrepancy
+	// claims are the files being written, by the ID of their media
+	claims map[string]string
+}
+
+func Extract(ctx context.Context, client MediaService, store storage.Storage, workerCount int, readOnly bool, options ...Option) error {
+	e := &extraction{client: client, store: store, duplicates: DuplicatesReport, dates: DatesAPI, log: slog.Default(), stop: context.Background(),
+		control: NewController(), metrics: newSyncMetrics(metrics.NewRegistry())}
+	for _, option := range options {
+		option(e)
+	}
+	e.budget = e.control.begin(workerCount)
+	defer e.control.end()
+	var err error
+	e.index, err = LoadIndex(store)
+	if err != nil {
+		return err
+	}
+
 	var total int64
+	var saved atomic.Int64
 	var nextPageToken string
-	for {
+	seen := map[string]bool{}
+	start, before := time.Now(), e.throughput()
+	interrupted, caughtUp := false, false
+	for !interrupted {
 		medias, err := client.List(ctx, nextPageToken)
 		if err != nil {
-			if errors.Is(err, context.Canceled) {
-				return nil
+			if ctx.Err() != nil {
+				interrupted = true
+				break
 			}
-			return fmt.Errorf("failed to get mediaitems: %s", err)
+			return fmt.Errorf("failed to get mediaitems: %w", err)
+		}
+		e.log.Info("listed", "items", len(medias.MediaItems), "more", len(medias.NextPageToken) > 0)
+		if e.incremental && e.known(medias.MediaItems) {
+			caughtUp = true
+			break
 		}
 		total += int64(len(medias.MediaItems))
-		fmt.Printf("%d items, has more %t\n", len(medias.MediaItems), len(medias.NextPageToken) > 0)
-		eg, ctx := errgroup.WithContext(ctx)
-		eg.SetLimit(workerCount)
+		e.control.listed(len(medias.MediaItems))
+		eg, pageCtx := errgroup.WithContext(ctx)
+		// waiting for a worker ends at the stop too
+		scheduling, cancel := context.WithCancel(pageCtx)
+		stopWaiting := context.AfterFunc(e.stop, cancel)
 		for _, media := range medias.MediaItems {
+			if e.stopping() {
+				break
+			}
+			if err := e.budget.acquire(scheduling); err != nil {
+				// stopped, or a worker failed
+				break
+			}
+			if e.stopping() {
+				// waited for a worker past the stop
+				e.budget.release()
+				break
+			}
 			media := *media
+			seen[media.ID] = true
 			eg.Go(func() error {
+				defer e.budget.release()
 				if readOnly {
-					fmt.Printf("%s/%s\n", buildPath(outputDir, media.Metadata.CreationTime), nameCleaner(media.Filename))
+					name, err := e.mediaPath(media)
+					if err != nil {
+						return err
+					}
+					e.log.Info("would write", "id", media.ID, "path", name)
 					return nil
 				}
-				return saveMedia(ctx, client, outputDir, media)
+				slot := e.control.working(media.ID, media.Filename)
+				start := time.Now()
+				err := e.saveMedia(pageCtx, media)
+				if err != nil && pageCtx.Err() != nil {
+					// aborted, or cut short by the failure of another worker
+					e.control.done(slot, nil, false)
+					return err
+				}
+				e.control.done(slot, err, true)
+				e.metrics.itemSeconds.Observe(time.Since(start).Seconds())
+				if err != nil {
+					e.metrics.items.Inc(outcomeFailed)
+					return err
+				}
+				saved.Add(1)
+				return nil
 			})
 		}
 		err = eg.Wait()
-		if err != nil {
+		stopWaiting()
+		cancel()
+		if !readOnly {
+			// a checkpoint, even when interrupted
+			if saveErr := e.index.Save(store); saveErr != nil && err == nil {
+				err = saveErr
+			}
+		}
+		interrupted = ctx.Err() != nil || e.stopping()
+		if err != nil && ctx.Err() == nil {
 			return err
 		}
+		e.reportThroughput(start, before)
 		nextPageToken = medias.NextPageToken
 		if nextPageToken == "" {
 			break
 		}
 	}
-	p := message.NewPrinter(language.English)
-	p.Printf("%d media processed\n", total)
+	if interrupted {
+		e.log.Warn("interrupted, run again to continue", "listed", total, "saved", saved.Load(), "resumable", e.countPartial(),
+			"aborted", ctx.Err() != nil)
+		return ErrInterrupted
+	}
+	if caughtUp {
+		e.log.Info("caught up with media saved before", "new", total)
+	} else if err := e.reconcile(seen, readOnly); err != nil {
+		return err
+	}
+	if !readOnly {
+		if err := e.index.Save(store); err != nil {
+			return err
+		}
+	}
+	if !readOnly {
+		e.metrics.lastSuccess.Set(float64(time.Now().Unix()))
+	}
+	e.reportDates()
+	e.log.Info("media processed", "count", total)
+	if groups := e.index.Duplicates(); len(groups) > 0 {
+		e.log.Info("media have duplicates, see the dupes command", "count", len(groups))
+	}
 	return nil
 }
 
-func saveMedia(ctx context.Context, client MediaService, outputDir string, mediaItem data.MediaItem) error {
-	f, closer, err := openFile(outputDir, mediaItem)
+// known is whether every item of a page is in the index already
+func (e *extraction) known(mediaItems []*data.MediaItem) bool {
+	for _, mediaItem := range mediaItems {
+		if _, ok := e.index.Lookup(mediaItem.ID); !ok {
+			return false
+		}
+	}
+	return len(mediaItems) > 0
+}
+
+// stopping is whether the stop of WithStop was requested, after which no more media is started
+func (e *extraction) stopping() bool {
+	return e.stop.Err() != nil
+}
+
+// saveMedia saves a listed item, deciding from the API error what a failure means for the run:
+// an expired baseUrl is renewed, media deleted since the listing is skipped, and running out of
+// quota or authorization stops the run with what to do about it
+func (e *extraction) saveMedia(ctx context.Context, mediaItem data.MediaItem) error {
+	err := e.saveListed(ctx, mediaItem)
+	if refresher, ok := e.client.(Refresher); ok && client.IsExpiredURL(err) {
+		e.log.Info("renewing expired baseUrl", "id", mediaItem.ID, "filename", mediaItem.Filename)
+		e.metrics.retries.Inc("expired_url")
+		var renewed *data.MediaItem
+		if renewed, err = refresher.Item(ctx, mediaItem.ID); err == nil {
+			err = e.saveListed(ctx, *renewed)
+		}
+	}
+	switch {
+	case err == nil:
+		return nil
+	case client.IsNotFound(err):
+		e.log.Warn("skipped, no longer in Google Photos", "id", mediaItem.ID, "filename", mediaItem.Filename, "err", err)
+		e.counted(outcomeSkipped)
+		return nil
+	case errors.Is(err, client.ErrPlaceholder):
+		e.log.Warn("skipped, the cassette did not record the media", "id", mediaItem.ID, "filename", mediaItem.Filename)
+		e.counted(outcomeSkipped)
+		return nil
+	case client.IsQuotaExceeded(err):
+		return fmt.Errorf("out of API quota, run again once it resets: %w", err)
+	case client.IsUnauthorized(err):
+		return fmt.Errorf("not authorized, delete token.json to sign in again: %w", err)
+	}
+	return err
+}
+
+// saveListed saves the item with the baseUrl it was listed with
+func (e *extraction) saveListed(ctx context.Context, mediaItem data.MediaItem) error {
+	d, resumable := e.client.(Downloader)
+	if _, ok := e.store.(storage.Appender); !ok || !resumable {
+		return e.save(mediaItem, fetchBytes(func() ([]byte, error) {
+			return e.client.Get(ctx, mediaItem)
+		}))
+	}
+	// interrupted downloads are kept to continue from, until the media is saved
+	downloaded := false
+	err := e.save(mediaItem, func() (io.ReadCloser, error) {
+		downloaded = true
+		return e.download(ctx, d, mediaItem)
+	})
+	if err == nil && downloaded {
+		e.removePartial(mediaItem)
+	}
+	return err
+}
+
+// fetchBytes makes a fetch for save of media read whole by get, which is called once however
+// often the media is read
+func fetchBytes(get func() ([]byte, error)) func() (io.ReadCloser, error) {
+	var content []byte
+	var err error
+	fetched := false
+	return func() (io.ReadCloser, error) {
+		if !fetched {
+			content, err = get()
+			fetched = true
+		}
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+}
+
+// save writes the media read from fetch, unless it is already saved. Each call of fetch reads the
+// media from its start, it is called a second time when the DatePolicy needs the contents to
+// place the media.
+func (e *extraction) save(mediaItem data.MediaItem, fetch func() (io.ReadCloser, error)) error {
+	entry, indexed := e.index.Lookup(mediaItem.ID)
+	if indexed && entry.DuplicateOf != "" && entry.Path == "" {
+		// an earlier run skipped this duplicate
+		e.counted(outcomeSkipped)
+		return nil
+	}
+	log := e.log.With("id", mediaItem.ID, "filename", mediaItem.Filename, "mime", mediaItem.MimeType)
+	start := time.Now()
+	apiTime := mediaItem.Metadata.CreationTime
+	candidates, err := e.candidates(mediaItem)
 	if err != nil {
-		if os.IsExist(err) {
-			return nil
-		} else {
+		return err
+	}
+	if e.dates != DatesAPI {
+		// where the media goes depends on its contents, so look where the index or the API time
+		// put it before fetching
+		if indexed && entry.Path != "" {
+			candidates = append([]string{entry.Path}, candidates...)
+		}
+		if err := findExisting(e.store, candidates, mediaItem); err != nil {
+			taken, cleanup, takenErr := e.nameTaken(mediaItem, err, &fetch)
+			defer cleanup()
+			if takenErr != nil {
+				return takenErr
+			}
+			if !taken {
+				return e.existing(mediaItem, err)
+			}
+		}
+		r, err := fetch()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", mediaItem.Filename, err)
+		}
+		embedded, _, found := embeddedTimeOf(r)
+		r.Close()
+		mediaItem.Metadata.CreationTime = e.dates.pick(apiTime, embedded, found)
+		placed, err := e.candidates(mediaItem)
+		if err != nil {
 			return err
 		}
+		candidates = append(placed, candidates...)
 	}
-	defer closer()
+	name := candidates[0]
+	f, closer, err := e.openFile(candidates, mediaItem)
+	taken, cleanup, takenErr := e.nameTaken(mediaItem, err, &fetch)
+	defer cleanup()
+	if takenErr != nil {
+		return takenErr
+	}
+	if taken {
+		// other media of the same name and month, this one gets a name of its own
+		distinct := e.distinctName(name, mediaItem.ID)
+		log.Warn("name taken by other media, saving under another name", "taken", name, "path", distinct)
+		name = distinct
+		f, closer, err = e.openFile([]string{name}, mediaItem)
+	}
+	if err != nil {
+		return e.existing(mediaItem, err)
+	}
+	// released once the index has the file
+	defer e.unclaim(name)
 
-	imgBytes, err := client.Get(ctx, mediaItem)
+	r, err := fetch()
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %v", mediaItem.Filename, err)
+		f.Close()
+		e.discard(name)
+		return fmt.Errorf("failed to read %s: %w", mediaItem.Filename, err)
 	}
-	count, err := f.Write(imgBytes)
+	count, sum, err := e.write(f, r, name, mediaItem, apiTime)
+	r.Close()
+	closeErr := closer()
 	if err != nil {
+		e.discard(name)
 		return fmt.Errorf("failed to write %s: %v", mediaItem.Filename, err)
 	}
-	fmt.Printf("wrote %s (%s) of %d\n", mediaItem.Filename, mediaItem.MimeType, count)
+	var timeErr *modTimeError
+	if errors.As(closeErr, &timeErr) {
+		// the contents are complete, fix-times can repair the time later
+		log.Warn("failed to set time, run fix-times", "path", name, "err", timeErr.err)
+	} else if closeErr != nil {
+		e.discard(name)
+		return fmt.Errorf("failed to write %s: %v", mediaItem.Filename, closeErr)
+	}
+	log.Info("wrote", "path", name, "bytes", count, "duration", time.Since(start))
+	e.control.wrote(count)
+	e.counted(outcomeDownloaded)
+
+	return e.dedupe(IndexEntry{
+		ID:     mediaItem.ID,
+		Path:   name,
+		SHA256: sum,
+		Size:   count,
+		Source: e.source,
+	})
+}
+
+// write copies the media from r to w, with its metadata added when writeMetadata, and returns
+// how much was written and its hash. The time embedded in it is checked against the API time
+// as it is copied.
+func (e *extraction) write(w io.Writer, r io.Reader, name string, mediaItem data.MediaItem, apiTime time.Time) (int64, string, error) {
+	pr, pw := io.Pipe()
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		e.crossCheck(name, apiTime, pr)
+		// the rest of the media is not needed
+		pr.Close()
+	}()
+	src := io.TeeReader(r, &bestEffort{w: pw})
+	hash := sha256.New()
+	var count byteCounter
+	dst := io.MultiWriter(w, hash, &count)
+	var err error
+	if e.writeMetadata {
+		err = e.embed(dst, src, name, mediaItem)
+	} else {
+		_, err = io.Copy(dst, src)
+	}
+	pw.CloseWithError(err)
+	<-checked
+	return int64(count), hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// bestEffort writes to w until it fails, and then accepts and drops what is written
+type bestEffort struct {
+	w   io.Writer
+	err error
+}
+
+func (b *bestEffort) Write(p []byte) (int, error) {
+	if b.err == nil {
+		_, b.err = b.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// counted records the outcome of media in the metrics and the progress of the sync
+func (e *extraction) counted(outcome string) {
+	e.metrics.items.Inc(outcome)
+	e.control.counted(outcome)
+}
+
+// discard removes a file save created but could not complete, so it is never mistaken for the media
+func (e *extraction) discard(name string) {
+	if err := e.store.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		e.log.Warn("failed to remove incomplete file", "path", name, "err", err)
+	}
+}
+
+// candidates are the paths the media may have been saved to, where it is saved first
+func (e *extraction) candidates(mediaItem data.MediaItem) ([]string, error) {
+	name, err := e.mediaPath(mediaItem)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []string{name}
+	if legacy := path.Join(path.Dir(name), legacyName(mediaItem.Filename)); e.nameTemplate == nil && legacy != name {
+		candidates = append(candidates, legacy)
+	}
+	return candidates, nil
+}
+
+// existing records media found already saved by openFile or findExisting, passing on other errors
+func (e *extraction) existing(mediaItem data.MediaItem, err error) error {
+	var existing *existingFile
+	if !errors.As(err, &existing) {
+		return err
+	}
+	e.counted(outcomeSkipped)
+	if _, ok := e.index.Lookup(mediaItem.ID); !ok {
+		// saved before the index existed
+		e.index.Add(IndexEntry{ID: mediaItem.ID, Path: existing.name, Source: e.source})
+	}
+	return nil
+}
+
+// nameTaken is true when err is a file saved for other media, so the media needs a name of its
+// own. A Takeout import may read the media to tell, replacing fetch; cleanup is to be called
+// once the media is saved.
+func (e *extraction) nameTaken(mediaItem data.MediaItem, err error, fetch *func() (io.ReadCloser, error)) (taken bool, cleanup func(), _ error) {
+	if e.source == SourceTakeout {
+		return e.takeoutCollides(mediaItem, err, fetch)
+	}
+	return e.collides(mediaItem, err), func() {}, nil
+}
+
+// collides is true when err is an *existingFile written, or being written, for other media.
+// Takeout ids name a file in an archive rather than the media, so media found under the same
+// name as a Takeout import is taken to be the same media; Takeout imports compare the contents
+// with takeoutCollides.
+func (e *extraction) collides(mediaItem data.MediaItem, err error) bool {
+	var existing *existingFile
+	if !errors.As(err, &existing) || e.source == SourceTakeout {
+		return false
+	}
+	owner := existing.owner
+	if entry, ok := e.index.LookupPath(existing.name); owner == "" && ok && entry.Source != SourceTakeout {
+		owner = entry.ID
+	}
+	return owner != "" && owner != mediaItem.ID
+}
+
+// distinctName is name made unique to the media with id, for media whose name is taken
+func (e *extraction) distinctName(name, id string) string {
+	ext := path.Ext(name)
+	return path.Join(path.Dir(name), e.nameCleaner(strings.TrimSuffix(path.Base(name), ext)+"_"+ShortID(id)+ext))
+}
+
+// dedupe records a saved file in the index and applies the DuplicatePolicy when its content was seen before
+func (e *extraction) dedupe(entry IndexEntry) error {
+	first, duplicate := e.index.Add(entry)
+	if !duplicate {
+		return nil
+	}
+	entry.DuplicateOf = first.ID
+	switch e.duplicates {
+	case DuplicatesSkip:
+		if err := e.store.Remove(entry.Path); err != nil {
+			return fmt.Errorf("failed to remove duplicate %s: %v", entry.Path, err)
+		}
+		e.log.Info("skipped duplicate", "id", entry.ID, "path", entry.Path, "duplicate_of", first.Path)
+		entry.Path = ""
+	case DuplicatesLink:
+		linker, ok := e.store.(storage.Linker)
+		if !ok || first.Path == "" {
+			e.log.Warn("kept duplicate, storage can not link", "id", entry.ID, "path", entry.Path, "duplicate_of", first.Path)
+			break
+		}
+		// the link takes the place of the copy only once it exists, so a failure keeps the copy
+		link := entry.Path + linkSuffix
+		e.discard(link)
+		if err := linker.Link(first.Path, link); err != nil {
+			e.log.Warn("kept duplicate, failed to link", "id", entry.ID, "path", entry.Path, "duplicate_of", first.Path, "err", err)
+			break
+		}
+		if err := e.store.Rename(link, entry.Path); err != nil {
+			e.discard(link)
+			e.log.Warn("kept duplicate, failed to link", "id", entry.ID, "path", entry.Path, "duplicate_of", first.Path, "err", err)
+			break
+		}
+		e.log.Info("linked duplicate", "id", entry.ID, "path", entry.Path, "duplicate_of", first.Path)
+	default:
+		e.log.Info("wrote duplicate", "id", entry.ID, "path", entry.Path, "duplicate_of", first.Path)
+	}
+	e.index.Update(entry)
+	return nil
+}
+
+// linkSuffix marks a link to the first copy of duplicated content, until it replaces the duplicate
+const linkSuffix = ".link"
+
+// existingFile is returned by openFile when the media was already written, possibly by an
+// earlier version under a legacy name
+type existingFile struct {
+	name string
+	// owner is the ID of other media being written to name
+	owner string
+}
+
+func (e *existingFile) Error() string { return fs.ErrExist.Error() + ": " + e.name }
+func (e *existingFile) Unwrap() error { return fs.ErrExist }
 
+// modTimeError is returned by the closer of openFile when the contents were written but
+// the time could not be set
+type modTimeError struct {
+	err error
+}
+
+func (e *modTimeError) Error() string { return "failed to set modification time: " + e.err.Error() }
+func (e *modTimeError) Unwrap() error { return e.err }
+
+// findExisting returns an *existingFile for the first of candidates that has contents
+func findExisting(store storage.Storage, candidates []string, mediaItem data.MediaItem) error {
+	for _, candidate := range candidates {
+		info, err := store.Stat(candidate)
+		if err == nil && info.Size() > 0 {
+			//if file has contents, assume it's complete. future support could confirm mimetype == mediaItem
+			return &existingFile{name: candidate}
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to determine if existing file was empty (%s): %+v", mediaItem.Filename, err)
+		}
+	}
 	return nil
 }
 
-func openFile(outputDir string, mediaItem data.MediaItem) (*os.File, func(), error) {
-	emptyCloser := func() {}
-	filePath := buildPath(outputDir, mediaItem.Metadata.CreationTime)
-	err := os.MkdirAll(filePath, os.ModePerm)
+// openFile creates the first of candidates, unless one of them already has contents. The file
+// is claimed for the media until unclaim, so other media of the same name finds it taken even
+// while it is still empty. The returned closer closes the file and sets its time to the
+// creation time of the media.
+func (e *extraction) openFile(candidates []string, mediaItem data.MediaItem) (io.WriteCloser, func() error, error) {
+	emptyCloser := func() error { return nil }
+	store, name := e.store, candidates[0]
+	err := store.MkdirAll(path.Dir(name))
 	if err != nil {
 		return nil, emptyCloser, fmt.Errorf("failed to create directory structure for media: %+v", err)
 	}
-	cleanName := nameCleaner(mediaItem.Filename)
-	f, err := os.OpenFile(fmt.Sprintf("%s/%s", filePath, cleanName), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
-	if err != nil {
-		if os.IsExist(err) {
-			info, err := os.Stat(fmt.Sprintf("%s/%s", filePath, cleanName))
-			if err != nil {
-				return nil, emptyCloser, fmt.Errorf("failed to determine if existing file was empty (%s): %+v", mediaItem.Filename, err)
-			}
-			if info.Size() > 0 {
-				//if file has contents, assume it's complete. future support could confirm mimetype == mediaItem
-				return nil, emptyCloser, os.ErrExist
-			}
-			f, _ = os.OpenFile(fmt.Sprintf("%s/%s", filePath, mediaItem.Filename), os.O_CREATE|os.O_WRONLY, 0666)
-		} else {
-			return nil, emptyCloser, fmt.Errorf("failed to open file for media item %+v: %+v", mediaItem, err)
+	if err := findExisting(store, candidates, mediaItem); err != nil {
+		return nil, emptyCloser, err
+	}
+	if owner, ok := e.claim(name, mediaItem.ID); !ok {
+		return nil, emptyCloser, &existingFile{name: name, owner: owner}
+	}
+	f, err := store.CreateExclusive(name)
+	if errors.Is(err, fs.ErrExist) {
+		// written since findExisting by another process, or left empty by an interrupted run
+		if err := findExisting(store, candidates[:1], mediaItem); err != nil {
+			e.unclaim(name)
+			return nil, emptyCloser, err
 		}
+		f, err = store.Create(name)
+	}
+	if err != nil {
+		e.unclaim(name)
+		return nil, emptyCloser, fmt.Errorf("failed to open file for media item %+v: %+v", mediaItem, err)
 	}
 
-	return f, func() {
-		f.Close()
-		os.Chtimes(fmt.Sprintf("%s/%s", filePath, cleanName), mediaItem.Metadata.CreationTime, mediaItem.Metadata.CreationTime)
+	return f, func() error {
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := store.SetModTime(name, mediaItem.Metadata.CreationTime); err != nil {
+			return &modTimeError{err: err}
+		}
+		return nil
 	}, nil
 }
-func nameCleaner(input string) string {
-	output := strings.ReplaceAll(input, " ", "_")
-	output = strings.ReplaceAll(input, "/", "_")
-	return output
+
+// claim reserves name for the media with id, false with the ID of the other media being written to it
+func (e *extraction) claim(name, id string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.claims == nil {
+		e.claims = map[string]string{}
+	}
+	if owner, ok := e.claims[name]; ok && owner != id {
+		return owner, false
+	}
+	e.claims[name] = id
+	return id, true
+}
+
+func (e *extraction) unclaim(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.claims, name)
+}
+
+// mediaPath is where the media is written, relative to the storage root
+func (e *extraction) mediaPath(mediaItem data.MediaItem) (string, error) {
+	filename := mediaItem.Filename
+	if e.nameTemplate != nil {
+		var err error
+		filename, err = e.nameTemplate.Execute(mediaItem)
+		if err != nil {
+			return "", err
+		}
+	}
+	return path.Join(buildPath(mediaItem.Metadata.CreationTime), e.nameCleaner(filename)), nil
 }
 
-// buildPath returns the path where the media should be written
-func buildPath(outputDir string, createdAt time.Time) string {
+// buildPath returns the directory, relative to the storage root, where the media should be written
+func buildPath(createdAt time.Time) string {
 	year := createdAt.Year()
 	month := createdAt.Month()
-	return fmt.Sprintf("%s/%d/%02d", outputDir, year, month)
+	return fmt.Sprintf("%d/%02d", year, month)
 }
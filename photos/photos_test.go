@@ -1,50 +1,93 @@
 package photos_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/client"
 	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/metadata"
+	"velocitizer.com/photogo/metrics"
 	"velocitizer.com/photogo/photos"
 	"velocitizer.com/photogo/photos/mocks"
+	"velocitizer.com/photogo/photos/photostest"
+	"velocitizer.com/photogo/storage"
 )
 
+// mediaWrites are the media files written to store, leaving out photogo's own bookkeeping
+func mediaWrites(store *storage.Memory) []string {
+	var names []string
+	for _, name := range store.Writes() {
+		if !strings.HasPrefix(name, ".photogo/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// waitFor polls condition until it holds, failing the test after a second. It stands in for
+// require.Eventually, whose ticker goroutine may outlive the call and panic.
+func waitFor(t *testing.T, condition func() bool, msgAndArgs ...any) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "condition never held", msgAndArgs...)
+		}
+	}
+}
+
 //go:generate mockery --name=MediaService
 func Test_Extract(t *testing.T) {
 	t.Run("empty response exists", func(t *testing.T) {
+		t.Parallel()
 		ctx := context.WithValue(context.Background(), "verify the same ctx", "value")
 		service := new(mocks.MediaService)
 
 		service.On("List", ctx, "").Return(&data.MediaResponse{}, nil)
 
-		err := photos.Extract(ctx, service, "testdata", 1, false)
+		err := photos.Extract(ctx, service, storage.NewMemory(), 1, false)
 
 		assert.NoError(t, err)
 	})
 
 	t.Run("empty response exists", func(t *testing.T) {
+		t.Parallel()
 		service := new(mocks.MediaService)
 
 		service.On("List", context.Background(), "").Return(nil, errors.New("list fails"))
 
-		err := photos.Extract(context.Background(), service, "testdata", 4, false)
+		err := photos.Extract(context.Background(), service, storage.NewMemory(), 4, false)
 		assert.Error(t, err)
 	})
 
 	t.Run("existing media on disk is skipped", func(t *testing.T) {
-		defer func() {
-			require.NoError(t, os.RemoveAll("testdata/2021"))
-		}()
+		t.Parallel()
 		mediaTime, err := time.Parse(time.RFC3339, "2009-05-13T15:04:05Z")
 		require.NoError(t, err)
+		store := storage.NewMemory()
+		require.NoError(t, store.WriteFile("2009/05/sample.txt", []byte("written by an earlier run"), mediaTime))
 
 		service := new(mocks.MediaService)
+		service.Test(t)
 
 		item := &data.MediaItem{
 			ID:       "doesn't matter",
@@ -61,26 +104,54 @@ func Test_Extract(t *testing.T) {
 			},
 		}, nil)
 
-		err = photos.Extract(context.Background(), service, "testdata", 2, false)
+		err = photos.Extract(context.Background(), service, store, 2, false)
 		assert.NoError(t, err)
+		service.AssertNotCalled(t, "Get")
+		assert.Empty(t, mediaWrites(store))
 	})
-	t.Run("cancelled context returns nil", func(t *testing.T) {
-		defer func() {
-			require.NoError(t, os.RemoveAll("testdata/2021"))
-		}()
+	t.Run("existing empty media is downloaded again", func(t *testing.T) {
+		t.Parallel()
+		mediaTime, err := time.Parse(time.RFC3339, "2009-05-13T15:04:05Z")
+		require.NoError(t, err)
+		store := storage.NewMemory()
+		require.NoError(t, store.WriteFile("2009/05/sample.jpg", nil, time.Now()))
+
+		service := new(mocks.MediaService)
+		item := &data.MediaItem{
+			ID:       "doesn't matter",
+			Filename: "sample.jpg",
+			MimeType: "image/jpeg",
+			Metadata: data.MediaMetadata{
+				CreationTime: mediaTime,
+			},
+		}
+		service.On("List", context.Background(), "").Return(&data.MediaResponse{
+			MediaItems: []*data.MediaItem{item},
+		}, nil)
+		service.On("Get", mock.Anything, *item).Return([]byte("foo"), nil)
 
+		err = photos.Extract(context.Background(), service, store, 2, false)
+		assert.NoError(t, err)
+		contents, err := store.ReadFile("2009/05/sample.jpg")
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(contents))
+	})
+	t.Run("cancelled context is an interruption", func(t *testing.T) {
+		t.Parallel()
 		service := new(mocks.MediaService)
 
 		ctx, cancel := context.WithCancel(context.Background())
 		service.On("List", ctx, "").Return(&data.MediaResponse{}, context.Canceled)
 		cancel()
-		err := photos.Extract(ctx, service, "testdata", 2, false)
-		assert.NoError(t, err)
+		err := photos.Extract(ctx, service, storage.NewMemory(), 2, false)
+		assert.True(t, errors.Is(err, photos.ErrInterrupted), "got %v", err)
 	})
 
 	t.Run("read only does not save", func(t *testing.T) {
+		t.Parallel()
 		mediaTime, err := time.Parse(time.RFC3339, "2021-09-13T15:04:05Z")
 		require.NoError(t, err)
+		store := storage.NewMemory()
 
 		service := new(mocks.MediaService)
 
@@ -100,16 +171,16 @@ func Test_Extract(t *testing.T) {
 		}, nil)
 		service.On("Get", mock.Anything, *item).Return([]byte("foo"), nil)
 
-		err = photos.Extract(context.Background(), service, "testdata", 2, true)
+		err = photos.Extract(context.Background(), service, store, 2, true)
 		assert.NoError(t, err)
 		service.AssertNotCalled(t, "Get")
+		assert.Empty(t, mediaWrites(store))
 	})
 	t.Run("media is passed to save", func(t *testing.T) {
-		defer func() {
-			require.NoError(t, os.RemoveAll("testdata/2021"))
-		}()
+		t.Parallel()
 		mediaTime, err := time.Parse(time.RFC3339, "2021-09-13T15:04:05Z")
 		require.NoError(t, err)
+		store := storage.NewMemory()
 
 		service := new(mocks.MediaService)
 
@@ -129,17 +200,22 @@ func Test_Extract(t *testing.T) {
 		}, nil)
 		service.On("Get", mock.Anything, *item).Return([]byte("foo"), nil)
 
-		err = photos.Extract(context.Background(), service, "testdata", 2, false)
+		err = photos.Extract(context.Background(), service, store, 2, false)
 		assert.NoError(t, err)
-		assert.FileExists(t, "./testdata/2021/09/foomedia.jpg")
+		contents, err := store.ReadFile("2021/09/foomedia.jpg")
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(contents))
+		info, err := store.Stat("2021/09/foomedia.jpg")
+		require.NoError(t, err)
+		assert.True(t, mediaTime.Equal(info.ModTime()), "modtime is the creation time, got %s", info.ModTime())
+		assert.Equal(t, []string{"2021/09/foomedia.jpg"}, mediaWrites(store))
 	})
 
 	t.Run("media with weird filename passed to save", func(t *testing.T) {
-		defer func() {
-			require.NoError(t, os.RemoveAll("testdata/2014"))
-		}()
+		t.Parallel()
 		mediaTime, err := time.Parse(time.RFC3339, "2014-07-21T15:04:05Z")
 		require.NoError(t, err)
+		store := storage.NewMemory()
 
 		service := new(mocks.MediaService)
 
@@ -159,14 +235,51 @@ func Test_Extract(t *testing.T) {
 		}, nil)
 		service.On("Get", mock.Anything, *item).Return([]byte("foo"), nil)
 
-		err = photos.Extract(context.Background(), service, "testdata", 2, false)
+		err = photos.Extract(context.Background(), service, store, 2, false)
+		assert.NoError(t, err)
+		assert.Len(t, mediaWrites(store), 1)
+		for _, name := range mediaWrites(store) {
+			assert.Regexp(t, `^2014/07/[^/]+$`, name)
+		}
+	})
+
+	t.Run("colliding filenames in a month get names of their own", func(t *testing.T) {
+		t.Parallel()
+		mediaTime, err := time.Parse(time.RFC3339, "2021-10-13T15:04:05Z")
+		require.NoError(t, err)
+		store := storage.NewMemory()
+
+		service := new(mocks.MediaService)
+		first := &data.MediaItem{ID: "first", Filename: "image.png", MimeType: "image/png", Metadata: data.MediaMetadata{CreationTime: mediaTime}}
+		second := &data.MediaItem{ID: "second", Filename: "image.png", MimeType: "image/png", Metadata: data.MediaMetadata{CreationTime: mediaTime.Add(time.Hour)}}
+		service.On("List", context.Background(), "").Return(&data.MediaResponse{
+			MediaItems: []*data.MediaItem{first, second},
+		}, nil)
+		service.On("Get", mock.Anything, *first).Return([]byte("first"), nil)
+		service.On("Get", mock.Anything, *second).Return([]byte("second"), nil)
+
+		err = photos.Extract(context.Background(), service, store, 1, false)
+		assert.NoError(t, err)
+		contents, err := store.ReadFile("2021/10/image.png")
+		require.NoError(t, err)
+		assert.Equal(t, "first", string(contents))
+		distinct := "2021/10/image_" + photos.ShortID("second") + ".png"
+		contents, err = store.ReadFile(distinct)
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(contents))
+		index, err := photos.LoadIndex(store)
+		require.NoError(t, err)
+		entry, ok := index.Lookup("second")
+		require.True(t, ok)
+		assert.Equal(t, distinct, entry.Path)
+
+		err = photos.Extract(context.Background(), service, store, 1, false)
 		assert.NoError(t, err)
+		service.AssertNumberOfCalls(t, "Get", 2)
 	})
 
 	t.Run("loop twice and exit", func(t *testing.T) {
-		defer func() {
-			require.NoError(t, os.RemoveAll("testdata/2021"))
-		}()
+		t.Parallel()
 		service := new(mocks.MediaService)
 		service.Test(t)
 
@@ -193,8 +306,1473 @@ func Test_Extract(t *testing.T) {
 		}, nil).Once()
 		service.On("Get", mock.Anything, *item).Return([]byte("foo"), nil)
 
-		err = photos.Extract(context.Background(), service, "testdata", 3, false)
+		err = photos.Extract(context.Background(), service, storage.NewMemory(), 3, false)
 		assert.NoError(t, err)
 		service.AssertExpectations(t)
 	})
 }
+
+func Test_Extract_EndToEnd(t *testing.T) {
+	library := func() []photostest.Item {
+		var items []photostest.Item
+		for i := 0; i < 30; i++ {
+			items = append(items, photostest.Item{
+				MediaItem: data.MediaItem{
+					ID:       fmt.Sprintf("id-%d", i),
+					Filename: fmt.Sprintf("IMG_%04d.JPG", i),
+					MimeType: "image/jpeg",
+					Metadata: data.MediaMetadata{CreationTime: time.Date(2021, time.Month(i%12+1), 13, 15, 4, 5, 0, time.UTC)},
+				},
+				Content: []byte(fmt.Sprintf("image %d", i)),
+			})
+		}
+		items = append(items, photostest.Item{
+			MediaItem: data.MediaItem{
+				ID:       "video",
+				Filename: "PXL_0001.mp4",
+				MimeType: "video/mp4",
+				Metadata: data.MediaMetadata{CreationTime: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)},
+			},
+			Content: bytes.Repeat([]byte("v"), 10_000),
+		})
+		return items
+	}
+	extract := func(server *photostest.Server, store storage.Storage) error {
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		return photos.Extract(context.Background(), c, store, 4, false)
+	}
+
+	t.Run("whole library is written with timestamps", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		store := storage.NewMemory()
+
+		require.NoError(t, extract(server, store))
+		assert.Len(t, mediaWrites(store), 31)
+		assert.Equal(t, 2, server.Hits(photostest.List))
+		contents, err := store.ReadFile("2022/01/PXL_0001.mp4")
+		require.NoError(t, err)
+		assert.Len(t, contents, 10_000)
+		info, err := store.Stat("2021/03/IMG_0002.JPG")
+		require.NoError(t, err)
+		assert.True(t, time.Date(2021, 3, 13, 15, 4, 5, 0, time.UTC).Equal(info.ModTime()))
+
+		require.NoError(t, extract(server, store), "a second run")
+		assert.Len(t, mediaWrites(store), 31, "nothing is downloaded again")
+	})
+	t.Run("list failure fails the run", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.List, Status: http.StatusServiceUnavailable})
+
+		assert.Error(t, extract(server, storage.NewMemory()))
+	})
+	t.Run("quota exhaustion fails the run", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, Status: http.StatusTooManyRequests, Times: 1})
+
+		err := extract(server, storage.NewMemory())
+		assert.True(t, client.IsQuotaExceeded(err), "got %v", err)
+	})
+	t.Run("revoked access fails the run", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.List, Status: http.StatusUnauthorized})
+
+		err := extract(server, storage.NewMemory())
+		assert.True(t, client.IsUnauthorized(err), "got %v", err)
+	})
+	t.Run("expired baseUrls are renewed", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, Status: http.StatusForbidden, Times: 1})
+		store := storage.NewMemory()
+
+		require.NoError(t, extract(server, store))
+		assert.Equal(t, 1, server.Hits(photostest.GetItem))
+		for _, name := range mediaWrites(store) {
+			info, err := store.Stat(name)
+			require.NoError(t, err)
+			assert.NotZero(t, info.Size(), name)
+		}
+	})
+	t.Run("media deleted since the listing is skipped", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, Status: http.StatusNotFound, Times: 1})
+		store := storage.NewMemory()
+
+		require.NoError(t, extract(server, store))
+		var saved int
+		for _, name := range mediaWrites(store) {
+			if info, err := store.Stat(name); err == nil && info.Size() > 0 {
+				saved++
+			}
+		}
+		assert.Equal(t, 30, saved)
+	})
+	t.Run("expired baseUrls fail the download", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		page, err := c.List(context.Background(), "")
+		require.NoError(t, err)
+		server.ExpireURLs()
+
+		_, err = c.Get(context.Background(), *page.MediaItems[0])
+		assert.Error(t, err)
+	})
+	t.Run("truncated bodies fail the download", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, TruncateAfter: 100})
+
+		assert.Error(t, extract(server, storage.NewMemory()))
+	})
+	t.Run("slow bodies are abandoned when the context ends", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library()...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, Delay: time.Second})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		assert.Error(t, photos.Extract(ctx, c, storage.NewMemory(), 4, false))
+	})
+}
+
+func Test_Extract_Duplicates(t *testing.T) {
+	created := time.Date(2021, 9, 13, 15, 4, 5, 0, time.UTC)
+	library := []photostest.Item{
+		{MediaItem: data.MediaItem{ID: "a", Filename: "IMG_0001.JPG", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: created}}, Content: []byte("same bytes")},
+		{MediaItem: data.MediaItem{ID: "b", Filename: "image.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: created.AddDate(1, 0, 0)}}, Content: []byte("same bytes")},
+		{MediaItem: data.MediaItem{ID: "c", Filename: "other.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: created}}, Content: []byte("other bytes")},
+	}
+	extract := func(t *testing.T, server *photostest.Server, store storage.Storage, policy photos.DuplicatePolicy) {
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		// one worker so "a" is always the first copy
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithDuplicates(policy)))
+	}
+	duplicates := func(t *testing.T, store storage.Storage) []photos.DuplicateGroup {
+		idx, err := photos.LoadIndex(store)
+		require.NoError(t, err)
+		return idx.Duplicates()
+	}
+
+	t.Run("report writes every copy", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		store := storage.NewMemory()
+
+		extract(t, server, store, photos.DuplicatesReport)
+		assert.Len(t, mediaWrites(store), 3)
+		groups := duplicates(t, store)
+		require.Len(t, groups, 1)
+		require.Len(t, groups[0].Entries, 2)
+		assert.Equal(t, "a", groups[0].Entries[0].ID)
+		assert.Equal(t, "2021/09/IMG_0001.JPG", groups[0].Entries[0].Path)
+		assert.Equal(t, "b", groups[0].Entries[1].ID)
+		assert.Equal(t, "2022/09/image.jpg", groups[0].Entries[1].Path)
+	})
+	t.Run("skip keeps the first copy, across runs", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		store := storage.NewMemory()
+
+		extract(t, server, store, photos.DuplicatesSkip)
+		_, err := store.Stat("2022/09/image.jpg")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+		groups := duplicates(t, store)
+		require.Len(t, groups, 1)
+		assert.Empty(t, groups[0].Entries[1].Path)
+
+		extract(t, server, store, photos.DuplicatesSkip)
+		assert.Equal(t, 3, server.Hits(photostest.Content), "the skipped duplicate is not downloaded again")
+	})
+	t.Run("link points at the first copy", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		store := storage.NewMemory()
+
+		extract(t, server, store, photos.DuplicatesLink)
+		contents, err := store.ReadFile("2022/09/image.jpg")
+		require.NoError(t, err)
+		assert.Equal(t, "same bytes", string(contents))
+		info, err := store.Stat("2022/09/image.jpg")
+		require.NoError(t, err)
+		assert.True(t, created.Equal(info.ModTime()), "a link shares the first copy's time")
+	})
+	t.Run("a failed link keeps the copy", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		store := failingLinker{storage.NewMemory()}
+
+		extract(t, server, store, photos.DuplicatesLink)
+		contents, err := store.ReadFile("2022/09/image.jpg")
+		require.NoError(t, err)
+		assert.Equal(t, "same bytes", string(contents))
+		groups := duplicates(t, store)
+		require.Len(t, groups, 1)
+		assert.Equal(t, "2022/09/image.jpg", groups[0].Entries[1].Path)
+	})
+	t.Run("unknown policy", func(t *testing.T) {
+		_, err := photos.ParseDuplicatePolicy("delete")
+		assert.Error(t, err)
+	})
+}
+
+// failingLinker is storage whose links fail
+type failingLinker struct {
+	*storage.Memory
+}
+
+func (failingLinker) Link(oldName, newName string) error {
+	return &fs.PathError{Op: "link", Path: newName, Err: errors.New("links are not supported")}
+}
+
+func Test_Extract_Orphans(t *testing.T) {
+	created := time.Date(2021, 9, 13, 15, 4, 5, 0, time.UTC)
+	library := []photostest.Item{
+		{MediaItem: data.MediaItem{ID: "keep", Filename: "keep.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: created}}, Content: []byte("keep")},
+		{MediaItem: data.MediaItem{ID: "junk", Filename: "junk.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: created}}, Content: []byte("junk")},
+	}
+	// setup syncs the library, then deletes junk from Google Photos
+	setup := func(t *testing.T) (*photostest.Server, *storage.Memory, *client.Client) {
+		server := photostest.NewServer(library...)
+		t.Cleanup(server.Close)
+		store := storage.NewMemory()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false))
+		server.RemoveItems("junk")
+		return server, store, c
+	}
+	exists := func(store storage.Storage, name string) bool {
+		_, err := store.Stat(name)
+		return err == nil
+	}
+
+	t.Run("keep is the default", func(t *testing.T) {
+		t.Parallel()
+		_, store, c := setup(t)
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false))
+		assert.True(t, exists(store, "2021/09/junk.jpg"))
+	})
+	t.Run("report leaves files in place", func(t *testing.T) {
+		t.Parallel()
+		_, store, c := setup(t)
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansReport)))
+		assert.True(t, exists(store, "2021/09/junk.jpg"))
+	})
+	t.Run("trash quarantines by date", func(t *testing.T) {
+		t.Parallel()
+		_, store, c := setup(t)
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansTrash)))
+		assert.False(t, exists(store, "2021/09/junk.jpg"))
+		assert.True(t, exists(store, "2021/09/keep.jpg"))
+		days, err := store.List(photos.TrashDir)
+		require.NoError(t, err)
+		require.Len(t, days, 1)
+		contents, err := store.ReadFile(photos.TrashDir + "/" + days[0].Name() + "/2021/09/junk.jpg")
+		require.NoError(t, err)
+		assert.Equal(t, "junk", string(contents))
+
+		idx, err := photos.LoadIndex(store)
+		require.NoError(t, err)
+		_, ok := idx.Lookup("junk")
+		assert.False(t, ok, "the orphan is forgotten")
+	})
+	t.Run("trashing the same path twice a day keeps both", func(t *testing.T) {
+		t.Parallel()
+		server, store, c := setup(t)
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansTrash)))
+		server.AddItems(photostest.Item{MediaItem: data.MediaItem{ID: "other", Filename: "junk.jpg", MimeType: "image/jpeg",
+			Metadata: data.MediaMetadata{CreationTime: created}}, Content: []byte("other junk")})
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false))
+		server.RemoveItems("other")
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansTrash)))
+
+		days, err := store.List(photos.TrashDir)
+		require.NoError(t, err)
+		require.Len(t, days, 1)
+		day := photos.TrashDir + "/" + days[0].Name() + "/2021/09/"
+		for name, want := range map[string]string{"junk.jpg": "junk", "junk_" + photos.ShortID("other") + ".jpg": "other junk"} {
+			contents, err := store.ReadFile(day + name)
+			require.NoError(t, err)
+			assert.Equal(t, want, string(contents), name)
+		}
+	})
+	t.Run("read only only reports", func(t *testing.T) {
+		t.Parallel()
+		_, store, c := setup(t)
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, true, photos.WithOrphans(photos.OrphansTrash)))
+		assert.True(t, exists(store, "2021/09/junk.jpg"))
+	})
+	t.Run("delete needs the orphan count confirmed", func(t *testing.T) {
+		t.Parallel()
+		_, store, c := setup(t)
+		err := photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansDelete))
+		assert.Error(t, err)
+		assert.True(t, exists(store, "2021/09/junk.jpg"))
+		err = photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansDelete), photos.WithDeleteConfirmation(2))
+		assert.Error(t, err, "a count that does not match is no confirmation")
+		assert.True(t, exists(store, "2021/09/junk.jpg"))
+
+		err = photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansDelete), photos.WithDeleteConfirmation(1))
+		require.NoError(t, err)
+		assert.False(t, exists(store, "2021/09/junk.jpg"))
+		assert.True(t, exists(store, "2021/09/keep.jpg"))
+	})
+	t.Run("an empty library is not mirrored", func(t *testing.T) {
+		t.Parallel()
+		server, store, c := setup(t)
+		server.RemoveItems("keep")
+		err := photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansTrash))
+		assert.Error(t, err)
+		assert.True(t, exists(store, "2021/09/keep.jpg"))
+	})
+	t.Run("a cancelled listing is not reconciled", func(t *testing.T) {
+		t.Parallel()
+		_, store, _ := setup(t)
+		service := new(mocks.MediaService)
+		ctx, cancel := context.WithCancel(context.Background())
+		service.On("List", ctx, "").Return(nil, context.Canceled)
+		cancel()
+		err := photos.Extract(ctx, service, store, 2, false, photos.WithOrphans(photos.OrphansTrash))
+		assert.True(t, errors.Is(err, photos.ErrInterrupted), "got %v", err)
+		assert.True(t, exists(store, "2021/09/junk.jpg"))
+	})
+}
+
+func Test_Index(t *testing.T) {
+	t.Run("removing the first copy promotes the next", func(t *testing.T) {
+		idx := photos.NewIndex()
+		idx.Add(photos.IndexEntry{ID: "a", Path: "a.jpg", SHA256: "hash"})
+		idx.Add(photos.IndexEntry{ID: "b", Path: "b.jpg", SHA256: "hash"})
+		idx.Add(photos.IndexEntry{ID: "c", Path: "c.jpg", SHA256: "hash"})
+		idx.Add(photos.IndexEntry{ID: "old", Path: "old.jpg"})
+		require.Len(t, idx.Duplicates(), 1)
+
+		idx.Remove("a")
+		groups := idx.Duplicates()
+		require.Len(t, groups, 1)
+		assert.Equal(t, "b", groups[0].Entries[0].ID)
+		assert.Equal(t, "c", groups[0].Entries[1].ID)
+		assert.Equal(t, "b", groups[0].Entries[1].DuplicateOf)
+
+		idx.Remove("b")
+		assert.Empty(t, idx.Duplicates())
+		entry, ok := idx.Lookup("c")
+		assert.True(t, ok)
+		assert.Empty(t, entry.DuplicateOf)
+	})
+	t.Run("round trips through storage", func(t *testing.T) {
+		store := storage.NewMemory()
+		idx := photos.NewIndex()
+		idx.Add(photos.IndexEntry{ID: "a", Path: "a.jpg", SHA256: "hash", Size: 3})
+		require.NoError(t, idx.Save(store))
+
+		loaded, err := photos.LoadIndex(store)
+		require.NoError(t, err)
+		entry, ok := loaded.Lookup("a")
+		assert.True(t, ok)
+		assert.Equal(t, photos.IndexEntry{ID: "a", Path: "a.jpg", SHA256: "hash", Size: 3}, entry)
+	})
+}
+
+func Test_ImportTakeout(t *testing.T) {
+	taken := func(month int) time.Time {
+		return time.Date(2019, time.Month(month), 1, 12, 0, 0, 0, time.UTC)
+	}
+	sidecarJSON := func(title string, at time.Time) []byte {
+		return []byte(fmt.Sprintf(`{"title":%q,"photoTakenTime":{"timestamp":"%d"},"creationTime":{"timestamp":"1600000000"}}`, title, at.Unix()))
+	}
+	const dir = "Takeout/Google Photos/Photos from 2019/"
+	const long = "a_very_long_filename_from_some_messaging_app_2019.jpg"
+	first := map[string][]byte{
+		dir + "IMG_0001.JPG":                            []byte("one"),
+		dir + "IMG_0001.JPG.json":                       sidecarJSON("IMG_0001.JPG", taken(6)),
+		dir + "IMG_0002(1).JPG":                         []byte("two"),
+		dir + "IMG_0002.JPG(1).json":                    sidecarJSON("IMG_0002.JPG", taken(7)),
+		dir + "IMG_0003.JPG":                            []byte("three"),
+		dir + "IMG_0003-edited.JPG":                     []byte("three edited"),
+		dir + "IMG_0003.JPG.json":                       sidecarJSON("IMG_0003.JPG", taken(8)),
+		dir + long[:46] + ".json":                       sidecarJSON(long, taken(9)),
+		dir + "PXL_0004.mp4.supplemental-metadata.json": sidecarJSON("PXL_0004.mp4", taken(10)),
+		dir + "orphan.jpg":                              []byte("no sidecar"),
+		"Takeout/Google Photos/Trip/metadata.json":      []byte(`{"title":"Trip","description":""}`),
+	}
+	// split archives put media and sidecars in different files
+	second := map[string][]byte{
+		dir + long:           []byte("long"),
+		dir + "PXL_0004.mp4": []byte("video"),
+		"Takeout/Google Photos/Trip/IMG_0001.JPG":      []byte("one"),
+		"Takeout/Google Photos/Trip/IMG_0001.JPG.json": sidecarJSON("IMG_0001.JPG", taken(6)),
+	}
+	archives := []string{writeZip(t, first), writeTgz(t, second)}
+
+	store := storage.NewMemory()
+	require.NoError(t, photos.ImportTakeout(context.Background(), store, archives))
+
+	expected := map[string]string{
+		"2019/06/IMG_0001.JPG":        "one",
+		"2019/07/IMG_0002.JPG":        "two",
+		"2019/08/IMG_0003.JPG":        "three",
+		"2019/08/IMG_0003-edited.JPG": "three edited",
+		"2019/09/" + long:             "long",
+		"2019/10/PXL_0004.mp4":        "video",
+	}
+	assert.ElementsMatch(t, keys(expected), mediaWrites(store))
+	for name, want := range expected {
+		contents, err := store.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(contents), name)
+	}
+	info, err := store.Stat("2019/10/PXL_0004.mp4")
+	require.NoError(t, err)
+	assert.True(t, taken(10).Equal(info.ModTime()), "photoTakenTime is the file time, got %s", info.ModTime())
+
+	t.Run("importing again writes nothing", func(t *testing.T) {
+		c := photos.NewController()
+		require.NoError(t, photos.ImportTakeout(context.Background(), store, archives, photos.WithController(c)))
+		assert.Zero(t, c.Status().Progress.Saved)
+		assert.Equal(t, int64(7), c.Status().Progress.Skipped)
+	})
+	t.Run("an API sync of the same library finds everything in place", func(t *testing.T) {
+		server := photostest.NewServer(
+			photostest.Item{MediaItem: data.MediaItem{ID: "1", Filename: "IMG_0001.JPG", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: taken(6)}}, Content: []byte("one")},
+			photostest.Item{MediaItem: data.MediaItem{ID: "4", Filename: "PXL_0004.mp4", MimeType: "video/mp4", Metadata: data.MediaMetadata{CreationTime: taken(10)}}, Content: []byte("video")},
+		)
+		defer server.Close()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false, photos.WithOrphans(photos.OrphansTrash)))
+		assert.Equal(t, 0, server.Hits(photostest.Content))
+		_, err := store.Stat("2019/08/IMG_0003.JPG")
+		assert.NoError(t, err, "imported media is not an orphan of the API library")
+	})
+	t.Run("numbered duplicates are other photos of the same title", func(t *testing.T) {
+		archives := []string{writeZip(t, map[string][]byte{
+			dir + "IMG_0001.JPG":         []byte("one"),
+			dir + "IMG_0001.JPG.json":    sidecarJSON("IMG_0001.JPG", taken(6)),
+			dir + "IMG_0001(1).JPG":      []byte("another one"),
+			dir + "IMG_0001.JPG(1).json": sidecarJSON("IMG_0001.JPG", taken(6)),
+		})}
+		store := storage.NewMemory()
+		require.NoError(t, photos.ImportTakeout(context.Background(), store, archives))
+
+		// IMG_0001(1).JPG comes first in the archive and takes the name
+		distinct := "2019/06/IMG_0001_" + photos.ShortID("takeout:"+dir+"IMG_0001.JPG") + ".JPG"
+		assert.ElementsMatch(t, []string{"2019/06/IMG_0001.JPG", distinct}, mediaWrites(store))
+		for name, want := range map[string]string{"2019/06/IMG_0001.JPG": "another one", distinct: "one"} {
+			contents, err := store.ReadFile(name)
+			require.NoError(t, err)
+			assert.Equal(t, want, string(contents), name)
+		}
+
+		c := photos.NewController()
+		require.NoError(t, photos.ImportTakeout(context.Background(), store, archives, photos.WithController(c)))
+		assert.Zero(t, c.Status().Progress.Saved)
+		assert.Equal(t, int64(2), c.Status().Progress.Skipped)
+	})
+	t.Run("sidecars of the same title are picked in order", func(t *testing.T) {
+		archives := []string{writeZip(t, map[string][]byte{
+			dir + "photo.jpg":  []byte("photo"),
+			dir + "first.json": sidecarJSON("photo.jpg", taken(6)),
+			dir + "later.json": sidecarJSON("photo.jpg", taken(7)),
+		})}
+		for range 5 {
+			store := storage.NewMemory()
+			require.NoError(t, photos.ImportTakeout(context.Background(), store, archives))
+			assert.Equal(t, []string{"2019/06/photo.jpg"}, mediaWrites(store))
+		}
+	})
+	t.Run("unsupported archive", func(t *testing.T) {
+		assert.Error(t, photos.ImportTakeout(context.Background(), storage.NewMemory(), []string{"takeout.rar"}))
+	})
+}
+
+func keys(m map[string]string) []string {
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
+
+func writeZip(t *testing.T, files map[string][]byte) string {
+	name := filepath.Join(t.TempDir(), "takeout-001.zip")
+	f, err := os.Create(name)
+	require.NoError(t, err)
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, entry := range sortedKeys(files) {
+		w, err := zw.Create(entry)
+		require.NoError(t, err)
+		_, err = w.Write(files[entry])
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return name
+}
+
+func writeTgz(t *testing.T, files map[string][]byte) string {
+	name := filepath.Join(t.TempDir(), "takeout-002.tgz")
+	f, err := os.Create(name)
+	require.NoError(t, err)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, entry := range sortedKeys(files) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: entry, Mode: 0644, Size: int64(len(files[entry])), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(files[entry])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return name
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func Test_SanitizeName(t *testing.T) {
+	long := strings.Repeat("é", 200) + ".jpg"
+	tests := []struct {
+		name    string
+		input   string
+		posix   string
+		smb     string
+		windows string
+	}{
+		{"spaces and slashes", "7/21/14 - 1.jpg", "7_21_14_-_1.jpg", "7_21_14_-_1.jpg", "7_21_14_-_1.jpg"},
+		{"smb reserved characters", `a:b*c?d"e<f>g|h\i.jpg`, `a:b*c?d"e<f>g|h\i.jpg`, "a_b_c_d_e_f_g_h_i.jpg", "a_b_c_d_e_f_g_h_i.jpg"},
+		{"trailing dots and spaces", "photo.jpg. .", "photo.jpg._.", "photo.jpg._", "photo.jpg._"},
+		{"trailing dots", "photo...", "photo...", "photo", "photo"},
+		{"reserved device names", "nul.jpg", "nul.jpg", "nul.jpg", "_nul.jpg"},
+		{"reserved device names without extension", "CON", "CON", "CON", "_CON"},
+		{"control characters", "a\x00b\x1fc\x7f.jpg", "a_b_c_.jpg", "a_b_c_.jpg", "a_b_c_.jpg"},
+		{"decomposed unicode is composed", "Tré.jpg", "Tré.jpg", "Tré.jpg", "Tré.jpg"},
+		{"empty", "", "_", "_", "_"},
+		{"dot dot", "..", "_", "_", "_"},
+		{"long names keep their extension", long, strings.Repeat("é", 125) + ".jpg", strings.Repeat("é", 125) + ".jpg", strings.Repeat("é", 125) + ".jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.posix, photos.SanitizeName(photos.NamesPOSIX, tt.input), "posix")
+			assert.Equal(t, tt.smb, photos.SanitizeName(photos.NamesSMB, tt.input), "smb")
+			assert.Equal(t, tt.windows, photos.SanitizeName(photos.NamesWindows, tt.input), "windows")
+			for _, profile := range []photos.NameProfile{photos.NamesPOSIX, photos.NamesSMB, photos.NamesWindows} {
+				once := photos.SanitizeName(profile, tt.input)
+				assert.Equal(t, once, photos.SanitizeName(profile, once), "sanitizing is idempotent for %s", profile)
+				assert.LessOrEqual(t, len(once), 255)
+			}
+		})
+	}
+	t.Run("unknown profile", func(t *testing.T) {
+		_, err := photos.ParseNameProfile("fat32")
+		assert.Error(t, err)
+	})
+}
+
+func Test_Extract_NameProfile(t *testing.T) {
+	created := time.Date(2021, 9, 13, 15, 4, 5, 0, time.UTC)
+	library := []photostest.Item{
+		{MediaItem: data.MediaItem{ID: "a", Filename: "Screen Shot 10:42:07.png", MimeType: "image/png", Metadata: data.MediaMetadata{CreationTime: created}}, Content: []byte("a")},
+	}
+
+	t.Run("smb profile", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		store := storage.NewMemory()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithNameProfile(photos.NamesSMB)))
+		assert.Equal(t, []string{"2021/09/Screen_Shot_10_42_07.png"}, mediaWrites(store))
+	})
+	t.Run("files written by earlier versions are found", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		store := storage.NewMemory()
+		// earlier versions left spaces in place
+		require.NoError(t, store.WriteFile("2021/09/Screen Shot 10:42:07.png", []byte("a"), created))
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false))
+		assert.Empty(t, mediaWrites(store))
+		assert.Equal(t, 0, server.Hits(photostest.Content))
+	})
+}
+
+func Test_NameTemplate(t *testing.T) {
+	created := time.Date(2021, 9, 13, 15, 4, 5, 0, time.UTC)
+	item := data.MediaItem{
+		ID:       "AF1QipN-id",
+		Filename: "IMG_1234.JPG",
+		MimeType: "image/jpeg",
+		Metadata: data.MediaMetadata{CreationTime: created, Photo: &data.Photo{CameraMake: "Google", CameraModel: "Pixel 6"}},
+	}
+	tests := []struct {
+		template string
+		item     data.MediaItem
+		expected string
+	}{
+		{`{{.Created.Format "20060102_150405"}}_{{short .ID}}{{ext}}`, item, "20210913_150405_" + photos.ShortID("AF1QipN-id") + ".jpg"},
+		{`{{stem}}-{{camera}}{{ext}}`, item, "IMG_1234-Pixel 6.jpg"},
+		{`{{original}}`, item, "IMG_1234.JPG"},
+		{`{{lower .Filename}}`, item, "img_1234.jpg"},
+		{`{{.CameraMake}}{{ext}}`, data.MediaItem{Filename: "image", MimeType: "video/quicktime", Metadata: data.MediaMetadata{Video: &data.Video{CameraMake: "Apple"}}}, "Apple.mov"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			nt, err := photos.ParseNameTemplate(tt.template)
+			require.NoError(t, err)
+			name, err := nt.Execute(tt.item)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, name)
+		})
+	}
+	t.Run("invalid templates", func(t *testing.T) {
+		for _, text := range []string{`{{.Nope}}`, `{{nope}}`, `{{`, `   `} {
+			_, err := photos.ParseNameTemplate(text)
+			assert.Error(t, err, text)
+		}
+	})
+	t.Run("renamed downloads are skipped on the next run", func(t *testing.T) {
+		server := photostest.NewServer(photostest.Item{MediaItem: item, Content: []byte("a")})
+		defer server.Close()
+		store := storage.NewMemory()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		nt, err := photos.ParseNameTemplate(`{{.Created.Format "20060102_150405"}}_{{camera}}{{ext}}`)
+		require.NoError(t, err)
+
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithNameTemplate(nt)))
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithNameTemplate(nt)))
+		assert.Equal(t, []string{"2021/09/20210913_150405_Pixel_6.jpg"}, mediaWrites(store))
+		assert.Equal(t, 1, server.Hits(photostest.Content))
+	})
+}
+
+// movie is an MP4 whose movie header records created
+func movie(created time.Time) []byte {
+	mvhd := make([]byte, 108)
+	binary.BigEndian.PutUint32(mvhd, 108)
+	copy(mvhd[4:], "mvhd")
+	binary.BigEndian.PutUint32(mvhd[12:], uint32(created.Unix()+2082844800))
+	moov := append([]byte{0, 0, 0, 116, 'm', 'o', 'o', 'v'}, mvhd...)
+	return append([]byte{0, 0, 0, 8, 'f', 't', 'y', 'p'}, moov...)
+}
+
+func Test_FixTimes(t *testing.T) {
+	created := time.Date(2021, 9, 13, 15, 4, 5, 0, time.UTC)
+	wrong := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	library := []photostest.Item{
+		{MediaItem: data.MediaItem{ID: "a", Filename: "a.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: created}}, Content: []byte("a")},
+		{MediaItem: data.MediaItem{ID: "b", Filename: "b c.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: created.Add(time.Hour)}}, Content: []byte("b")},
+	}
+	modTime := func(t *testing.T, store storage.Storage, name string) time.Time {
+		info, err := store.Stat(name)
+		require.NoError(t, err)
+		return info.ModTime()
+	}
+
+	t.Run("times are restored from a listing", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		store := storage.NewMemory()
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false))
+		// written by a version that kept spaces in names, without the index
+		require.NoError(t, store.Rename("2021/09/b_c.jpg", "2021/09/b c.jpg"))
+		require.NoError(t, store.Remove(photos.IndexPath))
+		for _, name := range []string{"2021/09/a.jpg", "2021/09/b c.jpg"} {
+			require.NoError(t, store.SetModTime(name, wrong))
+		}
+
+		require.NoError(t, photos.FixTimes(context.Background(), c, store, true))
+		assert.True(t, wrong.Equal(modTime(t, store, "2021/09/a.jpg")), "read-only changes nothing")
+
+		require.NoError(t, photos.FixTimes(context.Background(), c, store, false))
+		assert.True(t, created.Equal(modTime(t, store, "2021/09/a.jpg")))
+		assert.True(t, created.Add(time.Hour).Equal(modTime(t, store, "2021/09/b c.jpg")))
+		assert.Equal(t, 2, server.Hits(photostest.Content), "nothing downloaded again")
+	})
+	t.Run("the index finds media saved under another layout", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		store := storage.NewMemory()
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false))
+		require.NoError(t, store.SetModTime("2021/09/a.jpg", wrong))
+
+		nt, err := photos.ParseNameTemplate(`{{short .ID}}{{ext}}`)
+		require.NoError(t, err)
+		require.NoError(t, photos.FixTimes(context.Background(), c, store, false, photos.WithNameTemplate(nt)))
+		assert.True(t, created.Equal(modTime(t, store, "2021/09/a.jpg")))
+	})
+	t.Run("embedded times are used offline", func(t *testing.T) {
+		t.Parallel()
+		store := storage.NewMemory()
+		require.NoError(t, store.MkdirAll("2022/01"))
+		require.NoError(t, store.MkdirAll(photos.TrashDir))
+		videoCreated := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+		require.NoError(t, store.WriteFile("2022/01/PXL_0001.mp4", movie(videoCreated), wrong))
+		require.NoError(t, store.WriteFile("2022/01/notes.txt", []byte("no metadata"), wrong))
+		require.NoError(t, store.WriteFile(photos.TrashDir+"/old.mp4", movie(videoCreated), wrong))
+
+		require.NoError(t, photos.FixTimes(context.Background(), nil, store, false))
+		assert.True(t, videoCreated.Equal(modTime(t, store, "2022/01/PXL_0001.mp4")))
+		assert.True(t, wrong.Equal(modTime(t, store, "2022/01/notes.txt")), "nothing to fix it with")
+		assert.True(t, wrong.Equal(modTime(t, store, photos.TrashDir+"/old.mp4")), "photogo's own directories are left alone")
+	})
+	t.Run("list failure fixes nothing", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.List, Status: http.StatusServiceUnavailable})
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		store := storage.NewMemory()
+		require.NoError(t, store.MkdirAll("2021/09"))
+		require.NoError(t, store.WriteFile("2021/09/a.jpg", []byte("a"), wrong))
+
+		assert.Error(t, photos.FixTimes(context.Background(), c, store, false))
+		assert.True(t, wrong.Equal(modTime(t, store, "2021/09/a.jpg")))
+	})
+}
+
+func Test_Extract_Dates(t *testing.T) {
+	apiTime := time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+	embedded := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	library := []photostest.Item{
+		{MediaItem: data.MediaItem{ID: "scan", Filename: "scan.mp4", MimeType: "video/mp4", Metadata: data.MediaMetadata{CreationTime: apiTime}}, Content: movie(embedded)},
+		{MediaItem: data.MediaItem{ID: "plain", Filename: "plain.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: apiTime}}, Content: []byte("no metadata")},
+	}
+	tests := []struct {
+		policy photos.DatePolicy
+		path   string
+		time   time.Time
+	}{
+		{photos.DatesAPI, "2023/05/scan.mp4", apiTime},
+		{photos.DatesEXIF, "2019/01/scan.mp4", embedded},
+		{photos.DatesEarliest, "2019/01/scan.mp4", embedded},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(string(tt.policy), func(t *testing.T) {
+			t.Parallel()
+			server := photostest.NewServer(library...)
+			defer server.Close()
+			c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+			store := storage.NewMemory()
+
+			require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithDates(tt.policy)))
+			assert.ElementsMatch(t, []string{tt.path, "2023/05/plain.jpg"}, mediaWrites(store))
+			info, err := store.Stat(tt.path)
+			require.NoError(t, err)
+			assert.True(t, tt.time.Equal(info.ModTime()), info.ModTime())
+
+			require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithDates(tt.policy)))
+			assert.Len(t, mediaWrites(store), 2)
+			assert.Equal(t, 2, server.Hits(photostest.Content), "nothing is downloaded again")
+		})
+	}
+	t.Run("media saved by api time is found without downloading", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		store := storage.NewMemory()
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false))
+		require.NoError(t, store.Remove(photos.IndexPath))
+
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithDates(photos.DatesEXIF)))
+		assert.Len(t, mediaWrites(store), 2)
+		assert.Equal(t, 2, server.Hits(photostest.Content))
+	})
+	t.Run("fix-times follows the policy", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(library...)
+		defer server.Close()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		store := storage.NewMemory()
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithDates(photos.DatesEXIF)))
+		require.NoError(t, store.SetModTime("2019/01/scan.mp4", apiTime))
+
+		require.NoError(t, photos.FixTimes(context.Background(), c, store, false, photos.WithDates(photos.DatesEXIF)))
+		info, err := store.Stat("2019/01/scan.mp4")
+		require.NoError(t, err)
+		assert.True(t, embedded.Equal(info.ModTime()))
+	})
+	t.Run("metadata is written into downloads missing it", func(t *testing.T) {
+		t.Parallel()
+		bare := []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9}
+		server := photostest.NewServer(photostest.Item{
+			MediaItem: data.MediaItem{ID: "cake", Filename: "cake.jpg", MimeType: "image/jpeg", Description: "birthday", Metadata: data.MediaMetadata{CreationTime: apiTime}},
+			Content:   bare,
+		})
+		defer server.Close()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		store := storage.NewMemory()
+
+		require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithMetadataWrite(true)))
+		contents, err := store.ReadFile("2023/05/cake.jpg")
+		require.NoError(t, err)
+		info, err := metadata.Read(bytes.NewReader(contents))
+		require.NoError(t, err)
+		assert.True(t, apiTime.Equal(info.Captured))
+		assert.Equal(t, "birthday", info.Description)
+		assert.Equal(t, bare[2:], contents[len(contents)-len(bare)+2:])
+	})
+	t.Run("unknown policy", func(t *testing.T) {
+		_, err := photos.ParseDatePolicy("exfi")
+		assert.Error(t, err)
+	})
+}
+
+func Test_MergeLocations(t *testing.T) {
+	taken := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	sidecarJSON := func(title string, at time.Time, latitude float64) []byte {
+		longitude := 2.2945
+		if latitude == 0 {
+			longitude = 0
+		}
+		return []byte(fmt.Sprintf(`{"title":%q,"photoTakenTime":{"timestamp":"%d"},"geoData":{"latitude":%f,"longitude":%f,"altitude":35}}`, title, at.Unix(), latitude, longitude))
+	}
+	bare := []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9}
+	const dir = "Takeout/Google Photos/Photos from 2019/"
+	takeout := map[string][]byte{
+		dir + "IMG_0001.JPG.json":      sidecarJSON("IMG_0001.JPG", taken, 48.8584),
+		dir + "IMG 0002.JPG.json":      sidecarJSON("IMG 0002.JPG", taken, 48.8584),
+		dir + "PXL_0003.mp4.json":      sidecarJSON("PXL_0003.mp4", taken, 48.8584),
+		dir + "IMG_0004.PNG.json":      sidecarJSON("IMG_0004.PNG", taken, 48.8584),
+		dir + "elsewhen.jpg.json":      sidecarJSON("elsewhen.jpg", taken.AddDate(0, 0, 1), 48.8584),
+		dir + "nowhere.jpg.json":       sidecarJSON("nowhere.jpg", taken, 0),
+		dir + "not-saved.jpg.json":     sidecarJSON("not-saved.jpg", taken, 48.8584),
+		dir + "IMG_0001.JPG":           []byte("media in the archive is not needed"),
+		"Takeout/archive_browser.html": []byte("<html>"),
+	}
+	saved := func(t *testing.T) *storage.Memory {
+		store := storage.NewMemory()
+		require.NoError(t, store.MkdirAll("2019/06"))
+		for name, contents := range map[string][]byte{
+			"2019/06/IMG_0001.JPG": bare,
+			"2019/06/IMG_0002.JPG": bare,
+			"2019/06/PXL_0003.mp4": movie(taken),
+			"2019/06/IMG_0004.PNG": []byte("png"),
+			"2019/06/elsewhen.jpg": bare,
+			"2019/06/nowhere.jpg":  bare,
+		} {
+			require.NoError(t, store.WriteFile(name, contents, taken))
+		}
+		return store
+	}
+	location := func(t *testing.T, store *storage.Memory, name string) *metadata.Location {
+		contents, err := store.ReadFile(name)
+		require.NoError(t, err)
+		info, _ := metadata.Read(bytes.NewReader(contents))
+		return info.Location
+	}
+
+	t.Run("into exif", func(t *testing.T) {
+		t.Parallel()
+		store := saved(t)
+		require.NoError(t, photos.MergeLocations(context.Background(), store, []string{writeZip(t, takeout)}, photos.LocationsEXIF, false))
+
+		for _, name := range []string{"2019/06/IMG_0001.JPG", "2019/06/IMG_0002.JPG", "2019/06/PXL_0003.mp4"} {
+			loc := location(t, store, name)
+			require.NotNil(t, loc, name)
+			assert.InDelta(t, 48.8584, loc.Latitude, 0.00001, name)
+			assert.InDelta(t, 2.2945, loc.Longitude, 0.00001, name)
+			info, err := store.Stat(name)
+			require.NoError(t, err)
+			assert.True(t, taken.Equal(info.ModTime()), "%s keeps its time", name)
+		}
+		assert.Nil(t, location(t, store, "2019/06/elsewhen.jpg"), "taken at another time")
+		assert.Nil(t, location(t, store, "2019/06/nowhere.jpg"))
+		xmp, err := store.ReadFile("2019/06/IMG_0004.PNG.xmp")
+		require.NoError(t, err)
+		assert.Contains(t, string(xmp), "<exif:GPSLatitude>48,51.504000N</exif:GPSLatitude>")
+		png, err := store.ReadFile("2019/06/IMG_0004.PNG")
+		require.NoError(t, err)
+		assert.Equal(t, "png", string(png), "formats without metadata are untouched")
+
+		writes := len(store.Writes())
+		require.NoError(t, photos.MergeLocations(context.Background(), store, []string{writeZip(t, takeout)}, photos.LocationsEXIF, false))
+		assert.Len(t, store.Writes(), writes, "a second run writes nothing")
+	})
+	t.Run("legacy names and extracted takeouts", func(t *testing.T) {
+		t.Parallel()
+		store := saved(t)
+		require.NoError(t, store.Rename("2019/06/IMG_0002.JPG", "2019/06/IMG 0002.JPG"))
+		extracted := t.TempDir()
+		for name, contents := range takeout {
+			require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(extracted, name)), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(extracted, name), contents, 0644))
+		}
+		require.NoError(t, photos.MergeLocations(context.Background(), store, []string{extracted}, photos.LocationsEXIF, false))
+		assert.NotNil(t, location(t, store, "2019/06/IMG 0002.JPG"))
+	})
+	t.Run("into xmp sidecars", func(t *testing.T) {
+		t.Parallel()
+		store := saved(t)
+		require.NoError(t, photos.MergeLocations(context.Background(), store, []string{writeZip(t, takeout)}, photos.LocationsXMP, false))
+		assert.Nil(t, location(t, store, "2019/06/IMG_0001.JPG"))
+		assert.ElementsMatch(t, []string{
+			"2019/06/IMG_0001.JPG.xmp.tmp", "2019/06/IMG_0002.JPG.xmp.tmp", "2019/06/PXL_0003.mp4.xmp.tmp", "2019/06/IMG_0004.PNG.xmp.tmp",
+		}, store.Writes())
+	})
+	t.Run("names from a template", func(t *testing.T) {
+		t.Parallel()
+		store := storage.NewMemory()
+		require.NoError(t, store.MkdirAll("2019/06"))
+		require.NoError(t, store.WriteFile("2019/06/20190601_120000.jpg", bare, taken))
+		template, err := photos.ParseNameTemplate(`{{.Created.Format "20060102_150405"}}{{ext}}`)
+		require.NoError(t, err)
+		require.NoError(t, photos.MergeLocations(context.Background(), store, []string{writeZip(t, takeout)}, photos.LocationsEXIF, false,
+			photos.WithNameTemplate(template)))
+		assert.NotNil(t, location(t, store, "2019/06/20190601_120000.jpg"))
+	})
+	t.Run("a file that cannot take a location gets a sidecar", func(t *testing.T) {
+		t.Parallel()
+		store := saved(t)
+		broken := []byte{0xFF, 0xD8, 0x00, 0x01, 0x02, 0x03}
+		require.NoError(t, store.WriteFile("2019/06/broken.jpg", broken, taken))
+		archive := writeZip(t, map[string][]byte{dir + "broken.jpg.json": sidecarJSON("broken.jpg", taken, 48.8584)})
+		require.NoError(t, photos.MergeLocations(context.Background(), store, []string{writeZip(t, takeout), archive}, photos.LocationsEXIF, false))
+
+		contents, err := store.ReadFile("2019/06/broken.jpg")
+		require.NoError(t, err)
+		assert.Equal(t, broken, contents)
+		xmp, err := store.ReadFile("2019/06/broken.jpg.xmp")
+		require.NoError(t, err)
+		assert.Contains(t, string(xmp), "<exif:GPSLatitude>48,51.504000N</exif:GPSLatitude>")
+		assert.NotNil(t, location(t, store, "2019/06/IMG_0001.JPG"), "the other files are located")
+	})
+	t.Run("read-only writes nothing", func(t *testing.T) {
+		t.Parallel()
+		store := saved(t)
+		require.NoError(t, photos.MergeLocations(context.Background(), store, []string{writeZip(t, takeout)}, photos.LocationsEXIF, true))
+		assert.Empty(t, store.Writes())
+	})
+}
+
+func Test_Extract_Resume(t *testing.T) {
+	video := func(content []byte) photostest.Item {
+		return photostest.Item{
+			MediaItem: data.MediaItem{
+				ID:       "video",
+				Filename: "PXL_0001.mp4",
+				MimeType: "video/mp4",
+				Metadata: data.MediaMetadata{CreationTime: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)},
+			},
+			Content: content,
+		}
+	}
+	content := bytes.Repeat([]byte("0123456789"), 1_000)
+	extract := func(server *photostest.Server, store storage.Storage) error {
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		return photos.Extract(context.Background(), c, store, 1, false)
+	}
+	saved := func(t *testing.T, store *storage.Memory) []byte {
+		contents, err := store.ReadFile("2022/01/PXL_0001.mp4")
+		require.NoError(t, err)
+		return contents
+	}
+
+	t.Run("an interrupted download continues with a range", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(video(content))
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, TruncateAfter: 4_000, Times: 1})
+		store := storage.NewMemory()
+
+		require.NoError(t, extract(server, store))
+		assert.Equal(t, content, saved(t, store))
+		assert.Equal(t, 2, server.Hits(photostest.Content))
+		_, err := store.Stat(photos.PartialDir + "/video")
+		assert.True(t, errors.Is(err, fs.ErrNotExist), "the partial download is removed")
+	})
+	t.Run("the next run continues what this one could not finish", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(video(content))
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, TruncateAfter: 1_000, Times: 3})
+		store := storage.NewMemory()
+
+		assert.Error(t, extract(server, store))
+		_, err := store.Stat("2022/01/PXL_0001.mp4")
+		assert.True(t, errors.Is(err, fs.ErrNotExist), "an incomplete download is never mistaken for the media")
+		info, err := store.Stat(photos.PartialDir + "/video")
+		require.NoError(t, err)
+		assert.EqualValues(t, 3_000, info.Size())
+
+		require.NoError(t, extract(server, store))
+		assert.Equal(t, content, saved(t, store))
+		assert.Equal(t, 4, server.Hits(photostest.Content))
+	})
+	t.Run("a server ignoring ranges restarts the download", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(video(content))
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, TruncateAfter: 4_000, Times: 1})
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, IgnoreRange: true})
+		store := storage.NewMemory()
+
+		require.NoError(t, extract(server, store))
+		assert.Equal(t, content, saved(t, store))
+	})
+	t.Run("changed media restarts the download", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(video(content))
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, TruncateAfter: 1_000, Times: 3})
+		store := storage.NewMemory()
+		assert.Error(t, extract(server, store))
+
+		changed := bytes.Repeat([]byte("abcdefghij"), 1_000)
+		server.RemoveItems("video")
+		server.AddItems(video(changed))
+		require.NoError(t, extract(server, store))
+		assert.Equal(t, changed, saved(t, store))
+	})
+}
+
+func Test_Extract_Chunks(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1_000)
+	server := func() *photostest.Server {
+		return photostest.NewServer(photostest.Item{
+			MediaItem: data.MediaItem{
+				ID:       "video",
+				Filename: "PXL_0001.mp4",
+				MimeType: "video/mp4",
+				Metadata: data.MediaMetadata{CreationTime: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)},
+			},
+			Content: content,
+		})
+	}
+	extract := func(server *photostest.Server, store storage.Storage, workerCount int) error {
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		return photos.Extract(context.Background(), c, store, workerCount, false, photos.WithChunks(5_000, 3_000))
+	}
+	saved := func(t *testing.T, store *storage.Memory) []byte {
+		contents, err := store.ReadFile("2022/01/PXL_0001.mp4")
+		require.NoError(t, err)
+		return contents
+	}
+
+	for _, workerCount := range []int{1, 4} {
+		t.Run(fmt.Sprintf("large media is downloaded in ranges with %d workers", workerCount), func(t *testing.T) {
+			t.Parallel()
+			server := server()
+			defer server.Close()
+			store := storage.NewMemory()
+
+			require.NoError(t, extract(server, store, workerCount))
+			assert.Equal(t, content, saved(t, store))
+			assert.Equal(t, 4, server.Hits(photostest.Content), "the first response and three more ranges")
+			infos, err := store.List(photos.PartialDir)
+			require.NoError(t, err)
+			assert.Empty(t, infos, "the chunks are removed once saved")
+		})
+	}
+	t.Run("a failed first chunk is requested again", func(t *testing.T) {
+		t.Parallel()
+		server := server()
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, TruncateAfter: 1_000, Times: 1})
+		store := storage.NewMemory()
+
+		require.NoError(t, extract(server, store, 2))
+		assert.Equal(t, content, saved(t, store))
+	})
+	t.Run("a failed chunk is requested again alone", func(t *testing.T) {
+		t.Parallel()
+		server := server()
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, TruncateAfter: 1_000, After: 2, Times: 1})
+		store := storage.NewMemory()
+
+		require.NoError(t, extract(server, store, 1))
+		assert.Equal(t, content, saved(t, store))
+		assert.Equal(t, 5, server.Hits(photostest.Content), "three ranges, then the failed one and the last")
+	})
+	t.Run("the chunks of a failed run are kept for the next", func(t *testing.T) {
+		t.Parallel()
+		server := server()
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, Status: http.StatusInternalServerError, After: 2, Times: 1})
+		store := storage.NewMemory()
+
+		assert.Error(t, extract(server, store, 1))
+		_, err := store.Stat(photos.PartialDir + "/video.chunks")
+		require.NoError(t, err)
+		require.NoError(t, extract(server, store, 1))
+		assert.Equal(t, content, saved(t, store))
+		assert.Equal(t, 5, server.Hits(photostest.Content), "two ranges, then the failed one and the last")
+	})
+	t.Run("a server without ranges sends it whole", func(t *testing.T) {
+		t.Parallel()
+		server := server()
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.Content, IgnoreRange: true})
+		store := storage.NewMemory()
+
+		require.NoError(t, extract(server, store, 4))
+		assert.Equal(t, content, saved(t, store))
+		assert.Equal(t, 1, server.Hits(photostest.Content))
+	})
+}
+
+func Test_Extract_Logging(t *testing.T) {
+	server := photostest.NewServer(photostest.Item{
+		MediaItem: data.MediaItem{
+			ID:       "AB12",
+			Filename: "IMG_0001.JPG",
+			MimeType: "image/jpeg",
+			Metadata: data.MediaMetadata{CreationTime: time.Date(2009, 5, 13, 15, 4, 5, 0, time.UTC)},
+		},
+		Content: []byte("jpeg"),
+	})
+	defer server.Close()
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{ReplaceAttr: client.RedactAttr}))
+	c := client.New(server.Client().Do, client.WithBaseURL(server.URL), client.WithLogger(logger))
+
+	require.NoError(t, photos.Extract(context.Background(), c, storage.NewMemory(), 1, false, photos.WithLogger(logger)))
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record), line)
+		records = append(records, record)
+	}
+	var wrote map[string]any
+	for _, record := range records {
+		if record["msg"] == "wrote" {
+			wrote = record
+		}
+	}
+	require.NotNil(t, wrote, "got %v", records)
+	assert.Equal(t, "INFO", wrote["level"])
+	assert.Equal(t, "AB12", wrote["id"])
+	assert.Equal(t, "IMG_0001.JPG", wrote["filename"])
+	assert.Equal(t, "image/jpeg", wrote["mime"])
+	assert.Equal(t, "2009/05/IMG_0001.JPG", wrote["path"])
+	assert.EqualValues(t, 4, wrote["bytes"])
+	assert.Contains(t, wrote, "duration")
+}
+
+func Test_Extract_Throughput(t *testing.T) {
+	server := photostest.NewServer(photostest.Item{
+		MediaItem: data.MediaItem{
+			ID:       "AB12",
+			Filename: "IMG_0001.JPG",
+			MimeType: "image/jpeg",
+			Metadata: data.MediaMetadata{CreationTime: time.Date(2009, 5, 13, 15, 4, 5, 0, time.UTC)},
+		},
+		Content: []byte("jpeg"),
+	})
+	defer server.Close()
+	c := client.New(server.Client().Do, client.WithBaseURL(server.URL), client.WithLimiter(client.NewLimiter(client.Schedule{})))
+
+	// a daemon syncs with the same client every run
+	for run := 0; run < 2; run++ {
+		var out bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&out, nil))
+		require.NoError(t, photos.Extract(context.Background(), c, storage.NewMemory(), 1, false, photos.WithLogger(logger)))
+		var downloaded map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var record map[string]any
+			require.NoError(t, json.Unmarshal([]byte(line), &record), line)
+			if record["msg"] == "downloaded" {
+				downloaded = record
+			}
+		}
+		require.NotNil(t, downloaded, "run %d logged %s", run, out.String())
+		assert.EqualValues(t, 4, downloaded["bytes"], "run %d", run)
+	}
+}
+
+func Test_Extract_Metrics(t *testing.T) {
+	item := func(id string) photostest.Item {
+		return photostest.Item{
+			MediaItem: data.MediaItem{
+				ID:       id,
+				Filename: id + ".jpg",
+				MimeType: "image/jpeg",
+				Metadata: data.MediaMetadata{CreationTime: time.Date(2009, 5, 13, 15, 4, 5, 0, time.UTC)},
+			},
+			Content: []byte("jpeg " + id),
+		}
+	}
+	server := photostest.NewServer(item("a"), item("b"))
+	defer server.Close()
+	registry := metrics.NewRegistry()
+	c := client.New(server.Client().Do, client.WithBaseURL(server.URL), client.WithMetrics(registry))
+	store := storage.NewMemory()
+	text := func() string {
+		var b strings.Builder
+		_, err := registry.WriteTo(&b)
+		require.NoError(t, err)
+		return b.String()
+	}
+
+	require.NoError(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithMetrics(registry)))
+	out := text()
+	for _, line := range []string{
+		`photogo_api_requests_total{endpoint="list",code="200"} 1`,
+		`photogo_api_requests_total{endpoint="get",code="200"} 2`,
+		`photogo_api_quota_used{quota="media"} 2`,
+		`photogo_api_quota_used{quota="requests"} 1`,
+		`photogo_download_bytes_total 12`,
+		`photogo_items_total{outcome="downloaded"} 2`,
+		`photogo_item_duration_seconds_count 2`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+	assert.Regexp(t, `photogo_last_success_timestamp_seconds \d+`, out)
+
+	server.AddItems(item("c"))
+	server.Inject(photostest.Fault{Endpoint: photostest.Content, Status: http.StatusInternalServerError})
+	require.Error(t, photos.Extract(context.Background(), c, store, 1, false, photos.WithMetrics(registry)))
+	out = text()
+	for _, line := range []string{
+		`photogo_api_requests_total{endpoint="get",code="500"} 1`,
+		`photogo_items_total{outcome="downloaded"} 2`,
+		`photogo_items_total{outcome="failed"} 1`,
+		`photogo_items_total{outcome="skipped"} 2`,
+		`photogo_item_duration_seconds_count 5`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+}
+
+// gatedService holds every download until released, signalling when one starts
+type gatedService struct {
+	photos.MediaService
+	started chan string
+	release chan struct{}
+}
+
+func (g *gatedService) Get(ctx context.Context, mediaItem data.MediaItem) ([]byte, error) {
+	g.started <- mediaItem.ID
+	select {
+	case <-g.release:
+		return g.MediaService.Get(ctx, mediaItem)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func Test_Extract_Shutdown(t *testing.T) {
+	library := func() *photostest.Server {
+		var items []photostest.Item
+		for i := 0; i < 10; i++ {
+			items = append(items, photostest.Item{
+				MediaItem: data.MediaItem{
+					ID:       fmt.Sprintf("id-%d", i),
+					Filename: fmt.Sprintf("IMG_%04d.JPG", i),
+					MimeType: "image/jpeg",
+					Metadata: data.MediaMetadata{CreationTime: time.Date(2021, 9, 13, 15, 4, 5, 0, time.UTC)},
+				},
+				Content: []byte(fmt.Sprintf("image %d", i)),
+			})
+		}
+		return photostest.NewServer(items...)
+	}
+	// saved are the media files with contents
+	saved := func(store *storage.Memory) []string {
+		var names []string
+		for _, name := range mediaWrites(store) {
+			if info, err := store.Stat(name); err == nil {
+				assert.NotZero(t, info.Size(), "%s is incomplete", name)
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	t.Run("a stop lets running downloads finish", func(t *testing.T) {
+		t.Parallel()
+		server := library()
+		defer server.Close()
+		service := &gatedService{
+			MediaService: client.New(server.Client().Do, client.WithBaseURL(server.URL)),
+			started:      make(chan string, 10),
+			release:      make(chan struct{}),
+		}
+		store := storage.NewMemory()
+		stop, requestStop := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- photos.Extract(context.Background(), service, store, 2, false, photos.WithStop(stop))
+		}()
+		<-service.started
+		<-service.started
+		requestStop()
+		close(service.release)
+
+		err := <-done
+		assert.True(t, errors.Is(err, photos.ErrInterrupted), "got %v", err)
+		assert.Len(t, saved(store), 2)
+		idx, err := photos.LoadIndex(store)
+		require.NoError(t, err)
+		assert.Len(t, idx.Entries(), 2, "the index is saved")
+	})
+	t.Run("an abort removes what it interrupted", func(t *testing.T) {
+		t.Parallel()
+		server := library()
+		defer server.Close()
+		service := &gatedService{
+			MediaService: client.New(server.Client().Do, client.WithBaseURL(server.URL)),
+			started:      make(chan string, 10),
+			release:      make(chan struct{}),
+		}
+		store := storage.NewMemory()
+		ctx, abort := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- photos.Extract(ctx, service, store, 2, false)
+		}()
+		<-service.started
+		<-service.started
+		abort()
+
+		err := <-done
+		assert.True(t, errors.Is(err, photos.ErrInterrupted), "got %v", err)
+		assert.Empty(t, saved(store))
+		assert.Len(t, mediaWrites(store), 2, "both downloads had started")
+	})
+}
+
+// never is a Schedule without a next time, as a cron expression for February 30th would be
+type never struct{}
+
+func (never) Next(time.Time) time.Time { return time.Time{} }
+
+func Test_Daemon(t *testing.T) {
+	exists := func(store storage.Storage, name string) bool {
+		_, err := store.Stat(name)
+		return err == nil
+	}
+	item := func(id string, day int) photostest.Item {
+		return photostest.Item{
+			MediaItem: data.MediaItem{
+				ID:       id,
+				Filename: id + ".jpg",
+				MimeType: "image/jpeg",
+				Metadata: data.MediaMetadata{CreationTime: time.Date(2021, 9, day, 15, 4, 5, 0, time.UTC)},
+			},
+			Content: []byte("image " + id),
+		}
+	}
+	var old []photostest.Item
+	for i := 0; i < 60; i++ {
+		old = append(old, item(fmt.Sprintf("old-%d", i), 1))
+	}
+
+	t.Run("later syncs list only new media", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(old...)
+		defer server.Close()
+		store := storage.NewMemory()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false))
+		assert.Equal(t, 3, server.Hits(photostest.List))
+
+		// the library lists the newest media first
+		newer := photostest.NewServer(append([]photostest.Item{item("new", 2)}, old...)...)
+		defer newer.Close()
+		c = client.New(newer.Client().Do, client.WithBaseURL(newer.URL))
+		require.NoError(t, photos.Extract(context.Background(), c, store, 2, false, photos.WithIncremental(true),
+			photos.WithOrphans(photos.OrphansDelete), photos.WithDeleteConfirmation(0)))
+		assert.Equal(t, 2, newer.Hits(photostest.List), "stops at the first page of known media")
+		assert.True(t, exists(store, "2021/09/new.jpg"))
+		assert.Len(t, mediaWrites(store), 61)
+	})
+	t.Run("syncs on schedule until stopped", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(old[:3]...)
+		defer server.Close()
+		store := storage.NewMemory()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		stop, requestStop := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			daemon := photos.Daemon{Schedule: photos.Every(10 * time.Millisecond), WorkerCount: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+			done <- daemon.Run(context.Background(), c, store, photos.WithStop(stop))
+		}()
+		server.AddItems(item("new", 2))
+		waitFor(t, func() bool { return exists(store, "2021/09/new.jpg") })
+		requestStop()
+		err := <-done
+		assert.True(t, errors.Is(err, photos.ErrInterrupted), "got %v", err)
+	})
+	t.Run("lists the whole library again after FullSync", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(old...)
+		defer server.Close()
+		store := storage.NewMemory()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			daemon := photos.Daemon{Schedule: photos.Every(time.Millisecond), WorkerCount: 2, FullSync: 20 * time.Millisecond}
+			done <- daemon.Run(ctx, c, store)
+		}()
+		waitFor(t, func() bool { return exists(store, "2021/09/old-59.jpg") }, "the first sync is done")
+		// listed last, past the first page of known media where incremental syncs stop
+		server.AddItems(item("late", 3))
+		waitFor(t, func() bool { return exists(store, "2021/09/late.jpg") }, "found by a full sync")
+		cancel()
+		<-done
+	})
+	t.Run("fails when the schedule has no next sync", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(old[:3]...)
+		defer server.Close()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		daemon := photos.Daemon{Schedule: never{}, WorkerCount: 2}
+		err := daemon.Run(context.Background(), c, storage.NewMemory())
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, photos.ErrInterrupted), "got %v", err)
+	})
+	t.Run("failures back off and retry", func(t *testing.T) {
+		t.Parallel()
+		server := photostest.NewServer(old[:3]...)
+		defer server.Close()
+		server.Inject(photostest.Fault{Endpoint: photostest.List, Status: http.StatusServiceUnavailable, Times: 2})
+		store := storage.NewMemory()
+		c := client.New(server.Client().Do, client.WithBaseURL(server.URL))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			daemon := photos.Daemon{Schedule: photos.Every(time.Hour), WorkerCount: 2, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+			done <- daemon.Run(ctx, c, store)
+		}()
+		waitFor(t, func() bool { return exists(store, "2021/09/old-2.jpg") }, "retried well before the hour")
+		cancel()
+		<-done
+	})
+}
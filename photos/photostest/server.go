@@ -0,0 +1,523 @@
+// Package photostest provides a fake Google Photos Library API for end-to-end tests that run offline.
+package photostest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"velocitizer.com/photogo/data"
+)
+
+// Endpoint names a family of requests the Server answers, used to target faults and count hits.
+type Endpoint string
+
+const (
+	List     Endpoint = "list"
+	Search   Endpoint = "search"
+	BatchGet Endpoint = "batchGet"
+	GetItem  Endpoint = "get"
+	Albums   Endpoint = "albums"
+	Content  Endpoint = "content"
+)
+
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+// Item is a media item the Server lists, along with the bytes served from its baseUrl.
+type Item struct {
+	data.MediaItem
+	Content []byte
+	// AlbumIDs are the albums the item is searchable by
+	AlbumIDs []string
+}
+
+// Fault is a failure injected into the responses of an Endpoint.
+type Fault struct {
+	// Endpoint the fault applies to, empty for every endpoint
+	Endpoint Endpoint
+	// Status replaces the response with a Google error body of that status
+	Status int
+	// Delay is paused before responding, and again between each chunk of a content body
+	Delay time.Duration
+	// TruncateAfter, when non-zero, cuts content bodies after that many bytes while still
+	// promising the full Content-Length
+	TruncateAfter int
+	// IgnoreRange serves whole content bodies, like a server without Range support
+	IgnoreRange bool
+	// Times limits the fault to the next n matching requests, zero applies it to every request
+	Times int
+	// After lets that many matching requests through before the fault applies
+	After int
+}
+
+// Server is an httptest.Server implementing the subset of the Library API photogo uses:
+// mediaItems list, search, batchGet and get, albums, and content served from baseUrls.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	items      []*Item
+	albums     []*data.Album
+	faults     []*Fault
+	hits       map[Endpoint]int
+	generation int
+}
+
+// NewServer starts a Server holding items. Close it when done.
+func NewServer(items ...Item) *Server {
+	s := &Server{hits: map[Endpoint]int{}}
+	s.AddItems(items...)
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddItems appends items to the library
+func (s *Server) AddItems(items ...Item) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range items {
+		item := item
+		s.items = append(s.items, &item)
+	}
+}
+
+// RemoveItems deletes items from the library, as a user deleting them in Google Photos
+func (s *Server) RemoveItems(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remove := map[string]bool{}
+	for _, id := range ids {
+		remove[id] = true
+	}
+	kept := s.items[:0]
+	for _, item := range s.items {
+		if !remove[item.ID] {
+			kept = append(kept, item)
+		}
+	}
+	s.items = kept
+}
+
+// AddAlbum adds an album, which items join through Item.AlbumIDs
+func (s *Server) AddAlbum(album data.Album) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.albums = append(s.albums, &album)
+}
+
+// Inject adds a fault. Faults are consulted in the order they were injected.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// ExpireURLs expires every baseUrl handed out so far, as Google does after 60 minutes.
+func (s *Server) ExpireURLs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+}
+
+// Hits returns how many requests an endpoint has received
+func (s *Server) Hits(endpoint Endpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[endpoint]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint, id := route(r)
+	if endpoint == "" {
+		writeError(w, http.StatusNotFound, "unknown path "+r.URL.Path)
+		return
+	}
+	fault := s.hit(endpoint)
+	if fault.Delay > 0 && endpoint != Content {
+		if !sleep(r, fault.Delay) {
+			return
+		}
+	}
+	if fault.Status != 0 {
+		writeError(w, fault.Status, fmt.Sprintf("injected %s failure", endpoint))
+		return
+	}
+	switch endpoint {
+	case List:
+		s.list(w, r)
+	case Search:
+		s.search(w, r)
+	case BatchGet:
+		s.batchGet(w, r)
+	case GetItem:
+		s.get(w, id)
+	case Albums:
+		s.listAlbums(w, r)
+	case Content:
+		s.content(w, r, id, fault)
+	}
+}
+
+func route(r *http.Request) (Endpoint, string) {
+	p := r.URL.Path
+	switch {
+	case p == "/v1/mediaItems" && r.Method == http.MethodGet:
+		return List, ""
+	case p == "/v1/mediaItems:search" && r.Method == http.MethodPost:
+		return Search, ""
+	case p == "/v1/mediaItems:batchGet" && r.Method == http.MethodGet:
+		return BatchGet, ""
+	case strings.HasPrefix(p, "/v1/mediaItems/") && r.Method == http.MethodGet:
+		return GetItem, strings.TrimPrefix(p, "/v1/mediaItems/")
+	case p == "/v1/albums" && r.Method == http.MethodGet:
+		return Albums, ""
+	case strings.HasPrefix(p, "/content/") && r.Method == http.MethodGet:
+		return Content, strings.TrimPrefix(p, "/content/")
+	}
+	return "", ""
+}
+
+// hit counts the request and returns the fault to apply, the zero Fault for none
+func (s *Server) hit(endpoint Endpoint) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits[endpoint]++
+	for i, f := range s.faults {
+		if f.Endpoint != "" && f.Endpoint != endpoint {
+			continue
+		}
+		if f.After > 0 {
+			f.After--
+			continue
+		}
+		fault := *f
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return Fault{}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	pageSize, err := parsePageSize(r.URL.Query().Get("pageSize"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	items := append([]*Item(nil), s.items...)
+	s.mu.Unlock()
+	s.writePage(w, items, pageSize, r.URL.Query().Get("pageToken"))
+}
+
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	var req data.SearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid search request: "+err.Error())
+		return
+	}
+	if req.AlbumID != "" && req.Filters != nil {
+		writeError(w, http.StatusBadRequest, "albumId cannot be set with filters")
+		return
+	}
+	pageSize, err := parsePageSize(strconv.Itoa(req.PageSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.mu.Lock()
+	var items []*Item
+	for _, item := range s.items {
+		if matches(item, req) {
+			items = append(items, item)
+		}
+	}
+	s.mu.Unlock()
+	s.writePage(w, items, pageSize, req.PageToken)
+}
+
+func matches(item *Item, req data.SearchRequest) bool {
+	if req.AlbumID != "" {
+		for _, id := range item.AlbumIDs {
+			if id == req.AlbumID {
+				return true
+			}
+		}
+		return false
+	}
+	if req.Filters == nil || req.Filters.DateFilter == nil {
+		return true
+	}
+	created := item.Metadata.CreationTime.UTC()
+	day := time.Date(created.Year(), created.Month(), created.Day(), 0, 0, 0, 0, time.UTC)
+	for _, d := range req.Filters.DateFilter.Dates {
+		if (d.Year == 0 || d.Year == day.Year()) && (d.Month == 0 || d.Month == int(day.Month())) && (d.Day == 0 || d.Day == day.Day()) {
+			return true
+		}
+	}
+	for _, rng := range req.Filters.DateFilter.Ranges {
+		start := time.Date(rng.StartDate.Year, time.Month(rng.StartDate.Month), rng.StartDate.Day, 0, 0, 0, 0, time.UTC)
+		end := time.Date(rng.EndDate.Year, time.Month(rng.EndDate.Month), rng.EndDate.Day, 0, 0, 0, 0, time.UTC)
+		if !day.Before(start) && !day.After(end) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) writePage(w http.ResponseWriter, items []*Item, pageSize int, pageToken string) {
+	offset := 0
+	if pageToken != "" {
+		var err error
+		offset, err = strconv.Atoi(strings.TrimPrefix(pageToken, "page-"))
+		if err != nil || offset < 0 || offset > len(items) {
+			writeError(w, http.StatusBadRequest, "invalid pageToken")
+			return
+		}
+	}
+	end := offset + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	response := data.MediaResponse{MediaItems: []*data.MediaItem{}}
+	for _, item := range items[offset:end] {
+		response.MediaItems = append(response.MediaItems, s.mediaItem(item))
+	}
+	if end < len(items) {
+		response.NextPageToken = fmt.Sprintf("page-%d", end)
+	}
+	writeJSON(w, response)
+}
+
+func (s *Server) batchGet(w http.ResponseWriter, r *http.Request) {
+	ids := r.URL.Query()["mediaItemIds"]
+	if len(ids) == 0 || len(ids) > 50 {
+		writeError(w, http.StatusBadRequest, "between 1 and 50 mediaItemIds are required")
+		return
+	}
+	var response data.BatchGetResponse
+	for _, id := range ids {
+		if item := s.find(id); item != nil {
+			response.MediaItemResults = append(response.MediaItemResults, data.MediaItemResult{MediaItem: s.mediaItem(item)})
+		} else {
+			response.MediaItemResults = append(response.MediaItemResults, data.MediaItemResult{Status: &data.Status{Code: 5, Message: "Requested entity was not found."}})
+		}
+	}
+	writeJSON(w, response)
+}
+
+func (s *Server) get(w http.ResponseWriter, id string) {
+	item := s.find(id)
+	if item == nil {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	writeJSON(w, s.mediaItem(item))
+}
+
+func (s *Server) listAlbums(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	response := data.AlbumsResponse{Albums: []*data.Album{}}
+	for _, album := range s.albums {
+		album := *album
+		count := 0
+		for _, item := range s.items {
+			for _, id := range item.AlbumIDs {
+				if id == album.ID {
+					count++
+				}
+			}
+		}
+		album.MediaItemsCount = strconv.Itoa(count)
+		response.Albums = append(response.Albums, &album)
+	}
+	s.mu.Unlock()
+	writeJSON(w, response)
+}
+
+// content serves the bytes of a baseUrl, /content/{id}/{generation} followed by a =d or =dv suffix
+func (s *Server) content(w http.ResponseWriter, r *http.Request, ref string, fault Fault) {
+	id, rest, _ := strings.Cut(ref, "/")
+	generation, suffix, _ := strings.Cut(rest, "=")
+	item := s.find(id)
+	if item == nil {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	s.mu.Lock()
+	expired := generation != strconv.Itoa(s.generation)
+	s.mu.Unlock()
+	if expired {
+		writeError(w, http.StatusForbidden, "baseUrl has expired")
+		return
+	}
+	video := strings.HasPrefix(item.MimeType, "video")
+	if (video && suffix != "dv") || (!video && suffix != "d") {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported baseUrl suffix %q for %s", suffix, item.MimeType))
+		return
+	}
+
+	body := item.Content
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	status := http.StatusOK
+	w.Header().Set("Content-Type", item.MimeType)
+	w.Header().Set("ETag", etag)
+	if !fault.IgnoreRange {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	if start, end, ok := byteRange(r, etag); ok && !fault.IgnoreRange {
+		if start >= len(body) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(body)))
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "range not satisfiable")
+			return
+		}
+		if end < 0 || end >= len(body) {
+			end = len(body) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+		body, status = body[start:end+1], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if fault.TruncateAfter > 0 && fault.TruncateAfter < len(body) {
+		body = body[:fault.TruncateAfter]
+	}
+	w.WriteHeader(status)
+	const chunk = 1 << 10
+	for len(body) > 0 {
+		if fault.Delay > 0 {
+			w.(http.Flusher).Flush()
+			if !sleep(r, fault.Delay) {
+				return
+			}
+		}
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		body = body[n:]
+	}
+}
+
+// byteRange is the first and last offset of a "bytes=N-M" Range request, the last -1 for "bytes=N-".
+// The range is ignored when If-Range names another version.
+func byteRange(r *http.Request, etag string) (int, int, bool) {
+	value := r.Header.Get("Range")
+	if value == "" {
+		return 0, 0, false
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimPrefix(value, "bytes="), "-")
+	start, err := strconv.Atoi(first)
+	if !ok || err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end := -1
+	if last != "" {
+		if end, err = strconv.Atoi(last); err != nil || end < start {
+			return 0, 0, false
+		}
+	}
+	return start, end, true
+}
+
+func (s *Server) find(id string) *Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range s.items {
+		if item.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// mediaItem is the item as listed, with a baseUrl valid until the next ExpireURLs
+func (s *Server) mediaItem(item *Item) *data.MediaItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	media := item.MediaItem
+	media.BaseUrl = fmt.Sprintf("%s/content/%s/%d", s.URL, item.ID, s.generation)
+	return &media
+}
+
+func parsePageSize(value string) (int, error) {
+	if value == "" || value == "0" {
+		return defaultPageSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid pageSize %q", value)
+	}
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+	return size, nil
+}
+
+func sleep(r *http.Request, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with the error body Google APIs use
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    status,
+			"message": message,
+			"status":  googleStatus(status),
+		},
+	})
+}
+
+func googleStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	if status >= 500 {
+		return "INTERNAL"
+	}
+	return "UNKNOWN"
+}
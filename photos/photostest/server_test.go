@@ -0,0 +1,129 @@
+package photostest_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/photos/photostest"
+)
+
+func library() []photostest.Item {
+	return []photostest.Item{
+		{MediaItem: data.MediaItem{ID: "1", Filename: "a.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: time.Date(2009, 5, 13, 0, 0, 0, 0, time.UTC)}}, Content: []byte("aaa"), AlbumIDs: []string{"album"}},
+		{MediaItem: data.MediaItem{ID: "2", Filename: "b.mp4", MimeType: "video/mp4", Metadata: data.MediaMetadata{CreationTime: time.Date(2021, 9, 13, 0, 0, 0, 0, time.UTC)}}, Content: []byte("bbbb")},
+		{MediaItem: data.MediaItem{ID: "3", Filename: "c.jpg", MimeType: "image/jpeg", Metadata: data.MediaMetadata{CreationTime: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)}}, Content: []byte("ccccc")},
+	}
+}
+
+func get(t *testing.T, url string, v any) int {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	t.Run("list pages", func(t *testing.T) {
+		s := photostest.NewServer(library()...)
+		defer s.Close()
+
+		var page data.MediaResponse
+		assert.Equal(t, http.StatusOK, get(t, s.URL+"/v1/mediaItems?pageSize=2", &page))
+		require.Len(t, page.MediaItems, 2)
+		assert.Equal(t, "page-2", page.NextPageToken)
+		assert.Equal(t, s.URL+"/content/1/0", page.MediaItems[0].BaseUrl)
+
+		get(t, s.URL+"/v1/mediaItems?pageSize=2&pageToken="+page.NextPageToken, &page)
+		require.Len(t, page.MediaItems, 1)
+		assert.Empty(t, page.NextPageToken)
+		assert.Equal(t, 2, s.Hits(photostest.List))
+	})
+	t.Run("search by album and date", func(t *testing.T) {
+		s := photostest.NewServer(library()...)
+		defer s.Close()
+
+		search := func(body string) []string {
+			resp, err := http.Post(s.URL+"/v1/mediaItems:search", "application/json", strings.NewReader(body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			var page data.MediaResponse
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+			var ids []string
+			for _, item := range page.MediaItems {
+				ids = append(ids, item.ID)
+			}
+			return ids
+		}
+		assert.Equal(t, []string{"1"}, search(`{"albumId":"album"}`))
+		assert.Equal(t, []string{"2", "3"}, search(`{"filters":{"dateFilter":{"ranges":[{"startDate":{"year":2021,"month":1,"day":1},"endDate":{"year":2021,"month":12,"day":31}}]}}}`))
+		assert.Equal(t, []string{"3"}, search(`{"filters":{"dateFilter":{"dates":[{"year":2021,"month":10}]}}}`))
+	})
+	t.Run("batchGet, get and albums", func(t *testing.T) {
+		s := photostest.NewServer(library()...)
+		defer s.Close()
+		s.AddAlbum(data.Album{ID: "album", Title: "Summer"})
+
+		var batch data.BatchGetResponse
+		get(t, s.URL+"/v1/mediaItems:batchGet?mediaItemIds=3&mediaItemIds=missing", &batch)
+		require.Len(t, batch.MediaItemResults, 2)
+		assert.Equal(t, "c.jpg", batch.MediaItemResults[0].MediaItem.Filename)
+		assert.Equal(t, 5, batch.MediaItemResults[1].Status.Code)
+
+		var item data.MediaItem
+		assert.Equal(t, http.StatusOK, get(t, s.URL+"/v1/mediaItems/2", &item))
+		assert.Equal(t, "b.mp4", item.Filename)
+		assert.Equal(t, http.StatusNotFound, get(t, s.URL+"/v1/mediaItems/missing", nil))
+
+		var albums data.AlbumsResponse
+		get(t, s.URL+"/v1/albums", &albums)
+		require.Len(t, albums.Albums, 1)
+		assert.Equal(t, "1", albums.Albums[0].MediaItemsCount)
+	})
+	t.Run("content honors the download suffix and expiry", func(t *testing.T) {
+		s := photostest.NewServer(library()...)
+		defer s.Close()
+
+		resp, err := http.Get(s.URL + "/content/2/0=dv")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "bbbb", string(body))
+
+		assert.Equal(t, http.StatusBadRequest, get(t, s.URL+"/content/2/0=d", nil))
+		s.ExpireURLs()
+		assert.Equal(t, http.StatusForbidden, get(t, s.URL+"/content/2/0=dv", nil))
+	})
+	t.Run("injected faults", func(t *testing.T) {
+		s := photostest.NewServer(library()...)
+		defer s.Close()
+		s.Inject(photostest.Fault{Endpoint: photostest.List, Status: http.StatusTooManyRequests, Times: 1})
+		s.Inject(photostest.Fault{Endpoint: photostest.Content, TruncateAfter: 2})
+
+		var googleError struct {
+			Error struct {
+				Code   int    `json:"code"`
+				Status string `json:"status"`
+			} `json:"error"`
+		}
+		assert.Equal(t, http.StatusTooManyRequests, get(t, s.URL+"/v1/mediaItems", &googleError))
+		assert.Equal(t, "RESOURCE_EXHAUSTED", googleError.Error.Status)
+		assert.Equal(t, http.StatusOK, get(t, s.URL+"/v1/mediaItems", nil), "fault only applied once")
+
+		resp, err := http.Get(s.URL + "/content/3/0=d")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+		assert.Equal(t, "cc", string(body))
+	})
+}
@@ -0,0 +1,79 @@
+package photos
+
+import (
+	"context"
+	"sync"
+)
+
+// pool is the budget of concurrent downloads, shared by the workers of Extract and the chunks of
+// large downloads. Unlike a semaphore it can be resized and paused while Extract runs.
+type pool struct {
+	mu     sync.Mutex
+	limit  int
+	used   int
+	paused bool
+	// changed is closed, and replaced, whenever a slot may have become available
+	changed chan struct{}
+}
+
+func newPool(limit int) *pool {
+	return &pool{limit: limit, changed: make(chan struct{})}
+}
+
+// acquire takes a slot, waiting while the pool is full or paused
+func (p *pool) acquire(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		if !p.paused && p.used < p.limit {
+			p.used++
+			p.mu.Unlock()
+			return nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryAcquire takes a slot only when one is free now
+func (p *pool) tryAcquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused || p.used >= p.limit {
+		return false
+	}
+	p.used++
+	return true
+}
+
+func (p *pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used--
+	p.notify()
+}
+
+// setLimit resizes the pool. Shrinking it lets running downloads finish.
+func (p *pool) setLimit(limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = limit
+	p.notify()
+}
+
+// setPaused stops, or resumes, handing out slots
+func (p *pool) setPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+	p.notify()
+}
+
+func (p *pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
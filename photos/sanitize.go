@@ -0,0 +1,113 @@
+package photos
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NameProfile is the set of filename rules of the filesystem, or of the clients of the share, media is written to
+type NameProfile string
+
+const (
+	// NamesPOSIX only replaces what no filesystem allows, the default
+	NamesPOSIX NameProfile = "posix"
+	// NamesSMB also replaces the characters SMB clients reject, and trailing dots and spaces,
+	// for shares such as a Synology NAS
+	NamesSMB NameProfile = "smb"
+	// NamesWindows is NamesSMB plus the device names Windows reserves, such as CON and NUL
+	NamesWindows NameProfile = "windows"
+)
+
+// maxNameBytes is the longest filename ext4, btrfs and most other filesystems allow
+const maxNameBytes = 255
+
+// ParseNameProfile validates a profile name
+func ParseNameProfile(name string) (NameProfile, error) {
+	switch profile := NameProfile(name); profile {
+	case NamesPOSIX, NamesSMB, NamesWindows:
+		return profile, nil
+	}
+	return "", fmt.Errorf("unknown name profile %q, expected posix, smb or windows", name)
+}
+
+// WithNameProfile sets the NameProfile filenames are sanitized with, NamesPOSIX by default
+func WithNameProfile(profile NameProfile) Option {
+	return func(e *extraction) {
+		e.names = profile
+	}
+}
+
+// SanitizeName makes a media filename safe to write under profile. The result only depends on
+// its arguments, so later runs compute the same name and find the file already written.
+func SanitizeName(profile NameProfile, name string) string {
+	// macOS clients write decomposed (NFD) names, everyone else composed
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/', r == ' ', r == utf8.RuneError, unicode.IsControl(r):
+			return '_'
+		case profile != NamesPOSIX && strings.ContainsRune(`\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	if profile != NamesPOSIX {
+		// Windows clients can not open names ending in a dot or space
+		name = strings.TrimRight(name, ". ")
+	}
+	if profile == NamesWindows && reservedName(name) {
+		name = "_" + name
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return truncateName(name, maxNameBytes)
+}
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// reservedName reports names Windows treats as devices, with or without an extension, e.g. nul.jpg
+func reservedName(name string) bool {
+	stem, _, _ := strings.Cut(name, ".")
+	return reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))]
+}
+
+// truncateName shortens name to max bytes, keeping the extension and whole characters
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := path.Ext(name)
+	if len(ext) > max/2 {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+	return stem[:limit] + ext
+}
+
+// nameCleaner is the filename media is written with
+func (e *extraction) nameCleaner(input string) string {
+	profile := e.names
+	if profile == "" {
+		profile = NamesPOSIX
+	}
+	return SanitizeName(profile, input)
+}
+
+// legacyName is the name versions before SanitizeName wrote, which only replaced slashes
+func legacyName(input string) string {
+	return strings.ReplaceAll(input, "/", "_")
+}
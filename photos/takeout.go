@@ -0,0 +1,483 @@
+package photos
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"velocitizer.com/photogo/data"
+	"velocitizer.com/photogo/metrics"
+	"velocitizer.com/photogo/storage"
+)
+
+// SourceTakeout marks index entries imported from Google Takeout archives
+const SourceTakeout = "takeout"
+
+// sidecar is the metadata Takeout writes next to each media file as <filename>.json
+type sidecar struct {
+	Title          string      `json:"title"`
+	Description    string      `json:"description"`
+	URL            string      `json:"url"`
+	PhotoTakenTime takeoutTime `json:"photoTakenTime"`
+	CreationTime   takeoutTime `json:"creationTime"`
+	GeoData        takeoutGeo  `json:"geoData"`
+	GeoDataExif    takeoutGeo  `json:"geoDataExif"`
+	archive        string      // archive the sidecar was read from
+	name           string      // path of the sidecar within the archive
+}
+
+type takeoutTime struct {
+	Timestamp string `json:"timestamp"`
+}
+
+func (t takeoutTime) Time() (time.Time, bool) {
+	seconds, err := strconv.ParseInt(t.Timestamp, 10, 64)
+	if err != nil || seconds == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0).UTC(), true
+}
+
+type takeoutGeo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// readSidecar decodes a json from a Takeout, false when it does not describe media
+func readSidecar(r io.Reader) (*sidecar, bool) {
+	var s sidecar
+	if err := json.NewDecoder(r).Decode(&s); err != nil || s.Title == "" {
+		// not every json in a Takeout describes media
+		return nil, false
+	}
+	return &s, true
+}
+
+// takenTime is when the media was captured, the time the Library API reports as creationTime
+func (s *sidecar) takenTime() (time.Time, bool) {
+	if t, ok := s.PhotoTakenTime.Time(); ok {
+		return t, true
+	}
+	return s.CreationTime.Time()
+}
+
+// ImportTakeout saves the media in Google Takeout archives (.zip, .tgz, .tar.gz or extracted) with the same
+// layout, names and timestamps Extract uses, so both end up with one identical tree. Archives
+// are streamed twice, first for the small json sidecars, then for the media, and never extracted
+// to disk. Media without a sidecar is reported and skipped.
+func ImportTakeout(ctx context.Context, store storage.Storage, archives []string, options ...Option) error {
+	e := &extraction{store: store, duplicates: DuplicatesReport, dates: DatesAPI, source: SourceTakeout, log: slog.Default(), control: NewController(),
+		metrics: newSyncMetrics(metrics.NewRegistry())}
+	for _, option := range options {
+		option(e)
+	}
+	var err error
+	e.index, err = LoadIndex(store)
+	if err != nil {
+		return err
+	}
+
+	sidecars := newSidecars()
+	for _, archive := range archives {
+		err := walkArchive(archive, isSidecar, func(name string, r io.Reader) error {
+			if s, ok := readSidecar(r); ok {
+				s.name = name
+				sidecars.add(name, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// media is counted by save, which knows whether it was written or found already saved
+	before := e.control.Status().Progress
+	var unmatched int
+	for _, archive := range archives {
+		err := walkArchive(archive, isMedia, func(name string, r io.Reader) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			s, original := sidecars.find(name)
+			if s == nil {
+				unmatched++
+				e.log.Warn("no metadata, skipped", "name", name, "archive", archive)
+				return nil
+			}
+			created, ok := s.takenTime()
+			if !ok {
+				unmatched++
+				e.log.Warn("no time in metadata, skipped", "name", name, "metadata", s.name)
+				return nil
+			}
+			filename := path.Base(name)
+			if original {
+				filename = s.Title
+			}
+			mediaItem := data.MediaItem{
+				ID:          takeoutID(name),
+				Filename:    filename,
+				MimeType:    mimeType(name),
+				Metadata:    data.MediaMetadata{CreationTime: created},
+				Description: s.Description,
+			}
+			// streamed from the archive, unless it is read twice to place it by its contents
+			fetch := func() (io.ReadCloser, error) { return io.NopCloser(r), nil }
+			if e.dates != DatesAPI {
+				fetch = fetchBytes(func() ([]byte, error) { return io.ReadAll(r) })
+			}
+			if err := e.save(mediaItem, fetch); err != nil {
+				return fmt.Errorf("failed to import %s from %s: %v", name, archive, err)
+			}
+			return nil
+		})
+		if err != nil {
+			if saveErr := e.index.Save(store); saveErr != nil {
+				e.log.Error("failed to save index", "err", saveErr)
+			}
+			return err
+		}
+		if err := e.index.Save(store); err != nil {
+			return err
+		}
+	}
+	e.reportDates()
+	after := e.control.Status().Progress
+	e.log.Info("media imported", "count", after.Saved-before.Saved, "already_saved", after.Skipped-before.Skipped,
+		"without_metadata", unmatched)
+	return nil
+}
+
+// takeoutCollides is true when err is a file imported from another file of a Takeout whose
+// contents differ, like IMG_0001(1).JPG, another photo Google titled IMG_0001.JPG too. Copies of
+// the same media in album folders find their own file. The media is spooled to a temporary file
+// to compare it, which fetch then reads from until cleanup.
+func (e *extraction) takeoutCollides(mediaItem data.MediaItem, err error, fetch *func() (io.ReadCloser, error)) (bool, func(), error) {
+	noCleanup := func() {}
+	var existing *existingFile
+	if !errors.As(err, &existing) {
+		return false, noCleanup, nil
+	}
+	entry, ok := e.index.LookupPath(existing.name)
+	if !ok || entry.Source != SourceTakeout || entry.ID == mediaItem.ID {
+		return false, noCleanup, nil
+	}
+	if own, ok := e.index.Lookup(mediaItem.ID); ok {
+		// imported before, under this name or one of its own
+		return own.Path != existing.name, noCleanup, nil
+	}
+
+	r, err := (*fetch)()
+	if err != nil {
+		return false, noCleanup, fmt.Errorf("failed to read %s: %w", mediaItem.Filename, err)
+	}
+	defer r.Close()
+	spool, err := os.CreateTemp("", "photogo-takeout-*")
+	if err != nil {
+		return false, noCleanup, err
+	}
+	cleanup := func() { os.Remove(spool.Name()) }
+	_, err = io.Copy(spool, r)
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return false, noCleanup, fmt.Errorf("failed to read %s: %w", mediaItem.Filename, err)
+	}
+	*fetch = func() (io.ReadCloser, error) { return os.Open(spool.Name()) }
+
+	same, err := e.sameContents(existing.name, mediaItem, *fetch)
+	if err != nil {
+		cleanup()
+		return false, noCleanup, err
+	}
+	return !same, cleanup, nil
+}
+
+// sameContents is true when media fetched would be saved as the contents of name already are
+func (e *extraction) sameContents(name string, mediaItem data.MediaItem, fetch func() (io.ReadCloser, error)) (bool, error) {
+	saved, err := e.store.Open(name)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	defer saved.Close()
+	r, err := fetch()
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", mediaItem.Filename, err)
+	}
+	defer r.Close()
+	cmp := &comparer{r: saved}
+	if e.writeMetadata {
+		err = e.embed(cmp, r, name, mediaItem)
+	} else {
+		_, err = io.Copy(cmp, r)
+	}
+	if errors.Is(err, errDiffers) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return cmp.atEnd(), nil
+}
+
+var errDiffers = errors.New("contents differ")
+
+// comparer is a Writer that fails with errDiffers once what is written is not what r reads
+type comparer struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (c *comparer) Write(p []byte) (int, error) {
+	if cap(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+	b := c.buf[:len(p)]
+	if _, err := io.ReadFull(c.r, b); err != nil || !bytes.Equal(b, p) {
+		return 0, errDiffers
+	}
+	return len(p), nil
+}
+
+// atEnd is true when everything r had was written
+func (c *comparer) atEnd() bool {
+	var b [1]byte
+	_, err := io.ReadFull(c.r, b[:])
+	return err == io.EOF
+}
+
+// takeoutID identifies archive media in the index, the Library API id is not in the archive
+func takeoutID(name string) string {
+	return fmt.Sprintf("%s:%s", SourceTakeout, name)
+}
+
+func isSidecar(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".json")
+}
+
+var mediaExtensions = map[string]string{
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png", ".gif": "image/gif",
+	".heic": "image/heic", ".heif": "image/heif", ".webp": "image/webp", ".bmp": "image/bmp",
+	".tif": "image/tiff", ".tiff": "image/tiff", ".dng": "image/x-adobe-dng", ".cr2": "image/x-canon-cr2",
+	".nef": "image/x-nikon-nef", ".arw": "image/x-sony-arw", ".raw": "image/x-panasonic-raw",
+	".mp4": "video/mp4", ".m4v": "video/x-m4v", ".mov": "video/quicktime", ".3gp": "video/3gpp",
+	".avi": "video/x-msvideo", ".mkv": "video/x-matroska", ".mts": "video/mp2t", ".m2ts": "video/mp2t",
+	".wmv": "video/x-ms-wmv", ".mpg": "video/mpeg", ".mpeg": "video/mpeg",
+}
+
+func isMedia(name string) bool {
+	_, ok := mediaExtensions[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+func mimeType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := mediaExtensions[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// walkArchive calls fn, in archive order, with the contents of each entry that want accepts
+func walkArchive(archive string, want func(name string) bool, fn func(name string, r io.Reader) error) error {
+	lower := strings.ToLower(archive)
+	if info, err := os.Stat(archive); err == nil && info.IsDir() {
+		return walkDir(archive, want, fn)
+	}
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", archive, err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || !want(f.Name) {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("failed to read %s from %s: %v", f.Name, archive, err)
+			}
+			err = fn(f.Name, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasSuffix(lower, ".tgz"), strings.HasSuffix(lower, ".tar.gz"):
+		f, err := os.Open(archive)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", archive, err)
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", archive, err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", archive, err)
+			}
+			if header.Typeflag != tar.TypeReg || !want(header.Name) {
+				continue
+			}
+			if err := fn(header.Name, tr); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unsupported archive %s, expected .zip, .tgz, .tar.gz or an extracted directory", archive)
+}
+
+// walkDir calls fn like walkArchive for a Takeout archive that was already extracted into dir
+func walkDir(dir string, want func(name string) bool, fn func(name string, r io.Reader) error) error {
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil || d.IsDir() || !want(filepath.ToSlash(name)) {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fn(filepath.ToSlash(name), f)
+	})
+}
+
+// sidecars are indexed by directory, then by the name of the sidecar without .json
+type sidecars struct {
+	byDir map[string]map[string]*sidecar
+	// ordered are the names in a directory in order, sorted once all sidecars were added
+	ordered map[string][]string
+}
+
+func newSidecars() *sidecars {
+	return &sidecars{byDir: map[string]map[string]*sidecar{}, ordered: map[string][]string{}}
+}
+
+func (s *sidecars) add(name string, sc *sidecar) {
+	dir := path.Dir(name)
+	if s.byDir[dir] == nil {
+		s.byDir[dir] = map[string]*sidecar{}
+	}
+	s.byDir[dir][strings.TrimSuffix(path.Base(name), path.Ext(name))] = sc
+	delete(s.ordered, dir)
+}
+
+// minTruncatedStem is the shortest a sidecar name is cut to when Takeout truncates long names,
+// shorter names are never truncated
+const minTruncatedStem = 40
+
+var (
+	// IMG_1234(1).JPG is described by IMG_1234.JPG(1).json
+	numbered = regexp.MustCompile(`^(.*)(\(\d+\))(\.[^.]*)$`)
+	// edited copies share the sidecar of the original, the suffix is localized
+	edited = regexp.MustCompile(`(?i)-(edited|bearbeitet|modifié|editado|modificato|bewerkt|redigerad)(\.[^.]*)$`)
+)
+
+// find returns the sidecar describing the media at name in the archive. original is false when
+// the media is a variant, such as an edited copy, that should keep its own filename.
+func (s *sidecars) find(name string) (sc *sidecar, original bool) {
+	dir, base := path.Dir(name), path.Base(name)
+	if sc := s.match(dir, base); sc != nil {
+		return sc, true
+	}
+	if m := edited.FindStringSubmatch(base); m != nil {
+		if sc := s.match(dir, strings.TrimSuffix(base, m[0])+m[2]); sc != nil {
+			return sc, false
+		}
+	}
+	// a live photo's video is described by the photo's sidecar
+	stem := strings.TrimSuffix(base, path.Ext(base))
+	for _, name := range s.stems(dir) {
+		if sc := s.byDir[dir][name]; strings.TrimSuffix(sc.Title, path.Ext(sc.Title)) == stem && !strings.EqualFold(path.Ext(sc.Title), path.Ext(base)) {
+			return sc, false
+		}
+	}
+	return nil, false
+}
+
+// stems are the sidecar names in dir in order, so ties are broken the same on every run
+func (s *sidecars) stems(dir string) []string {
+	stems, ok := s.ordered[dir]
+	if !ok {
+		for stem := range s.byDir[dir] {
+			stems = append(stems, stem)
+		}
+		slices.Sort(stems)
+		s.ordered[dir] = stems
+	}
+	return stems
+}
+
+func (s *sidecars) match(dir, base string) *sidecar {
+	inDir := s.byDir[dir]
+	if inDir == nil {
+		return nil
+	}
+	candidates := []string{base, base + ".supplemental-metadata"}
+	if m := numbered.FindStringSubmatch(base); m != nil {
+		candidates = append(candidates, m[1]+m[3]+m[2], m[1]+m[3]+".supplemental-metadata"+m[2])
+	}
+	for _, candidate := range candidates {
+		if sc, ok := inDir[candidate]; ok {
+			return sc
+		}
+	}
+	for _, stem := range s.stems(dir) {
+		if sc := inDir[stem]; sc.Title == base {
+			return sc
+		}
+	}
+	// long sidecar names are truncated, and long media names may be too leaving the full name
+	// only in the title
+	var truncated *sidecar
+	var best string
+	for _, stem := range s.stems(dir) {
+		sc := inDir[stem]
+		if len(stem) < minTruncatedStem || len(stem) <= len(best) {
+			// the longest, then the first in order
+			continue
+		}
+		for _, candidate := range candidates {
+			mediaStem := strings.TrimSuffix(candidate, path.Ext(candidate))
+			if strings.HasPrefix(candidate, stem) || (len(mediaStem) >= minTruncatedStem && strings.HasPrefix(sc.Title, mediaStem)) {
+				truncated, best = sc, stem
+				break
+			}
+		}
+	}
+	return truncated
+}
@@ -0,0 +1,124 @@
+package photos
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"velocitizer.com/photogo/data"
+)
+
+// NameTemplate renames media from its metadata, e.g.
+//
+//	{{.Created.Format "20060102_150405"}}_{{short .ID}}{{ext}}
+//
+// The fields are those of NameData. The functions are:
+//
+//	original  the filename in Google Photos
+//	stem      the original filename without its extension
+//	ext       the lowercased extension, from the mime type when the filename has none
+//	short     a short, stable code for a value such as the ID
+//	camera    the camera model, empty when unknown
+//	lower, upper
+type NameTemplate struct {
+	template *template.Template
+}
+
+// NameData is what a NameTemplate is evaluated with
+type NameData struct {
+	ID          string
+	Filename    string
+	MimeType    string
+	Created     time.Time
+	CameraMake  string
+	CameraModel string
+}
+
+// ParseNameTemplate parses text, failing on templates that reference unknown fields or functions
+func ParseNameTemplate(text string) (*NameTemplate, error) {
+	t, err := template.New("name").Funcs(nameFuncs(NameData{})).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %v", err)
+	}
+	nt := &NameTemplate{template: t}
+	// evaluate once up front so mistakes surface before anything is downloaded
+	if _, err := nt.Execute(data.MediaItem{ID: "id", Filename: "IMG_0001.JPG", MimeType: "image/jpeg"}); err != nil {
+		return nil, err
+	}
+	return nt, nil
+}
+
+// WithNameTemplate renames media with t instead of keeping the Google Photos filename
+func WithNameTemplate(t *NameTemplate) Option {
+	return func(e *extraction) {
+		e.nameTemplate = t
+	}
+}
+
+// Execute returns the filename for mediaItem, before it is sanitized
+func (nt *NameTemplate) Execute(mediaItem data.MediaItem) (string, error) {
+	nd := NameData{
+		ID:       mediaItem.ID,
+		Filename: mediaItem.Filename,
+		MimeType: mediaItem.MimeType,
+		Created:  mediaItem.Metadata.CreationTime,
+	}
+	if photo := mediaItem.Metadata.Photo; photo != nil {
+		nd.CameraMake, nd.CameraModel = photo.CameraMake, photo.CameraModel
+	} else if video := mediaItem.Metadata.Video; video != nil {
+		nd.CameraMake, nd.CameraModel = video.CameraMake, video.CameraModel
+	}
+	t, err := nt.template.Clone()
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Funcs(nameFuncs(nd)).Execute(&b, nd); err != nil {
+		return "", fmt.Errorf("failed to name %s: %v", mediaItem.Filename, err)
+	}
+	name := strings.TrimSpace(b.String())
+	if name == "" {
+		return "", fmt.Errorf("failed to name %s: the template produced an empty name", mediaItem.Filename)
+	}
+	return name, nil
+}
+
+func nameFuncs(nd NameData) template.FuncMap {
+	return template.FuncMap{
+		"original": func() string { return nd.Filename },
+		"stem":     func() string { return strings.TrimSuffix(nd.Filename, path.Ext(nd.Filename)) },
+		"ext":      func() string { return extension(nd.Filename, nd.MimeType) },
+		"camera":   func() string { return nd.CameraModel },
+		"short":    ShortID,
+		"lower":    strings.ToLower,
+		"upper":    strings.ToUpper,
+	}
+}
+
+// ShortID is the first 8 hex digits of the SHA-256 of value. Google IDs share long prefixes,
+// so a plain prefix would collide.
+func ShortID(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:4])
+}
+
+var mimeExtensions = map[string]string{
+	"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif", "image/heic": ".heic",
+	"image/heif": ".heif", "image/webp": ".webp", "image/bmp": ".bmp", "image/tiff": ".tif",
+	"image/x-adobe-dng": ".dng", "video/mp4": ".mp4", "video/quicktime": ".mov", "video/3gpp": ".3gp",
+	"video/x-msvideo": ".avi", "video/x-matroska": ".mkv", "video/mp2t": ".mts", "video/mpeg": ".mpg",
+	"video/x-m4v": ".m4v", "video/x-ms-wmv": ".wmv",
+}
+
+// extension is the lowercased extension of filename, or the usual one for mimeType when it has none
+func extension(filename, mimeType string) string {
+	if ext := path.Ext(filename); ext != "" && ext != "." {
+		return strings.ToLower(ext)
+	}
+	return mimeExtensions[strings.ToLower(mimeType)]
+}
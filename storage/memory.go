@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Storage held in memory. It records every write, modification time and permission
+// so tests can assert on what would have reached disk without touching it.
+type Memory struct {
+	mu     sync.Mutex
+	nodes  map[string]*memNode
+	writes []string
+}
+
+type memNode struct {
+	data    bytes.Buffer
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+func NewMemory() *Memory {
+	return &Memory{nodes: map[string]*memNode{
+		".": {mode: fs.ModeDir | fs.ModePerm},
+	}}
+}
+
+func clean(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (m *Memory) lookup(op, name string) (*memNode, string, error) {
+	name = clean(name)
+	if name == "" {
+		name = "."
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, name, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return n, name, nil
+}
+
+func (m *Memory) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, name, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(name), nil
+}
+
+func (m *Memory) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, name, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return io.NopCloser(bytes.NewReader(bytes.Clone(n.data.Bytes()))), nil
+}
+
+func (m *Memory) Create(name string) (io.WriteCloser, error) {
+	return m.open(name, true, false)
+}
+
+func (m *Memory) CreateExclusive(name string) (io.WriteCloser, error) {
+	return m.open(name, true, true)
+}
+
+// Append opens the file to write at its end, creating it when missing
+func (m *Memory) Append(name string) (io.WriteCloser, error) {
+	return m.open(name, false, false)
+}
+
+// CreateSized creates the file filled with size zero bytes, to be written with WriteAt
+func (m *Memory) CreateSized(name string, size int64) (WriterAtCloser, error) {
+	w, err := m.open(name, true, false)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.n.data.Write(make([]byte, size))
+	return w, nil
+}
+
+func (m *Memory) OpenSized(name string) (WriterAtCloser, error) {
+	if _, err := m.Stat(name); err != nil {
+		return nil, err
+	}
+	return m.open(name, false, false)
+}
+
+func (m *Memory) open(name string, truncate, exclusive bool) (*memWriter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = clean(name)
+	parent, _, err := m.lookup("open", path.Dir(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n, ok := m.nodes[name]
+	if ok && (n.mode.IsDir() || exclusive) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	if !ok {
+		n = &memNode{mode: 0666}
+		m.nodes[name] = n
+	}
+	if truncate {
+		n.data.Reset()
+	}
+	n.modTime = time.Now()
+	m.writes = append(m.writes, name)
+	return &memWriter{m: m, n: n}, nil
+}
+
+type memWriter struct {
+	m *Memory
+	n *memNode
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	w.n.modTime = time.Now()
+	return w.n.data.Write(p)
+}
+
+func (w *memWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	data := w.n.data.Bytes()
+	if off < 0 || off+int64(len(p)) > int64(len(data)) {
+		return 0, fs.ErrInvalid
+	}
+	w.n.modTime = time.Now()
+	return copy(data[off:], p), nil
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
+
+func (m *Memory) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, oldName, err := m.lookup("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newName = clean(newName)
+	if _, _, err := m.lookup("rename", path.Dir(newName)); err != nil {
+		return err
+	}
+	moved := map[string]*memNode{}
+	for name, child := range m.nodes {
+		if strings.HasPrefix(name, oldName+"/") {
+			delete(m.nodes, name)
+			moved[newName+strings.TrimPrefix(name, oldName)] = child
+		}
+	}
+	for name, child := range moved {
+		m.nodes[name] = child
+	}
+	delete(m.nodes, oldName)
+	m.nodes[newName] = n
+	return nil
+}
+
+func (m *Memory) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, name, err := m.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	for other := range m.nodes {
+		if strings.HasPrefix(other, name+"/") {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+// Link makes newName share the contents and times of oldName, like a hard link.
+func (m *Memory) Link(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, _, err := m.lookup("link", oldName)
+	if err != nil {
+		return err
+	}
+	newName = clean(newName)
+	if _, ok := m.nodes[newName]; ok {
+		return &fs.PathError{Op: "link", Path: newName, Err: fs.ErrExist}
+	}
+	if _, _, err := m.lookup("link", path.Dir(newName)); err != nil {
+		return err
+	}
+	m.nodes[newName] = n
+	return nil
+}
+
+func (m *Memory) SetModTime(name string, modTime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, _, err := m.lookup("chtimes", name)
+	if err != nil {
+		return err
+	}
+	n.modTime = modTime
+	return nil
+}
+
+func (m *Memory) MkdirAll(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdirAll(clean(dir))
+}
+
+func (m *Memory) mkdirAll(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	var current string
+	for _, part := range strings.Split(dir, "/") {
+		current = path.Join(current, part)
+		n, ok := m.nodes[current]
+		if !ok {
+			m.nodes[current] = &memNode{mode: fs.ModeDir | fs.ModePerm, modTime: time.Now()}
+			continue
+		}
+		if !n.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: current, Err: fs.ErrExist}
+		}
+	}
+	return nil
+}
+
+func (m *Memory) List(dir string) ([]fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, dir, err := m.lookup("list", dir)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrInvalid}
+	}
+	var infos []fs.FileInfo
+	for name, child := range m.nodes {
+		if name != "." && path.Dir(name) == dir {
+			infos = append(infos, child.info(name))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// WriteFile seeds the named file, creating its directories, as if an earlier run had written it.
+func (m *Memory) WriteFile(name string, contents []byte, modTime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = clean(name)
+	if err := m.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	n := &memNode{mode: 0666, modTime: modTime}
+	n.data.Write(contents)
+	m.nodes[name] = n
+	return nil
+}
+
+// ReadFile returns the contents of the named file.
+func (m *Memory) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, _, err := m.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(n.data.Bytes()), nil
+}
+
+// Writes returns the names passed to Create, Append and CreateSized, in order.
+func (m *Memory) Writes() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.writes...)
+}
+
+func (m *Memory) String() string {
+	return "memory:"
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	return &fileInfo{
+		name:    path.Base(name),
+		size:    int64(n.data.Len()),
+		modTime: n.modTime,
+		dir:     n.mode.IsDir(),
+		mode:    n.mode,
+	}
+}
+
+var _ Storage = (*Memory)(nil)
+var _ Linker = (*Memory)(nil)
+var _ Appender = (*Memory)(nil)
+var _ RandomWriter = (*Memory)(nil)
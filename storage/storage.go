@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Storage is the destination media is written to. Names are slash separated
+// and relative to the root of the storage, e.g. "2009/05/IMG_0001.JPG".
+type Storage interface {
+	// Stat describes the named file. A missing file returns an error matching fs.ErrNotExist.
+	Stat(name string) (fs.FileInfo, error)
+	// Open opens the named file for reading.
+	Open(name string) (io.ReadCloser, error)
+	// Create opens the named file for writing, truncating it if it already exists.
+	Create(name string) (io.WriteCloser, error)
+	// CreateExclusive creates the named file for writing, failing with an error matching
+	// fs.ErrExist when it already exists, so two writers never share a file.
+	CreateExclusive(name string) (io.WriteCloser, error)
+	Rename(oldName, newName string) error
+	Remove(name string) error
+	SetModTime(name string, modTime time.Time) error
+	MkdirAll(dir string) error
+	// List returns the entries of dir, directories included.
+	List(dir string) ([]fs.FileInfo, error)
+}
+
+// Linker is implemented by storage that can hard link a file to a second name,
+// so identical media is only stored once.
+type Linker interface {
+	Link(oldName, newName string) error
+}
+
+// Appender is implemented by storage that can add to the end of a file, so an interrupted
+// download can continue where it stopped.
+type Appender interface {
+	// Append opens the file to write at its end, creating it when missing
+	Append(name string) (io.WriteCloser, error)
+}
+
+// RandomWriter is implemented by storage that can write a file out of order, so the parts of
+// one download can be written as they arrive.
+type RandomWriter interface {
+	// CreateSized creates the file at its full size, truncating it if it already exists,
+	// to be filled in with WriteAt
+	CreateSized(name string, size int64) (WriterAtCloser, error)
+	// OpenSized opens a file made by CreateSized to fill in more of it, keeping what it holds
+	OpenSized(name string) (WriterAtCloser, error)
+}
+
+type WriterAtCloser interface {
+	io.WriterAt
+	io.Closer
+}
+
+// Local is a Storage rooted at a directory of the local filesystem, or a mounted share.
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *Local) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(l.path(name))
+}
+
+func (l *Local) Open(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *Local) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(l.path(name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+}
+
+func (l *Local) CreateExclusive(name string) (io.WriteCloser, error) {
+	return os.OpenFile(l.path(name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+}
+
+func (l *Local) Rename(oldName, newName string) error {
+	return os.Rename(l.path(oldName), l.path(newName))
+}
+
+func (l *Local) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *Local) Append(name string) (io.WriteCloser, error) {
+	return os.OpenFile(l.path(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+}
+
+func (l *Local) CreateSized(name string, size int64) (WriterAtCloser, error) {
+	f, err := os.OpenFile(l.path(name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *Local) OpenSized(name string) (WriterAtCloser, error) {
+	return os.OpenFile(l.path(name), os.O_WRONLY, 0666)
+}
+
+func (l *Local) Link(oldName, newName string) error {
+	return os.Link(l.path(oldName), l.path(newName))
+}
+
+func (l *Local) SetModTime(name string, modTime time.Time) error {
+	return os.Chtimes(l.path(name), modTime, modTime)
+}
+
+func (l *Local) MkdirAll(dir string) error {
+	return os.MkdirAll(l.path(dir), os.ModePerm)
+}
+
+func (l *Local) List(dir string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(l.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (l *Local) String() string {
+	return l.root
+}
+
+var _ Storage = (*Local)(nil)
+var _ Linker = (*Local)(nil)
+var _ Appender = (*Local)(nil)
+var _ RandomWriter = (*Local)(nil)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	mode    fs.FileMode
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return f.dir }
+func (f *fileInfo) Sys() any           { return nil }
+func (f *fileInfo) Mode() fs.FileMode {
+	if f.mode != 0 {
+		return f.mode
+	}
+	if f.dir {
+		return fs.ModeDir | 0777
+	}
+	return 0666
+}
@@ -0,0 +1,193 @@
+package storage_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+	"velocitizer.com/photogo/storage"
+)
+
+func exercise(t *testing.T, store storage.Storage) {
+	modTime := time.Date(2009, 5, 13, 15, 4, 5, 0, time.UTC)
+
+	_, err := store.Stat("2009/05/sample.jpg")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+
+	require.NoError(t, store.MkdirAll("2009/05"))
+	require.NoError(t, store.MkdirAll("2009/05"), "creating an existing directory is not an error")
+
+	w, err := store.Create("2009/05/sample.jpg")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("contents of the file"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, store.SetModTime("2009/05/sample.jpg", modTime))
+	_, err = store.CreateExclusive("2009/05/sample.jpg")
+	assert.True(t, errors.Is(err, fs.ErrExist), "got %v", err)
+
+	info, err := store.Stat("2009/05/sample.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "sample.jpg", info.Name())
+	assert.EqualValues(t, 20, info.Size())
+	assert.False(t, info.IsDir())
+	assert.True(t, modTime.Equal(info.ModTime()), "got %s", info.ModTime())
+
+	r, err := store.Open("2009/05/sample.jpg")
+	require.NoError(t, err)
+	contents, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "contents of the file", string(contents))
+	_, err = store.Open("2009/05/missing.jpg")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+
+	w, err = store.Create("2009/05/other.jpg")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, store.Rename("2009/05/other.jpg", "2009/05/renamed.jpg"))
+	_, err = store.Stat("2009/05/other.jpg")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+
+	w, err = store.CreateExclusive("2009/05/removed.jpg")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, store.Remove("2009/05/removed.jpg"))
+	err = store.Remove("2009/05/removed.jpg")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+
+	if linker, ok := store.(storage.Linker); ok {
+		require.NoError(t, linker.Link("2009/05/sample.jpg", "2009/05/linked.jpg"))
+		info, err := store.Stat("2009/05/linked.jpg")
+		require.NoError(t, err)
+		assert.EqualValues(t, 20, info.Size())
+		require.NoError(t, store.Remove("2009/05/linked.jpg"))
+	}
+
+	if appender, ok := store.(storage.Appender); ok {
+		for _, part := range []string{"first ", "second"} {
+			w, err := appender.Append("2009/05/appended.jpg")
+			require.NoError(t, err)
+			_, err = w.Write([]byte(part))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+		}
+		r, err := store.Open("2009/05/appended.jpg")
+		require.NoError(t, err)
+		contents, err := io.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "first second", string(contents))
+		require.NoError(t, store.Remove("2009/05/appended.jpg"))
+	}
+
+	if random, ok := store.(storage.RandomWriter); ok {
+		w, err := random.CreateSized("2009/05/random.jpg", 12)
+		require.NoError(t, err)
+		for _, part := range []struct {
+			offset int64
+			data   string
+		}{{6, "second"}, {0, "first "}} {
+			_, err := w.WriteAt([]byte(part.data), part.offset)
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+		w, err = random.OpenSized("2009/05/random.jpg")
+		require.NoError(t, err)
+		_, err = w.WriteAt([]byte("third!"), 6)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		r, err := store.Open("2009/05/random.jpg")
+		require.NoError(t, err)
+		contents, err := io.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "first third!", string(contents))
+		require.NoError(t, store.Remove("2009/05/random.jpg"))
+	}
+
+	infos, err := store.List("2009/05")
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"renamed.jpg", "sample.jpg"}, names)
+
+	infos, err = store.List("2009")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.True(t, infos[0].IsDir())
+}
+
+func TestLocal(t *testing.T) {
+	exercise(t, storage.NewLocal(t.TempDir()))
+}
+
+func TestMemory(t *testing.T) {
+	store := storage.NewMemory()
+	exercise(t, store)
+
+	t.Run("records writes and permissions", func(t *testing.T) {
+		assert.Equal(t, []string{"2009/05/sample.jpg", "2009/05/other.jpg", "2009/05/removed.jpg", "2009/05/appended.jpg", "2009/05/appended.jpg", "2009/05/random.jpg", "2009/05/random.jpg"}, store.Writes())
+		contents, err := store.ReadFile("2009/05/sample.jpg")
+		require.NoError(t, err)
+		assert.Equal(t, "contents of the file", string(contents))
+
+		info, err := store.Stat("2009/05/sample.jpg")
+		require.NoError(t, err)
+		assert.Equal(t, fs.FileMode(0666), info.Mode())
+		info, err = store.Stat("2009")
+		require.NoError(t, err)
+		assert.Equal(t, fs.ModeDir|fs.ModePerm, info.Mode())
+	})
+	t.Run("create needs the directory", func(t *testing.T) {
+		_, err := store.Create("2010/01/sample.jpg")
+		assert.True(t, errors.Is(err, fs.ErrNotExist), "got %v", err)
+	})
+}
+
+func TestWebDAV(t *testing.T) {
+	handler := &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "photogo" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// x/net/webdav ignores conditional PUTs, which Apache and Synology honor
+		if _, err := handler.FileSystem.Stat(r.Context(), r.URL.Path); err == nil && r.Method == http.MethodPut && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	t.Run("backend operations", func(t *testing.T) {
+		endpoint := "http://photogo:secret@" + server.Listener.Addr().String() + "/"
+		store, err := storage.NewWebDAV(endpoint, server.Client())
+		require.NoError(t, err)
+		assert.Equal(t, server.URL, store.String(), "credentials are not displayed")
+		exercise(t, store)
+	})
+	t.Run("unauthorized", func(t *testing.T) {
+		store, err := storage.NewWebDAV(server.URL, server.Client())
+		require.NoError(t, err)
+		assert.Error(t, store.MkdirAll("2009"))
+		_, err = store.Stat("2009")
+		assert.Error(t, err)
+	})
+	t.Run("invalid endpoint", func(t *testing.T) {
+		_, err := storage.NewWebDAV("ftp://nas/photo", nil)
+		assert.Error(t, err)
+	})
+}